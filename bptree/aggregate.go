@@ -0,0 +1,243 @@
+package bptree
+
+import (
+	"github.com/madokast/bptree/memory"
+	"unsafe"
+)
+
+/**
+区间聚合
+每个 node 之后紧跟一段 SummarySize 大小的聚合值，表示以该 node 为根的子树的聚合结果。
+中间节点的 item 指向子节点，子节点的聚合值就是该 item 对应的聚合值。
+Aggregate(from, to) 下降时，完全落在区间内的子树直接取聚合值，只有区间两端的路径需要继续下降，因此是 O(log n)
+*/
+
+// Aggregator 用户自定义的聚合器，需要满足幺半群性质：Combine 满足结合律，Identity 是单位元
+// 所有指针都指向 SummarySize 大小的内存
+type Aggregator interface {
+	// SummarySize 聚合值大小，固定不变
+	SummarySize() uint32
+	// Identity 把单位元写入 dst
+	Identity(dst uintptr)
+	// Leaf 把单个键值对的聚合值写入 dst。key = 0 表示 key 为 null，value = 0 表示 value 为 null
+	Leaf(key uintptr, value uintptr, dst uintptr)
+	// Combine 把 a ⊕ b 写入 dst，dst 可能与 a 或 b 相同
+	Combine(a, b uintptr, dst uintptr)
+}
+
+// PointerAggregator 与 Aggregator 相同，指针以 unsafe.Pointer 传递，null 为 nil
+// uintptr 不能保证内存不被回收，也不能通过 checkptr 检查，新的聚合器应当实现该接口
+type PointerAggregator interface {
+	SummarySize() uint32
+	IdentityPointer(dst unsafe.Pointer)
+	LeafPointer(key, value unsafe.Pointer, dst unsafe.Pointer)
+	CombinePointer(a, b unsafe.Pointer, dst unsafe.Pointer)
+}
+
+// uintptrAggregator 把只实现了 Aggregator 的聚合器适配为 PointerAggregator
+type uintptrAggregator struct {
+	Aggregator
+}
+
+func (a uintptrAggregator) IdentityPointer(dst unsafe.Pointer) {
+	a.Identity(uintptr(dst))
+}
+
+func (a uintptrAggregator) LeafPointer(key, value unsafe.Pointer, dst unsafe.Pointer) {
+	a.Leaf(uintptr(key), uintptr(value), uintptr(dst))
+}
+
+func (a uintptrAggregator) CombinePointer(x, y unsafe.Pointer, dst unsafe.Pointer) {
+	a.Combine(uintptr(x), uintptr(y), uintptr(dst))
+}
+
+// Aggregate 计算闭区间 [from, to] 内所有键值对的聚合值，写入 dst
+// from、to = 0 表示 null，null 的位置由 WithNullOrder 决定
+func (t *Tree) Aggregate(from, to uintptr, dst uintptr) {
+	t.AggregatePointer(memory.UintptrPointer(from), memory.UintptrPointer(to), memory.UintptrPointer(dst))
+}
+
+// AggregatePointer 与 Aggregate 相同，指针以 unsafe.Pointer 传递，null 为 nil
+func (t *Tree) AggregatePointer(from, to unsafe.Pointer, dst unsafe.Pointer) {
+	t.enter()
+	defer t.exit()
+	agg := t.opts.aggregator
+	if agg == nil {
+		panic("no aggregator")
+	}
+	agg.IdentityPointer(dst)
+	if t.root == nil {
+		return
+	}
+	t.aggregate(t.root, from, to, false, false, dst, t.summaryBuffer())
+}
+
+// aggregate 把 n 子树中落在 [from, to] 的部分合并到 dst。buf 为临时空间
+// lowCovered 表示 from 不大于子树中所有 key，highCovered 表示 to 不小于子树中所有 key
+func (t *Tree) aggregate(n *node, from, to unsafe.Pointer, lowCovered, highCovered bool, dst unsafe.Pointer, buf unsafe.Pointer) {
+	agg := t.opts.aggregator
+	if lowCovered && highCovered {
+		agg.CombinePointer(dst, t.summaryOf(n), dst)
+		return
+	}
+
+	for i := uint32(0); i < n.itemNumber.get(); i++ {
+		it := n.item(i)
+		if n.isLeaf() {
+			if t.compare(from, &it.key, it.null) <= 0 && t.compare(to, &it.key, it.null) >= 0 {
+				t.leafSummary(it, buf)
+				agg.CombinePointer(dst, buf, dst)
+			}
+			continue
+		}
+
+		// 子树 i 中的 key 都不大于 items[i].key，且不小于 items[i-1].key
+		if t.compare(from, &it.key, it.null) > 0 {
+			continue
+		}
+		childLow := lowCovered
+		if i > 0 {
+			prev := n.item(i - 1)
+			if t.compare(to, &prev.key, prev.null) < 0 {
+				break
+			}
+			childLow = t.compare(from, &prev.key, prev.null) <= 0
+		}
+		childHigh := t.compare(to, &it.key, it.null) >= 0
+		child := t.readNode(it.valueLoc)
+		t.aggregate(child, from, to, childLow, childHigh, dst, buf)
+		t.releaseNode(child)
+	}
+}
+
+// summarySize node 之后附带的聚合值大小
+func (t *Tree) summarySize() uint32 {
+	if t.opts.aggregator == nil {
+		return 0
+	}
+	return t.opts.aggregator.SummarySize()
+}
+
+// summaryBuffer 聚合值的临时空间，由 Tree 引用，重复使用
+func (t *Tree) summaryBuffer() unsafe.Pointer {
+	if t.summaryBuf == nil {
+		t.summaryBuf = make([]byte, t.summarySize())
+	}
+	return unsafe.Pointer(&t.summaryBuf[0])
+}
+
+// summaryOf node 的聚合值地址，紧跟在 node 的 degree 个 item 之后
+func (t *Tree) summaryOf(n *node) unsafe.Pointer {
+	return unsafe.Add(unsafe.Pointer(n), t.nodeSize())
+}
+
+// leafSummary 叶子节点中单个 item 的聚合值
+// 遍历整棵树时（Verify、Aggregate）会读取每个 value，见 pinValue
+func (t *Tree) leafSummary(it *item, dst unsafe.Pointer) {
+	var value unsafe.Pointer
+	if !it.isNullValue() {
+		record := t.pinValue(it.valueLoc)
+		defer t.releaseValue(it.valueLoc)
+		t.verifyValue(it.valueLoc, record)
+		value = recordPointer(record)
+	}
+	t.opts.aggregator.LeafPointer(t.keyPointer(it), value, dst)
+}
+
+// refreshSummary 由 n 的 item 或子节点的聚合值重算 n 的聚合值
+// 校验和覆盖聚合值，所以同时重算校验和
+func (t *Tree) refreshSummary(n *node) {
+	t.computeSummary(n, t.summaryOf(n), t.summaryBuffer())
+	t.seal(n)
+	t.dirty(n)
+}
+
+// computeSummary 由 n 的 item 或子节点的聚合值计算 n 的聚合值，写入 dst。tmp 为临时空间
+func (t *Tree) computeSummary(n *node, dst unsafe.Pointer, tmp unsafe.Pointer) {
+	agg := t.opts.aggregator
+	agg.IdentityPointer(dst)
+	for i := uint32(0); i < n.itemNumber.get(); i++ {
+		it := n.item(i)
+		if n.isLeaf() {
+			t.leafSummary(it, tmp)
+			agg.CombinePointer(dst, tmp, dst)
+		} else {
+			child := t.readNode(it.valueLoc)
+			agg.CombinePointer(dst, t.summaryOf(child), dst)
+			t.releaseNode(child)
+		}
+	}
+}
+
+// refreshSummaryUp 重算 n 及其所有祖先的聚合值
+func (t *Tree) refreshSummaryUp(n *node) {
+	for {
+		t.refreshSummary(n)
+		if n.fatherPoint.get().BlockId == nullBlockBidFlag {
+			return
+		}
+		n = t.readNode(n.fatherPoint.get())
+	}
+}
+
+/*========== 内置聚合器 =============*/
+
+// Int64Stats 统计 int64 类型 value 的个数、和、最小值、最大值。null value 只计入 Count
+type Int64Stats struct {
+	Count    int64
+	NotNull  int64
+	Sum      int64
+	Min, Max int64
+}
+
+// Int64StatsAggregator value 为 int64 时的统计聚合器，聚合值为 Int64Stats。同时实现了 Aggregator 和 PointerAggregator
+type Int64StatsAggregator struct{}
+
+func (Int64StatsAggregator) SummarySize() uint32 {
+	return uint32(unsafe.Sizeof(Int64Stats{}))
+}
+
+func (a Int64StatsAggregator) Identity(dst uintptr) {
+	a.IdentityPointer(memory.UintptrPointer(dst))
+}
+
+func (a Int64StatsAggregator) Leaf(key uintptr, value uintptr, dst uintptr) {
+	a.LeafPointer(memory.UintptrPointer(key), memory.UintptrPointer(value), memory.UintptrPointer(dst))
+}
+
+func (a Int64StatsAggregator) Combine(x, y uintptr, dst uintptr) {
+	a.CombinePointer(memory.UintptrPointer(x), memory.UintptrPointer(y), memory.UintptrPointer(dst))
+}
+
+func (Int64StatsAggregator) IdentityPointer(dst unsafe.Pointer) {
+	*(*Int64Stats)(dst) = Int64Stats{}
+}
+
+func (Int64StatsAggregator) LeafPointer(key, value unsafe.Pointer, dst unsafe.Pointer) {
+	s := Int64Stats{Count: 1}
+	if value != nil {
+		v := *((*int64)(value))
+		s.NotNull, s.Sum, s.Min, s.Max = 1, v, v, v
+	}
+	*(*Int64Stats)(dst) = s
+}
+
+func (Int64StatsAggregator) CombinePointer(a, b unsafe.Pointer, dst unsafe.Pointer) {
+	sa, sb := *(*Int64Stats)(a), *(*Int64Stats)(b)
+	s := Int64Stats{Count: sa.Count + sb.Count, NotNull: sa.NotNull + sb.NotNull, Sum: sa.Sum + sb.Sum}
+	switch {
+	case sa.NotNull == 0:
+		s.Min, s.Max = sb.Min, sb.Max
+	case sb.NotNull == 0:
+		s.Min, s.Max = sa.Min, sa.Max
+	default:
+		s.Min, s.Max = sa.Min, sa.Max
+		if sb.Min < s.Min {
+			s.Min = sb.Min
+		}
+		if sb.Max > s.Max {
+			s.Max = sb.Max
+		}
+	}
+	*(*Int64Stats)(dst) = s
+}
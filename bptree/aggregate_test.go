@@ -0,0 +1,97 @@
+package bptree
+
+import (
+	"fmt"
+	"github.com/madokast/bptree/memory"
+	"math/rand"
+	"testing"
+	"unsafe"
+)
+
+var stats = new(Int64Stats)
+var stats2 = new(Int64Stats)
+
+func aggregateOf(tree *Tree, from, to int64) Int64Stats {
+	*key3, *key4 = from, to
+	tree.AggregatePointer(unsafe.Pointer(key3), unsafe.Pointer(key4), unsafe.Pointer(stats))
+	return *stats
+}
+
+func bruteStats(m map[int64]*int64, from, to int64) Int64Stats {
+	agg := Int64StatsAggregator{}
+	agg.IdentityPointer(unsafe.Pointer(stats))
+	for k, v := range m {
+		if k < from || k > to {
+			continue
+		}
+		if v == nil {
+			agg.LeafPointer(nil, nil, unsafe.Pointer(stats2))
+		} else {
+			agg.LeafPointer(nil, unsafe.Pointer(v), unsafe.Pointer(stats2))
+		}
+		agg.CombinePointer(unsafe.Pointer(stats), unsafe.Pointer(stats2), unsafe.Pointer(stats))
+	}
+	return *stats
+}
+
+func TestAggregateEmpty(t *testing.T) {
+	tree := New(memory.New(1024), nil, int64Keys, WithPointerAggregator(Int64StatsAggregator{}))
+	s := aggregateOf(tree, -100, 100)
+	if s != (Int64Stats{}) {
+		panic(fmt.Sprint(s))
+	}
+}
+
+func TestAggregateRandom(t *testing.T) {
+	for temp := 0; temp < 100; temp++ {
+		directory := memory.New(1024)
+		tree := New(directory, nil, int64Keys, WithPointerAggregator(Int64StatsAggregator{}))
+		m := map[int64]*int64{}
+		for i := 0; i < 300; i++ {
+			*key = int64(rand.Int31n(200)) - 100
+			if rand.Intn(10) == 0 {
+				m[*key] = nil
+				tree.InsertPointer(unsafe.Pointer(key), nil, 0)
+			} else {
+				*key2 = int64(rand.Int31n(1000)) - 500
+				v := *key2
+				m[*key] = &v
+				tree.InsertPointer(unsafe.Pointer(key), unsafe.Pointer(key2), 8)
+			}
+		}
+
+		for i := 0; i < 50; i++ {
+			from := int64(rand.Int31n(240)) - 120
+			to := from + int64(rand.Int31n(100))
+			got, want := aggregateOf(tree, from, to), bruteStats(m, from, to)
+			if got != want {
+				panic(fmt.Sprintf("[%d, %d] got %v want %v", from, to, got, want))
+			}
+		}
+	}
+}
+
+func TestAggregateNullKey(t *testing.T) {
+	directory := memory.New(1024)
+	tree := New(directory, nil, int64Keys, WithPointerAggregator(Int64StatsAggregator{}))
+	*key2 = 5
+	tree.InsertPointer(nil, unsafe.Pointer(key2), 8)
+	for i := 0; i < 10; i++ {
+		*key = int64(i)
+		*key2 = int64(i * 10)
+		tree.InsertPointer(unsafe.Pointer(key), unsafe.Pointer(key2), 8)
+	}
+
+	// [null, 9] 包含全部
+	*key = 9
+	tree.AggregatePointer(nil, unsafe.Pointer(key), unsafe.Pointer(stats))
+	if *stats != (Int64Stats{Count: 11, NotNull: 11, Sum: 455, Min: 0, Max: 90}) {
+		panic(fmt.Sprint(*stats))
+	}
+
+	// [null, null] 只有 null key
+	tree.AggregatePointer(nil, nil, unsafe.Pointer(stats))
+	if *stats != (Int64Stats{Count: 1, NotNull: 1, Sum: 5, Min: 5, Max: 5}) {
+		panic(fmt.Sprint(*stats))
+	}
+}
@@ -0,0 +1,190 @@
+package bptree
+
+import (
+	"fmt"
+	"github.com/madokast/bptree/memory"
+	"math/rand"
+	"sort"
+	"testing"
+	"unsafe"
+)
+
+/*
+性能测试
+插入：顺序、随机、Zipf 分布（大量重复 key 的更新）
+查找：命中、不命中
+遍历：全量、从某个 key 开始的 100 个
+对照：Go map、有序 slice 上的 sort.Search
+bytes/key 为 memory.Directory 分配的字节数除以键值对数目，包括 node、value 和元数据
+*/
+
+const benchKeys = 100000
+
+var benchDegrees = []int{3, 64}
+
+// benchKeySet 不同分布的 key，偶数用于插入，奇数用于不命中的查找
+func benchKeySet(dist string) []int64 {
+	r := rand.New(rand.NewSource(1))
+	ks := make([]int64, benchKeys)
+	switch dist {
+	case "sequential":
+		for i := range ks {
+			ks[i] = int64(i) * 2
+		}
+	case "random":
+		for i := range ks {
+			ks[i] = r.Int63n(benchKeys*100) * 2
+		}
+	case "zipf":
+		z := rand.NewZipf(r, 1.1, 1, benchKeys-1)
+		for i := range ks {
+			ks[i] = int64(z.Uint64()) * 2
+		}
+	default:
+		panic(dist)
+	}
+	return ks
+}
+
+// benchTree 插入 ks 的树，value 为 key 本身
+func benchTree(ks []int64, degree int) (*Tree, *memory.Directory) {
+	directory := memory.New(1 << 20)
+	tree := New(directory, nil, WithKeyType(KeyInt64), WithDegree(degree))
+	for _, k := range ks {
+		*key = k
+		tree.InsertPointer(unsafe.Pointer(key), unsafe.Pointer(key), 8)
+	}
+	return tree, directory
+}
+
+// sortedKeys 去重并排序，作为 sort.Search 的对照
+func sortedKeys(ks []int64) []int64 {
+	sorted := append([]int64{}, ks...)
+	sort.Slice(sorted, func(i, j int) bool { return sorted[i] < sorted[j] })
+	n := 0
+	for i, k := range sorted {
+		if i == 0 || k != sorted[n-1] {
+			sorted[n] = k
+			n++
+		}
+	}
+	return sorted[:n]
+}
+
+func BenchmarkInsert(b *testing.B) {
+	for _, dist := range []string{"sequential", "random", "zipf"} {
+		ks := benchKeySet(dist)
+		for _, degree := range benchDegrees {
+			b.Run(fmt.Sprintf("%s/degree=%d", dist, degree), func(b *testing.B) {
+				var directory *memory.Directory
+				var tree *Tree
+				for i := 0; i < b.N; i++ {
+					if i%benchKeys == 0 { // 每 benchKeys 个重建一棵树
+						b.StopTimer()
+						directory = memory.New(1 << 20)
+						tree = New(directory, nil, WithKeyType(KeyInt64), WithDegree(degree))
+						b.StartTimer()
+					}
+					*key = ks[i%benchKeys]
+					tree.InsertPointer(unsafe.Pointer(key), unsafe.Pointer(key), 8)
+				}
+				b.StopTimer()
+				if s := tree.Stats(); s.Entries > 0 {
+					b.ReportMetric(float64(directory.AllocatedBytes())/float64(s.Entries), "bytes/key")
+				}
+			})
+		}
+		b.Run(dist+"/map", func(b *testing.B) {
+			var m map[int64]int64
+			for i := 0; i < b.N; i++ {
+				if i%benchKeys == 0 {
+					m = make(map[int64]int64)
+				}
+				m[ks[i%benchKeys]] = ks[i%benchKeys]
+			}
+		})
+	}
+}
+
+func BenchmarkFind(b *testing.B) {
+	ks := benchKeySet("random")
+	sorted := sortedKeys(ks)
+	for _, c := range []struct {
+		name  string
+		delta int64 // 插入的 key 都是偶数，加 1 后不命中
+	}{{"hit", 0}, {"miss", 1}} {
+		for _, degree := range benchDegrees {
+			b.Run(fmt.Sprintf("%s/degree=%d", c.name, degree), func(b *testing.B) {
+				tree, _ := benchTree(ks, degree)
+				b.ResetTimer()
+				for i := 0; i < b.N; i++ {
+					*key = ks[i%benchKeys] + c.delta
+					if exist, _ := tree.FindPointer(unsafe.Pointer(key)); exist != (c.delta == 0) {
+						panic(*key)
+					}
+				}
+			})
+		}
+		b.Run(c.name+"/map", func(b *testing.B) {
+			m := make(map[int64]int64, benchKeys)
+			for _, k := range ks {
+				m[k] = k
+			}
+			b.ResetTimer()
+			for i := 0; i < b.N; i++ {
+				if _, exist := m[ks[i%benchKeys]+c.delta]; exist != (c.delta == 0) {
+					panic(i)
+				}
+			}
+		})
+		b.Run(c.name+"/sort.Search", func(b *testing.B) {
+			for i := 0; i < b.N; i++ {
+				k := ks[i%benchKeys] + c.delta
+				j := sort.Search(len(sorted), func(j int) bool { return sorted[j] >= k })
+				if (j < len(sorted) && sorted[j] == k) != (c.delta == 0) {
+					panic(k)
+				}
+			}
+		})
+	}
+}
+
+func BenchmarkScan(b *testing.B) {
+	ks := benchKeySet("random")
+	sorted := sortedKeys(ks)
+	for _, degree := range benchDegrees {
+		tree, _ := benchTree(ks, degree)
+		// 全量遍历，ns/op 为每个键值对的耗时
+		b.Run(fmt.Sprintf("full/degree=%d", degree), func(b *testing.B) {
+			iter := tree.Scan()
+			for i := 0; i < b.N; i++ {
+				if !iter.Next() {
+					iter = tree.Scan()
+					iter.Next()
+				}
+				_ = iter.ValuePointer()
+			}
+		})
+		// 从随机的 key 开始遍历 100 个
+		b.Run(fmt.Sprintf("range100/degree=%d", degree), func(b *testing.B) {
+			for i := 0; i < b.N; i++ {
+				*key = ks[i%benchKeys]
+				iter := tree.seek(unsafe.Pointer(key), nil)
+				for j := 0; j < 100 && iter.Next(); j++ {
+					_ = iter.ValuePointer()
+				}
+			}
+		})
+	}
+	b.Run("range100/sort.Search", func(b *testing.B) {
+		sum := int64(0)
+		for i := 0; i < b.N; i++ {
+			k := ks[i%benchKeys]
+			j := sort.Search(len(sorted), func(j int) bool { return sorted[j] >= k })
+			for end := j + 100; j < end && j < len(sorted); j++ {
+				sum += sorted[j]
+			}
+		}
+		_ = sum
+	})
+}
@@ -1,8 +1,11 @@
 package bptree
 
 import (
+	"bytes"
+	"encoding/binary"
+	"errors"
 	"github.com/madokast/bptree/memory"
-	"reflect"
+	"hash/crc32"
 	"strconv"
 	"strings"
 	"unsafe"
@@ -10,7 +13,7 @@ import (
 
 /**
 B+树
-1. 每个节点最多 degree 个 key。
+1. 每个节点最多 degree 个 key，degree 由 WithDegree 指定，默认为 3。节点内二分查找
 2. key 的数目和子节点数目相同，即 key 和叶子节点一一对应。key 就是对应的叶子节点中最大的 key
 3. key 可以为 null，非空时占用 8 bytes 空间，因此可以直接存储 int64、float64 数据。如果是 string 等变长类型需要先 hash 到 int64，在变长的 value 中链式存储
 4. value 可以为 null，空间大小不限
@@ -19,8 +22,10 @@ B+树
 const (
 	assert    = true
 	printMode = true
-	// 度。即节点 item 最大数目，决定节点大小
-	degree = 3
+	// 默认的度。即节点 item 最大数目，决定节点大小
+	defaultDegree = 3
+	// 度的上限
+	maxDegree = 1 << 12
 	// key 长度，不要改
 	keySize = 8
 	// node 模式，叶子节点、根节点、中间节点
@@ -32,11 +37,22 @@ const (
 	notNullKeyFlag   = byte(1 << 3)
 	nullBlockBidFlag = uint32(0x_FFFF_FFFF)
 	nullStr          = "nil"
+	// value 头部长度，保存 value 的长度
+	valueHeaderSz = uint32(8)
 )
 
-var nodeSz = uint32(unsafe.Sizeof(node{}))
+// node 头的大小，items 紧跟在 node 头之后，node 实际大小为 nodeHeaderSz + degree * itemSz
+var nodeHeaderSz = uint32(unsafe.Sizeof(node{}))
 var itemSz = uint32(unsafe.Sizeof(item{}))
 
+// node、meta 的地址按 8 bytes 对齐，不论之前分配了多长的 value。头字段都是字节数组，结构体本身的对齐是 1，
+// 这里的对齐保证紧跟 node 头的 item 中的 key 可以直接读取 int64、float64
+const nodeAlign = uint32(8)
+const metaAlign = uint32(8)
+
+// value 记录按 8 bytes 对齐，数据部分紧跟 8 bytes 的头，因此可以直接读取 int64、float64 等 value
+const valueAlign = uint32(8)
+
 // item 保存 key 值和指针信息
 type item struct {
 	null     byte // 第一个 byte 指定表示 key 为 null 与否
@@ -45,241 +61,357 @@ type item struct {
 	valueLoc memory.Location // blockId = nullBlockBidFlag 表示 null
 }
 
+// node 的磁盘格式见 layout.go
 type node struct {
-	itemNumber  uint32 // items 数目
-	mode        byte   // 节点模式，叶子节点、根节点、中间节点
-	padding     [3]byte
-	items       [degree]item    // item 数据
-	selfPoint   memory.Location // node 自己的地址信息
-	fatherPoint memory.Location // father 指向父节点。fatherBlockId = nullBlockBidFlag 表示父节点为 null，说明自己就是根
-	nextPoint   memory.Location // next 指向下一兄弟节点。nextBlockId = nullBlockBidFlag 表示下一兄弟节点为 null，说明自己就是最右边一个节点
+	magic       le16       // nodeMagic，用于发现损坏
+	version     byte       // formatVersion
+	mode        byte       // 节点模式，叶子节点、根节点、中间节点
+	itemNumber  le32       // items 数目
+	selfPoint   leLocation // node 自己的地址信息
+	fatherPoint leLocation // father 指向父节点。fatherBlockId = nullBlockBidFlag 表示父节点为 null，说明自己就是根
+	nextPoint   leLocation // next 指向下一兄弟节点。nextBlockId = nullBlockBidFlag 表示下一兄弟节点为 null，说明自己就是最右边一个节点
+	// 之后是 degree 个 item，见 item、items。不声明为数组字段，*node 只覆盖 node 头，不会越过实际分配的内存
 }
 
 type Tree struct {
-	root    *node
-	dir     memory.MemManager
-	compare func(key1 uintptr, key2 *[keySize]byte, key2Null byte) int
+	root      *node
+	metaPoint memory.Location // 元数据的地址，见 meta
+	dir       memory.MemManager
+	compare   func(key1 unsafe.Pointer, key2 *[keySize]byte, key2Null byte) int
+	opts      options
+	touched   []*node           // 本次操作中被修改过的 node，操作结束时统一处理（如重算聚合值）
+	reserved  []memory.Location // 分裂之前预先分配的 node，见 reserveNodes。保存地址而不是指针，可以跨越操作
+	// dir 实现了 memory.Scoped 时，每个操作在 Enter、Exit 之间进行，操作之间 node 可能被移动，见 enter
+	scoped   bool
+	volatile bool            // dir 同时被其他进程修改（memory.Volatile），每个操作开始时从元数据读取根
+	readOnly bool            // OpenReadOnly 打开，不能修改 dir 中的任何内存
+	depth    int             // 操作的嵌套层数
+	rootLoc  memory.Location // root 的地址，操作开始时由它重新得到 root
+	// dir 同时实现了 memory.Pinner 时，readNode 逐个 Pin 住 node，见 pinNode
+	pinner bool
+	pins   []memory.Location // 本次操作中 Pin 住、还没有释放的 node
+	// InsertBytes、GetBytes 的 key，放在堆上并由 Tree 引用，见 bytesKey
+	keyBuf []byte
+	// ChecksumSampled 抽样的随机数状态
+	checksumSeed uint32
+	// 聚合值的临时空间
+	summaryBuf []byte
 }
 
-func New(dir memory.MemManager, compareFunc func(k1, k2 uintptr) int) *Tree {
-	return &Tree{
+// New 在 dir 中新建一棵空树，元数据立即分配，其地址见 MetaLocation，之后可以用 Open 重新打开
+// 指定了 WithKeyType 时 compareFunc 可以为 nil。compareFunc 与 key 类型不一致时 panic(ErrComparatorMismatch)
+func New(dir memory.MemManager, compareFunc func(k1, k2 uintptr) int, opts ...Option) *Tree {
+	o := newOptions(opts)
+	compare, err := o.resolveCompare(compareFunc)
+	if err != nil {
+		panic(err)
+	}
+	t := &Tree{
 		root: nil,
 		dir:  dir,
-		compare: func(key1 uintptr, key2 *[keySize]byte, key2Null byte) int {
-			// key1 == null 视为最小元素
-			if key1 == 0 {
-				if key2Null == nullKeyFlag {
-					return 0
-				} else {
-					return -1
-				}
-			} else {
-				if key2Null == nullKeyFlag {
-					return 1
-				}
-				return compareFunc(key1, uintptr(unsafe.Pointer(key2)))
-			}
-		},
-	}
+		opts: o,
+	}
+	t.compare = o.wrapCompare(compare, t.slotPointer)
+	t.detectDir()
+	t.enter()
+	defer t.exit()
+	t.newMeta()
+	return t
 }
 
-// Insert 插入或者 update value
+// Insert 插入或者 update value。multimap 模式下相同的 key 不会覆盖，而是按插入顺序追加在后面
 // key = 0 表示 key 为 null。value = 0 表示 value 为 null
+// uintptr 不能保证 key、value 不被回收，见 InsertPointer
 func (t *Tree) Insert(key uintptr, value uintptr, valueLength uint32) {
+	t.InsertPointer(memory.UintptrPointer(key), memory.UintptrPointer(value), valueLength)
+}
+
+// InsertPointer 与 Insert 相同，key、value 以 unsafe.Pointer 传递，调用期间 GC 可以看到它们
+// key = nil 表示 key 为 null。value = nil 表示 value 为 null
+func (t *Tree) InsertPointer(key unsafe.Pointer, value unsafe.Pointer, valueLength uint32) {
+	t.enter()
+	defer t.exit()
+	if key == nil && t.opts.noNullKeys {
+		panic(ErrNullKey)
+	}
 	// 将 value、valueLength 转为定长的 blockId、blockOffset
-	if value == 0 {
+	if value == nil {
 		t.insert0(key, memory.Location{BlockId: nullBlockBidFlag})
 	} else {
-		diskPtr, pointer := t.dir.Allocate(valueLength)
-		memCopy(value, pointer, valueLength)
-		t.insert0(key, diskPtr)
+		t.insert0(key, t.newValue(value, valueLength))
 	}
+	t.flushTouched()
+}
+
+// TryInsert 与 Insert 相同，但 dir 空间不足（panic(memory.ErrOutOfSpace)）时返回错误
+// 分裂需要的 node 在修改树之前预先分配，失败时树保持一致，之前插入的键值对都在。最大 key 可能已经更新为 key，不影响查找
+// 读到校验失败的 node 时返回 *ChecksumError
+func (t *Tree) TryInsert(key uintptr, value uintptr, valueLength uint32) (err error) {
+	return t.TryInsertPointer(memory.UintptrPointer(key), memory.UintptrPointer(value), valueLength)
+}
+
+// TryInsertPointer 与 TryInsert 相同，key、value 以 unsafe.Pointer 传递
+func (t *Tree) TryInsertPointer(key unsafe.Pointer, value unsafe.Pointer, valueLength uint32) (err error) {
+	t.enter()
+	defer t.exit()
+	defer func() {
+		if r := recover(); r != nil {
+			e, ok := r.(error)
+			if !ok || !(errors.Is(e, memory.ErrOutOfSpace) || errors.Is(e, ErrChecksum)) {
+				panic(r)
+			}
+			t.flushTouched()
+			err = e
+		}
+	}()
+	t.InsertPointer(key, value, valueLength)
+	return nil
 }
 
 // Find 查找 key 对应的 val。返回 exist 是否找到
 // 因为可以存 null val，通过 value = 0 标识
-// 没有存 value length 所以无法返回，看来写变长数据时需要自解析
+// multimap 模式下返回最早插入的那个，全部的 value 使用 FindAll 获取
 func (t *Tree) Find(key uintptr) (exist bool, value uintptr) {
-	leaf := t.findLeaf(key, false)
-	for i := uint32(0); i < leaf.itemNumber; i++ {
-		if t.compare(key, &leaf.items[i].key, leaf.items[i].null) == 0 {
-			loc := leaf.items[i].valueLoc
-			if loc.BlockId == nullBlockBidFlag {
-				return true, 0
-			} else {
-				return true, t.dir.PointerAt(loc)
+	exist, p := t.FindPointer(memory.UintptrPointer(key))
+	return exist, uintptr(p)
+}
+
+// FindPointer 与 Find 相同，key、value 以 unsafe.Pointer 传递，null 为 nil
+func (t *Tree) FindPointer(key unsafe.Pointer) (exist bool, value unsafe.Pointer) {
+	t.enter()
+	defer t.exit()
+	iter := t.FindAllPointer(key)
+	if !iter.Next() {
+		return false, nil
+	}
+	return true, iter.ValuePointer()
+}
+
+// TryFind 与 Find 相同，但读到校验失败的 node 或 value 时返回 *ChecksumError
+func (t *Tree) TryFind(key uintptr) (exist bool, value uintptr, err error) {
+	exist, p, err := t.TryFindPointer(memory.UintptrPointer(key))
+	return exist, uintptr(p), err
+}
+
+// TryFindPointer 与 TryFind 相同，key、value 以 unsafe.Pointer 传递
+func (t *Tree) TryFindPointer(key unsafe.Pointer) (exist bool, value unsafe.Pointer, err error) {
+	t.enter()
+	defer t.exit()
+	defer func() {
+		if r := recover(); r != nil {
+			e, ok := r.(error)
+			if !ok || !errors.Is(e, ErrChecksum) {
+				panic(r)
 			}
+			err = e
 		}
+	}()
+	exist, value = t.FindPointer(key)
+	return exist, value, nil
+}
+
+// Scan 按顺序遍历全部键值对
+func (t *Tree) Scan() *Iterator {
+	t.enter()
+	defer t.exit()
+	if t.root == nil {
+		return &Iterator{}
 	}
-	return false, 0
+	return t.newIterator(t.firstLeaf(), 0, nil)
 }
 
-// insert0 实际插入逻辑
-func (t *Tree) insert0(key uintptr, valLoc memory.Location) {
-	if t.root == nil { // 懒初始化
-		t.newRoot(key, valLoc)
-		t.root.mode |= modeLeaf
-	} else {
-		leaf := t.findLeaf(key, true)
-		ok := t.tryInsertNode(leaf, key, valLoc)
-		if !ok { // 没有插入成功，说明满了，需要切开
-			_, _ = t.splitAndInsert(leaf, key, valLoc)
-		}
+// FindAll 返回 key 对应的所有 value 的迭代器，按插入顺序排列
+func (t *Tree) FindAll(key uintptr) *Iterator {
+	return t.FindAllPointer(memory.UintptrPointer(key))
+}
+
+// FindAllPointer 与 FindAll 相同，key 以 unsafe.Pointer 传递
+func (t *Tree) FindAllPointer(key unsafe.Pointer) *Iterator {
+	t.enter()
+	defer t.exit()
+	return t.seek(key, func(it *item) bool {
+		return t.compare(key, &it.key, it.null) != 0
+	})
+}
+
+// seek 返回从第一个不小于 key 的键值对开始的迭代器
+func (t *Tree) seek(key unsafe.Pointer, stop func(it *item) bool) *Iterator {
+	if t.root == nil {
+		return &Iterator{}
 	}
+	leaf := t.findLeaf(key, nil)
+	local, _ := t.search(leaf, key, false)
+	return t.newIterator(leaf, local, stop)
 }
 
-// tryInsertNode 尝试插入 key 到 node 中，如果存在相同的 key 则更新 value，如果插不进去返回 false
-func (t *Tree) tryInsertNode(n *node, key uintptr, valLoc memory.Location) bool {
-	// 找到插入点，local 及其后面的都需要移动
-	local := uint32(0)
-	for local < n.itemNumber {
-		if t.compare(key, &n.items[local].key, n.items[local].null) > 0 {
-			local++
-		} else {
-			break
+// DeleteOne 删除一个 key 和 value 都相同的键值对，返回是否删除成功
+// value = 0 表示匹配 null value，否则比较 value 的长度和内容
+// 删除后不合并节点，叶子节点可以为空（内存只分配，不释放）
+func (t *Tree) DeleteOne(key uintptr, value uintptr, valueLength uint32) bool {
+	return t.DeleteOnePointer(memory.UintptrPointer(key), memory.UintptrPointer(value), valueLength)
+}
+
+// DeleteOnePointer 与 DeleteOne 相同，key、value 以 unsafe.Pointer 传递
+func (t *Tree) DeleteOnePointer(key unsafe.Pointer, value unsafe.Pointer, valueLength uint32) bool {
+	t.enter()
+	defer t.exit()
+	iter := t.FindAllPointer(key)
+	for iter.Next() {
+		if t.valueEquals(iter.leaf.item(iter.index).valueLoc, value, valueLength) {
+			t.removeAt(iter.leaf, iter.index)
+			t.flushTouched()
+			return true
 		}
 	}
+	return false
+}
+
+// insert0 实际插入逻辑
+func (t *Tree) insert0(key unsafe.Pointer, valLoc memory.Location) {
+	t.checkWritable()
+	pk := pendingKey{key: key}
+	if t.root == nil { // 懒初始化
+		t.newRoot(t.newItem(&pk, valLoc))
+		t.root.mode |= modeLeaf
+		return
+	}
+
+	leaf := t.findLeaf(key, &pk)
+	// 找到插入点，local 及其后面的都需要移动。multimap 插入到相同 key 的最后面
+	local, exact := t.search(leaf, key, t.opts.multimap)
 
 	// 可能 local 就是 key，写入即可
-	if local < n.itemNumber && t.compare(key, &n.items[local].key, n.items[local].null) == 0 {
-		n.items[local].valueLoc = valLoc
-		return true
+	if exact && !t.opts.multimap {
+		leaf.item(local).valueLoc = valLoc
+		t.touch(leaf)
+		return
 	}
 
-	// 否则大于 local 的都需要移动，判断能否移动
-	if n.itemNumber == degree {
-		return false
+	i := t.newItem(&pk, valLoc)
+	if leaf.itemNumber.get() < t.opts.degree {
+		t.insertAt(leaf, local, i)
+	} else { // 满了，需要切开
+		t.reserveNodes(leaf)
+		t.splitAndInsert(leaf, local, i)
+	}
+}
+
+// insertAt 把 i 插入到 n 的 local 位置，local 及其后面的都向后移动。调用者保证 n 没有满
+func (t *Tree) insertAt(n *node, local uint32, i item) {
+	if assert && n.itemNumber.get() >= t.opts.degree {
+		panic("node is full")
 	}
 
 	// 移动
-	if local < n.itemNumber {
-		memCopy(uintptr(unsafe.Pointer(&n.items[local])), uintptr(unsafe.Pointer(&n.items[local+1])), (n.itemNumber-local)*itemSz)
+	if local < n.itemNumber.get() {
+		copy(n.items(n.itemNumber.get() + 1)[local+1:], n.items(n.itemNumber.get())[local:])
 	}
 
 	// 写入
-	i := item{
-		valueLoc: valLoc,
-	}
-	i.setKey(key)
-	n.items[local] = i
-	n.itemNumber++
-	return true
+	*n.item(local) = i
+	n.itemNumber.set(n.itemNumber.get() + 1)
+	t.touch(n)
 }
 
-// updateNode 更新 n 中 key 对应的 val
-func (t *Tree) updateNode(n *node, key uintptr, valLoc memory.Location) bool {
-	for i := uint32(0); i < n.itemNumber; i++ {
-		if t.compare(key, &n.items[i].key, n.items[i].null) == 0 {
-			n.items[i].valueLoc = valLoc
-			return true
-		}
+// removeAt 删除 n 中 local 位置的 item，后面的向前移动
+func (t *Tree) removeAt(n *node, local uint32) {
+	t.checkWritable()
+	if local+1 < n.itemNumber.get() {
+		copy(n.items(n.itemNumber.get())[local:], n.items(n.itemNumber.get())[local+1:])
 	}
-	return false
+	n.itemNumber.set(n.itemNumber.get() - 1)
+	t.touch(n)
 }
 
-// splitAndInsert leaf 中无法直接插入 key，应当先切分再插入，返回切分后新生成的 node，以及实际插入 key 的 node
-func (t *Tree) splitAndInsert(leaf *node, key uintptr, valLoc memory.Location) (*node, *node) {
-	newLeaf := t.newNode()
-	newLeaf.mode = leaf.mode
+// splitAndInsert n 中无法直接插入 i，应当先切分再插入。local 是 i 在切分前的 n 中的插入位置
+func (t *Tree) splitAndInsert(n *node, local uint32, i item) {
+	newNode := t.newNode()
+	newNode.mode = n.mode
 	// 兄弟指针
-	newLeaf.nextPoint = leaf.nextPoint
-	leaf.nextPoint = newLeaf.selfPoint
+	newNode.nextPoint.set(n.nextPoint.get())
+	n.nextPoint.set(newNode.selfPoint.get())
 	// 父指针
-	newLeaf.fatherPoint = leaf.fatherPoint
+	newNode.fatherPoint.set(n.fatherPoint.get())
 
-	// leaf 的一半移过去
-	mid := leaf.itemNumber / 2
+	// 连同 i 一共 itemNumber + 1 个 item，切分后左边 mid 个，右边其余的
+	// 只按插入前的数目对半分时，顺序插入总是落在右边，右边分裂后立刻又满了，左边只留下一半，树高增长很快
+	mid := (n.itemNumber.get() + 1) / 2
+	// 插入点在前一半，i 会插入 n，n 只保留 mid - 1 个
+	split := mid
+	if local < mid {
+		split = mid - 1
+	}
 	// 移动
-	memCopy(uintptr(unsafe.Pointer(&leaf.items[mid])), uintptr(unsafe.Pointer(&newLeaf.items[0])), (leaf.itemNumber-mid)*itemSz)
+	copy(newNode.items(n.itemNumber.get()-split), n.items(n.itemNumber.get())[split:])
 	// 更新 itemNumber
-	newLeaf.itemNumber = leaf.itemNumber - mid
-	leaf.itemNumber = mid
-
-	// newLeaf 被指需要修改
-	if !newLeaf.isLeaf() {
-		for i := uint32(0); i < newLeaf.itemNumber; i++ {
-			child := t.readNode(newLeaf.items[i].valueLoc)
-			child.fatherPoint = newLeaf.selfPoint
-		}
-	}
-
-	// 插入新的，问题是插入哪个。如果 key 大于新叶子（右边的）newLeaf 第一个值，就插入新叶子，否则插入旧叶子 leaf
-	var insertNode *node
-	if t.compare(key, &newLeaf.items[0].key, newLeaf.items[0].null) > 0 {
-		insertNode = newLeaf
+	newNode.itemNumber.set(n.itemNumber.get() - split)
+	n.itemNumber.set(split)
+	t.touch(n)
+	t.touch(newNode)
+
+	// 插入新的，插入点在前一半就插入旧节点 n，否则插入新节点 newNode。必定成功
+	if local < mid {
+		t.insertAt(n, local, i)
 	} else {
-		insertNode = leaf
+		t.insertAt(newNode, local-mid, i)
 	}
-	// 插入，必定成功
-	ok := t.tryInsertNode(insertNode, key, valLoc)
-	if !ok {
-		panic("splitting cannot insert")
+
+	// newNode 被指需要修改（包括刚刚插入的 item 指向的子节点）
+	if !newNode.isLeaf() {
+		for j := uint32(0); j < newNode.itemNumber.get(); j++ {
+			child := t.readNode(newNode.item(j).valueLoc)
+			child.fatherPoint.set(newNode.selfPoint.get())
+			t.touch(child)
+		}
 	}
 
 	// 更新父节点
-	t.insertFather(leaf, newLeaf)
-	return newLeaf, insertNode
+	t.insertFather(n, newNode)
 }
 
 // insertFather 当节点分裂为 left 和 right 后，需要修改父节点一些信息
+// 父节点中原本指向 left 的 item 改为 left.maxKey，并在其后插入指向 right 的 item
 func (t *Tree) insertFather(left *node, right *node) {
+	rightItem := right.separator()
+
 	if left.isRoot() {
-		// left 是根节点，说明没有父亲，自己 new 一个爸爸。把 left.maxKey 插入
-		t.newRoot(left.maxKey(), left.selfPoint)
-		// 把 right.maxKey 也插入
-		ok := t.tryInsertNode(t.root, right.maxKey(), right.selfPoint)
-		if !ok {
-			panic("root cannot hold two")
+		// left 是根节点，说明没有父亲，自己 new 一个爸爸。把 left.maxKey 和 right.maxKey 插入
+		t.newRoot(left.separator())
+		t.insertAt(t.root, 1, rightItem)
+		// left 和 right 不再是根节点
+		if left.isLeaf() {
+			left.mode, right.mode = modeLeaf, modeLeaf
+		} else {
+			left.mode, right.mode = modeMid, modeMid
 		}
-		// left 和 right 的模式删除 modeRoot
-		left.mode ^= modeRoot
-		right.mode ^= modeRoot
-		//
 		// left 和 right 都指向新爸爸
-		left.fatherPoint = t.root.selfPoint
-		right.fatherPoint = t.root.selfPoint
-	} else {
-		// 有父亲，那就读出来
-		father := t.readNode(left.fatherPoint)
-		// 把 left.maxKey 插到父结点中
-		ok := t.tryInsertNode(father, left.maxKey(), left.selfPoint)
-		if ok { // 父不分裂，更新父节点中 right.maxKey() 的值，指向现在的 right
-			ok2 := t.tryInsertNode(father, right.maxKey(), right.selfPoint)
-			if !ok2 {
-				panic("updateDuplicateValue fail?")
-			}
-		} else { // 父需要分裂，拿到分裂后的 anotherFather，还有实际插入 left.maxKey 的 insertKeyFather
-			anotherFather, insertKeyFather := t.splitAndInsert(father, left.maxKey(), left.selfPoint)
-			// 父发生了分裂，说明父是中间节点
-			father.mode, anotherFather.mode = modeMid, modeMid
-			// left 指向 insertKeyFather
-			left.fatherPoint = insertKeyFather.selfPoint
-			// 从 father 和 anotherFather 找到 right 的父节点 rightFather
-			rightFather := t.findFather(right, father, anotherFather)
-			// right 指向 rightFather
-			right.fatherPoint = rightFather.selfPoint
-			// 更新 rightFather 的 right.maxKey 新值
-			ok2 := t.updateNode(rightFather, right.maxKey(), right.selfPoint)
-			if !ok2 {
-				panic("replace fail?")
-			}
-		}
+		left.fatherPoint.set(t.root.selfPoint.get())
+		right.fatherPoint.set(t.root.selfPoint.get())
+		t.touch(left)
+		t.touch(right)
+		return
 	}
-}
 
-func (i *item) setKey(key uintptr) {
-	if key == 0 {
-		i.null = nullKeyFlag
+	// 有父亲，那就读出来，找到 left 所在位置
+	father := t.readNode(left.fatherPoint.get())
+	local := t.childLocal(father, left)
+	*father.item(local) = left.separator()
+	t.touch(father)
+
+	// right 插入到 left 后面。父亲满了就分裂，分裂时会修正 right 的父指针
+	if father.itemNumber.get() < t.opts.degree {
+		t.insertAt(father, local+1, rightItem)
 	} else {
-		i.null = notNullKeyFlag
-		memCopy(key, uintptr(unsafe.Pointer(&i.key)), keySize)
+		t.splitAndInsert(father, local+1, rightItem)
 	}
 }
 
 func (t *Tree) PrintTree(keyString func(p uintptr) string, valString func(p uintptr) string) string {
+	t.enter()
+	defer t.exit()
 	if keyString == nil {
 		keyString = func(p uintptr) string {
-			return strconv.Itoa(int(*((*int64)(unsafe.Pointer(p)))))
+			return strconv.Itoa(int(*((*int64)(memory.UintptrPointer(p)))))
 		}
 	}
 	if valString == nil {
@@ -302,24 +434,24 @@ func (t *Tree) PrintTree(keyString func(p uintptr) string, valString func(p uint
 			sb.WriteString(cur.modeStr())
 		}
 
-		for i := uint32(0); i < cur.itemNumber; i++ {
-			it := &cur.items[i]
+		for i := uint32(0); i < cur.itemNumber.get(); i++ {
+			it := cur.item(i)
 			if it.isNullKey() {
 				sb.WriteString(nullStr)
 			} else {
-				sb.WriteString(keyString(uintptr(unsafe.Pointer(&it.key))))
+				sb.WriteString(keyString(uintptr(t.keyPointer(it))))
 			}
 			if cur.isLeaf() {
 				if it.isNullValue() {
 					sb.WriteString(":" + nullStr)
 				} else {
-					sb.WriteString(":" + valString(t.dir.PointerAt(it.valueLoc)))
+					sb.WriteString(":" + valString(uintptr(t.valuePointer(it.valueLoc))))
 				}
 
 			} else {
 				nodes = append(nodes, t.readNode(it.valueLoc))
 			}
-			if i < cur.itemNumber-1 {
+			if i < cur.itemNumber.get()-1 {
 				sb.WriteString(",")
 			}
 		}
@@ -336,95 +468,349 @@ func (t *Tree) PrintTree(keyString func(p uintptr) string, valString func(p uint
 }
 
 func (t *Tree) AllKeys(keyFun func(p uintptr) interface{}) []interface{} {
+	t.enter()
+	defer t.exit()
 	keys := make([]interface{}, 0)
-	// null 是最小的 key
-	leaf := t.findLeaf(0, false)
+	if t.root == nil {
+		return keys
+	}
+	leaf := t.firstLeaf()
 	for leaf != nil {
-		for i := uint32(0); i < leaf.itemNumber; i++ {
-			it := &leaf.items[i]
+		for i := uint32(0); i < leaf.itemNumber.get(); i++ {
+			it := leaf.item(i)
 			if it.isNullKey() {
 				keys = append(keys, nullStr)
 			} else {
-				keys = append(keys, keyFun(uintptr(unsafe.Pointer(&it.key))))
+				keys = append(keys, keyFun(uintptr(t.keyPointer(it))))
 			}
 
 		}
+		prev := leaf
 		if leaf.hasNext() {
-			leaf = t.readNode(leaf.nextPoint)
+			leaf = t.readNode(leaf.nextPoint.get())
 		} else {
 			leaf = nil
 		}
+		t.releaseNode(prev)
 	}
 	return keys
 }
 
 /*========== new =============*/
 
-// newRoot 新建一个 root，并插入 key
-func (t *Tree) newRoot(key uintptr, valLoc memory.Location) {
+// newRoot 新建一个 root，并插入 i
+func (t *Tree) newRoot(i item) {
 	t.root = t.newNode()
 	t.root.mode = modeRoot
-	t.root.itemNumber = 1
+	t.root.itemNumber.set(1)
 	// 没有父亲，没有兄弟
-	t.root.fatherPoint.BlockId = nullBlockBidFlag
-	t.root.nextPoint.BlockId = nullBlockBidFlag
+	t.root.fatherPoint.set(memory.Location{BlockId: nullBlockBidFlag})
+	t.root.nextPoint.set(memory.Location{BlockId: nullBlockBidFlag})
+	*t.root.item(0) = i
+	t.touch(t.root)
+	t.rootLoc = t.root.selfPoint.get()
+	t.setMetaRoot(t.root.selfPoint.get())
+}
 
-	i := item{
-		valueLoc: valLoc,
+// reserveNodes 分裂满了的 n 之前，预先分配分裂需要的所有 node，之后的分裂不会因为空间不足而中断
+// n 和它连续满了的祖先各需要一个，一直分裂到根时还需要一个新根
+func (t *Tree) reserveNodes(n *node) {
+	need := 0
+	for {
+		need++
+		if n.isRoot() {
+			need++
+			break
+		}
+		n = t.readNode(n.fatherPoint.get())
+		if n.itemNumber.get() < t.opts.degree {
+			break
+		}
+	}
+	// 上次失败时剩下的可以继续使用
+	for len(t.reserved) < need {
+		t.reserved = append(t.reserved, t.allocateNode().selfPoint.get())
 	}
-	i.setKey(key)
-
-	t.root.items[0] = i
 }
 
+// newNode 取一个预先分配的 node，没有就新分配
 func (t *Tree) newNode() *node {
-	diskPtr, pointer := t.dir.Allocate(nodeSz)
-	n := (*node)(unsafe.Pointer(pointer))
-	n.selfPoint = diskPtr
+	if len(t.reserved) > 0 {
+		n := t.nodeAt(t.reserved[len(t.reserved)-1])
+		t.reserved = t.reserved[:len(t.reserved)-1]
+		return n
+	}
+	return t.allocateNode()
+}
+
+// detectDir 记录 dir 实现的可选接口
+func (t *Tree) detectDir() {
+	_, t.scoped = t.dir.(memory.Scoped)
+	_, pinner := t.dir.(memory.Pinner)
+	t.pinner = t.scoped && pinner
+	t.volatile = memory.IsVolatile(t.dir)
+}
+
+// enter 开始一个操作，与 exit 成对使用，可以嵌套
+// dir 实现了 memory.Scoped 时，操作期间得到的指针一直有效；操作之间 dir 可能移动内存（例如 memory.Tiered 换出），
+// 因此最外层的 enter 由 rootLoc 重新得到 root，迭代器也由地址重新得到当前叶子。dir 是 memory.Volatile 时 rootLoc 也从元数据重新读取
+func (t *Tree) enter() {
+	if !t.scoped {
+		return
+	}
+	memory.Enter(t.dir)
+	t.depth++
+	if t.depth == 1 {
+		// 读取根时 panic（例如 memory.Shared 的读者在 Read 中遇到写者修改）发生在调用者 defer exit 之前，这里撤销 enter，
+		// 否则 depth 不再回到 0，之后的操作都被当作嵌套的，不再重新读取根
+		defer func() {
+			if r := recover(); r != nil {
+				t.exit()
+				panic(r)
+			}
+		}()
+		if t.volatile {
+			// 其他进程可能换了根，重新读取
+			t.rootLoc, t.root = t.meta().rootPoint.get(), nil
+			if t.rootLoc.BlockId != nullBlockBidFlag {
+				t.root = t.nodeAt(t.rootLoc)
+			}
+		} else if t.root != nil {
+			t.root = t.nodeAt(t.rootLoc)
+		}
+	}
+}
+
+// exit 结束 enter 开始的操作
+func (t *Tree) exit() {
+	if !t.scoped {
+		return
+	}
+	t.depth--
+	if t.depth == 0 {
+		t.unpinAll()
+	}
+	memory.Exit(t.dir)
+}
+
+// allocate 分配 size 大小、地址按 align 对齐的内存。指针由 memory.Pointer 得到，不使用 Allocate 返回的 uintptr
+func (t *Tree) allocate(size, align uint32, tag memory.Tag) (memory.Location, unsafe.Pointer) {
+	t.checkWritable()
+	loc, _ := memory.AllocateAligned(t.dir, size, align, tag)
+	return loc, memory.Pointer(t.dir, loc)
+}
+
+// allocateNode 分配一个 node。配置了聚合器时，聚合值紧跟在 node 之后一起分配，校验和在最后
+func (t *Tree) allocateNode() *node {
+	diskPtr, pointer := t.allocate(t.nodeSize()+t.summarySize()+t.checksumSize(), nodeAlign, memory.TagNode)
+	n := (*node)(pointer)
+	n.magic.set(nodeMagic)
+	n.version = byte(formatVersion)
+	n.selfPoint.set(diskPtr)
 	return n
 }
 
+/*========== value =============*/
+
+// newValue 分配并写入一个 value，见 newValueBytes
+func (t *Tree) newValue(value unsafe.Pointer, valueLength uint32) memory.Location {
+	if valueLength == 0 {
+		return t.newValueBytes(nil)
+	}
+	return t.newValueBytes(unsafe.Slice((*byte)(value), valueLength))
+}
+
+// newValueBytes 分配并写入一个 value，布局为 [长度 uint32][保留 4 bytes][数据]，WithValueChecksums 时保留字段为校验和
+func (t *Tree) newValueBytes(data []byte) memory.Location {
+	diskPtr, _ := t.allocate(valueHeaderSz+uint32(len(data)), valueAlign, memory.TagValue)
+	record := memory.Bytes(t.dir, diskPtr, valueHeaderSz+uint32(len(data)))
+	binary.LittleEndian.PutUint32(record, uint32(len(data)))
+	copy(record[valueHeaderSz:], data)
+	if t.opts.valueChecksums {
+		binary.LittleEndian.PutUint32(record[4:], crc32.Checksum(data, castagnoli))
+	}
+	return diskPtr
+}
+
+// valuePointer value 数据的指针，null value 返回 nil
+// 长度为 0 的 value 返回记录本身的地址，数据之后可能已经是 block 的结尾，不能越过记录取指针
+func (t *Tree) valuePointer(valLoc memory.Location) unsafe.Pointer {
+	if valLoc.BlockId == nullBlockBidFlag {
+		return nil
+	}
+	record := memory.Pointer(t.dir, valLoc)
+	t.verifyValue(valLoc, record)
+	return recordPointer(record)
+}
+
+// valueBytes value 数据，直接指向 dir 中的内存。null value 返回 nil，长度为 0 的 value 返回空切片
+func (t *Tree) valueBytes(valLoc memory.Location) []byte {
+	if valLoc.BlockId == nullBlockBidFlag {
+		return nil
+	}
+	t.verifyValue(valLoc, memory.Pointer(t.dir, valLoc))
+	record := memory.Bytes(t.dir, valLoc, valueHeaderSz)
+	data := valLoc
+	data.BlockOffset += valueHeaderSz
+	return memory.Bytes(t.dir, data, binary.LittleEndian.Uint32(record))
+}
+
+// pinValue 与 memory.Pointer 相同，得到 valLoc 处的 value 记录，但 dir 实现了 memory.Pinner 时 Pin 住而不是把它留在作用域中
+// 长时间的遍历这样读取 value，经过的页不会都留在缓存中。必须与 releaseValue 成对调用，之后不能再使用记录
+func (t *Tree) pinValue(valLoc memory.Location) unsafe.Pointer {
+	if !t.pinner {
+		return memory.Pointer(t.dir, valLoc)
+	}
+	return memory.Pin(t.dir, valLoc)
+}
+
+// releaseValue 释放 pinValue 得到的记录
+func (t *Tree) releaseValue(valLoc memory.Location) {
+	if t.pinner {
+		memory.Unpin(t.dir, valLoc)
+	}
+}
+
+// recordLength value 记录中数据的长度
+func recordLength(record unsafe.Pointer) uint32 {
+	return binary.LittleEndian.Uint32((*[valueHeaderSz]byte)(record)[:])
+}
+
+// recordPointer value 记录中数据的指针，见 valuePointer
+func recordPointer(record unsafe.Pointer) unsafe.Pointer {
+	if recordLength(record) == 0 {
+		return record
+	}
+	return unsafe.Add(record, valueHeaderSz)
+}
+
+// recordBytes value 记录中的数据
+func recordBytes(record unsafe.Pointer) []byte {
+	return unsafe.Slice((*byte)(recordPointer(record)), recordLength(record))
+}
+
+// valueLength value 数据的长度，null value 返回 0
+func (t *Tree) valueLength(valLoc memory.Location) uint32 {
+	if valLoc.BlockId == nullBlockBidFlag {
+		return 0
+	}
+	return binary.LittleEndian.Uint32(memory.Bytes(t.dir, valLoc, 4))
+}
+
+// valueEquals 判断 valLoc 处保存的 value 和 value 是否相同，value = nil 表示 null
+func (t *Tree) valueEquals(valLoc memory.Location, value unsafe.Pointer, valueLength uint32) bool {
+	if value == nil || valLoc.BlockId == nullBlockBidFlag {
+		return value == nil && valLoc.BlockId == nullBlockBidFlag
+	}
+	if t.valueLength(valLoc) != valueLength {
+		return false
+	}
+	return valueLength == 0 || bytes.Equal(t.valueBytes(valLoc), unsafe.Slice((*byte)(value), valueLength))
+}
+
 /*========== finder =============*/
 
-func (t *Tree) findLeaf(key uintptr, updateMaxKey bool) *node {
+// findLeaf 查找 key 所在的叶子节点。pk 不为 nil 表示插入，key 比所有 key 都大时更新最大 key 为 pk
+// multimap 插入时要插到相同 key 的最后面，因此下降到第一个大于 key 的子节点
+func (t *Tree) findLeaf(key unsafe.Pointer, pk *pendingKey) *node {
+	updateMaxKey := pk != nil
+	after := updateMaxKey && t.opts.multimap
 	leaf := t.root
 	for !leaf.isLeaf() {
-		it := uint32(0)
-		for it < leaf.itemNumber {
-			// key > leaf.items[it].key
-			if t.compare(key, &leaf.items[it].key, leaf.items[it].null) > 0 {
-				it++
-			} else {
-				break
-			}
-		}
-
-		if it == leaf.itemNumber {
+		// 第一个不小于 key 的子节点
+		it, _ := t.search(leaf, key, after)
+		if it == leaf.itemNumber.get() {
 			it--
 			if updateMaxKey {
-				(&leaf.items[it]).setKey(key)
+				t.setItemKey(leaf.item(it), pk)
+				t.touch(leaf)
 			}
 		}
 
-		leaf = t.readNode((&leaf.items[it]).valueLoc)
+		leaf = t.readNode(leaf.item(it).valueLoc)
 	}
 
 	return leaf
 }
 
-func (t *Tree) findFather(n *node, f1 *node, f2 *node) *node {
-	maxKey := n.maxKey()
-	for i := uint32(0); i < f1.itemNumber; i++ {
-		if t.compare(maxKey, &f1.items[i].key, f1.items[i].null) == 0 {
-			return f1
+// firstLeaf 最左边的叶子节点
+func (t *Tree) firstLeaf() *node {
+	leaf := t.root
+	for !leaf.isLeaf() {
+		leaf = t.readNode(leaf.item(0).valueLoc)
+	}
+	return leaf
+}
+
+// childLocal 查找 father 中指向 child 的 item 的位置
+// 按 key 查找在 multimap 下并不唯一，所以先二分到第一个不小于 child 最大 key 的位置，再向后按照地址查找
+func (t *Tree) childLocal(father *node, child *node) uint32 {
+	i := uint32(0)
+	if child.itemNumber.get() > 0 {
+		i, _ = t.search(father, t.keyPointer(child.item(child.itemNumber.get()-1)), false)
+	}
+	for ; i < father.itemNumber.get(); i++ {
+		if father.item(i).valueLoc == child.selfPoint.get() {
+			return i
+		}
+	}
+	panic("no child in father")
+}
+
+// search 在 n 中二分查找 key，返回第一个不小于 key 的位置（after 时为第一个大于 key 的位置）
+// exact 表示 n 中存在等于 key 的 item，此时它位于 pos（after 时位于 pos - 1）
+func (t *Tree) search(n *node, key unsafe.Pointer, after bool) (pos uint32, exact bool) {
+	low, high := uint32(0), n.itemNumber.get()
+	for low < high {
+		mid := (low + high) / 2
+		c := t.compare(key, &n.item(mid).key, n.item(mid).null)
+		if c == 0 {
+			exact = true
+		}
+		if c > 0 || (c == 0 && after) {
+			low = mid + 1
+		} else {
+			high = mid
 		}
 	}
-	for i := uint32(0); i < f2.itemNumber; i++ {
-		if t.compare(maxKey, &f2.items[i].key, f2.items[i].null) == 0 {
-			return f2
+	return low, exact
+}
+
+// nodeSize node 的大小，不包括聚合值
+func (t *Tree) nodeSize() uint32 {
+	return nodeHeaderSz + t.opts.degree*itemSz
+}
+
+/*========== touch =============*/
+
+// touch 记录 n 在本次操作中被修改
+func (t *Tree) touch(n *node) {
+	for _, m := range t.touched {
+		if m == n {
+			return
+		}
+	}
+	t.touched = append(t.touched, n)
+}
+
+// flushTouched 一次操作结束，处理所有被修改的 node
+func (t *Tree) flushTouched() {
+	if t.opts.aggregator != nil {
+		// 按修改顺序逐个向上重算到根。此时父指针都已是最终状态，所以每个祖先都会在其子节点之后重算
+		for _, n := range t.touched {
+			t.refreshSummaryUp(n)
 		}
 	}
-	panic("no father in them")
+	for _, n := range t.touched {
+		t.seal(n)
+		t.dirty(n)
+	}
+	t.touched = t.touched[:0]
+}
+
+// dirty n 的修改需要写回，dir 只写回修改过的内存时（memory.Dirtier）才有作用
+func (t *Tree) dirty(n *node) {
+	memory.MarkDirty(t.dir, n.selfPoint.get())
 }
 
 /*========== reader =============*/
@@ -456,12 +842,71 @@ func (t *Tree) readNode(valLoc memory.Location) *node {
 		}
 	}
 
-	p := t.dir.PointerAt(valLoc)
-	return (*node)(unsafe.Pointer(p))
+	n := t.pinNode(valLoc)
+	if assert {
+		if n.magic.get() != nodeMagic {
+			panic("bad node magic")
+		}
+	}
+	if t.opts.checksums && t.shouldVerify() && !t.isTouched(n) {
+		if err := t.checkNode(valLoc, n); err != nil {
+			panic(err)
+		}
+	}
+	return n
+}
+
+// nodeAt 不做任何检查，把 valLoc 处的内存看作 node
+func (t *Tree) nodeAt(valLoc memory.Location) *node {
+	return (*node)(memory.Pointer(t.dir, valLoc))
+}
+
+// pinNode 与 nodeAt 相同，但 dir 实现了 memory.Pinner 时 Pin 住 node 而不是把它留在作用域中，
+// 到 releaseNode 或者最外层 exit 为止有效。长时间的遍历用完一个 node 就释放，经过的页不会都留在缓存中
+func (t *Tree) pinNode(valLoc memory.Location) *node {
+	if !t.pinner {
+		return t.nodeAt(valLoc)
+	}
+	t.pins = append(t.pins, valLoc)
+	return (*node)(memory.Pin(t.dir, valLoc))
+}
+
+// releaseNode 释放 pinNode 得到的 n，之后不能再使用 n。n 被 Pin 住多次时只释放一次，不是 pinNode 得到的什么也不做
+func (t *Tree) releaseNode(n *node) {
+	if !t.pinner {
+		return
+	}
+	loc := n.selfPoint.get()
+	for i := len(t.pins) - 1; i >= 0; i-- {
+		if t.pins[i] == loc {
+			t.pins = append(t.pins[:i], t.pins[i+1:]...)
+			memory.Unpin(t.dir, loc)
+			return
+		}
+	}
+}
+
+// unpinAll 操作结束时释放剩下的 node。它们留在作用域中，与 nodeAt 得到的 node 一样在下一次 Exit 之前仍然有效
+func (t *Tree) unpinAll() {
+	for _, loc := range t.pins {
+		memory.Pointer(t.dir, loc)
+		memory.Unpin(t.dir, loc)
+	}
+	t.pins = t.pins[:0]
 }
 
 /*========== node method =============*/
 
+// item 第 i 个 item。调用者保证 i 小于 degree
+func (n *node) item(i uint32) *item {
+	return (*item)(unsafe.Add(unsafe.Pointer(n), uintptr(nodeHeaderSz)+uintptr(i)*uintptr(itemSz)))
+}
+
+// items 前 count 个 item。调用者保证 count 不大于 degree
+func (n *node) items(count uint32) []item {
+	return unsafe.Slice(n.item(0), count)
+}
+
 func (n *node) isLeaf() bool {
 	if assert {
 		allMode := modeLeaf | modeRoot | modeMid
@@ -495,33 +940,18 @@ func (n *node) isMid() bool {
 	return n.mode&modeMid == modeMid
 }
 
-func (n *node) maxKey() uintptr {
-	if assert && n.itemNumber == 0 {
-		panic("no key")
-	}
-	// bug 狗屁 go 语言，这里必须取地址
-	maxItem := &n.items[n.itemNumber-1]
-	if maxItem.isNullKey() {
-		return 0
-	} else {
-		return uintptr(unsafe.Pointer(&(maxItem.key[0])))
-	}
-}
-
-func (n *node) minKey() uintptr {
-	if assert && n.itemNumber == 0 {
+// separator 父节点中指向 n 的 item，key 为 n 中最大的 key
+func (n *node) separator() item {
+	if assert && n.itemNumber.get() == 0 {
 		panic("no key")
 	}
-	maxItem := &n.items[0]
-	if maxItem.isNullKey() {
-		return 0
-	} else {
-		return uintptr(unsafe.Pointer(&(maxItem.key[0])))
-	}
+	i := *n.item(n.itemNumber.get() - 1)
+	i.valueLoc = n.selfPoint.get()
+	return i
 }
 
 func (n *node) hasNext() bool {
-	return n.nextPoint.BlockId != nullBlockBidFlag
+	return n.nextPoint.get().BlockId != nullBlockBidFlag
 }
 
 func (n *node) modeStr() string {
@@ -549,16 +979,9 @@ func (n *node) modeStr() string {
 
 /*========== utils =============*/
 
-func memCopy(src, des uintptr, length uint32) {
-	Len := int(length)
+func memCopy(src, des unsafe.Pointer, length uint32) {
 	if length == 0 {
 		return
 	}
-	srcHelper := *((*[]byte)(unsafe.Pointer(&reflect.SliceHeader{
-		Data: src, Len: Len, Cap: Len,
-	})))
-	desHelper := *((*[]byte)(unsafe.Pointer(&reflect.SliceHeader{
-		Data: des, Len: Len, Cap: Len,
-	})))
-	copy(desHelper, srcHelper)
+	copy(unsafe.Slice((*byte)(des), length), unsafe.Slice((*byte)(src), length))
 }
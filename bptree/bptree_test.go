@@ -1,10 +1,17 @@
 package bptree
 
 import (
+	"bytes"
+	"encoding/binary"
 	"fmt"
 	"github.com/madokast/bptree/memory"
+	"io"
 	"math/rand"
+	"os"
+	"path/filepath"
 	"strconv"
+	"strings"
+	"sync"
 	"testing"
 	"unsafe"
 )
@@ -15,8 +22,8 @@ var key3 = new(int64)
 var key4 = new(int64)
 
 func keyComp(k1, k2 uintptr) int {
-	n1 := *((*int64)(unsafe.Pointer(k1)))
-	n2 := *((*int64)(unsafe.Pointer(k2)))
+	n1 := *((*int64)(memory.UintptrPointer(k1)))
+	n2 := *((*int64)(memory.UintptrPointer(k2)))
 	if n1 > n2 {
 		return 1
 	} else if n1 < n2 {
@@ -27,11 +34,11 @@ func keyComp(k1, k2 uintptr) int {
 }
 
 func keyString(p uintptr) string {
-	return strconv.Itoa(int(*((*int64)(unsafe.Pointer(p)))))
+	return strconv.Itoa(int(*((*int64)(memory.UintptrPointer(p)))))
 }
 
 func keyFunc(p uintptr) interface{} {
-	return *((*int64)(unsafe.Pointer(p)))
+	return *((*int64)(memory.UintptrPointer(p)))
 }
 
 func TestEmpty(t *testing.T) {
@@ -123,8 +130,8 @@ func TestTwoReverse(t *testing.T) {
 	t.Log(tree.PrintTree(keyString, keyString))
 	tree.Insert(uintptr(unsafe.Pointer(key2)), uintptr(unsafe.Pointer(key)), 8)
 	t.Log(tree.PrintTree(keyString, keyString))
-	point := tree.root.items[0].valueLoc
-	p := directory.PointerAt(point)
+	point := tree.root.item(0).valueLoc
+	p := tree.valuePointer(point)
 	t.Log(*((*int64)(unsafe.Pointer(p))))
 }
 
@@ -366,7 +373,7 @@ func Test10_3(t *testing.T) {
 	//  // newLeaf 被指需要修改
 	//	if !newLeaf.isLeaf() {
 	//		for i := uint32(0); i < newLeaf.itemNumber; i++ {
-	//			child := t.readNode(newLeaf.items[i].valueLoc)
+	//			child := t.readNode(newLeaf.item(i).valueLoc)
 	//			child.fatherPoint = newLeaf.selfPoint
 	//		}
 	//	}
@@ -402,6 +409,16 @@ func Test10_3(t *testing.T) {
 	*key = 5
 	tree.Insert(uintptr(unsafe.Pointer(key)), 0, 0)
 	t.Log(tree.PrintTree(keyString, keyString))
+
+	// dot -Tsvg 查看父子和兄弟指针
+	if err := tree.Verify(); err != nil {
+		panic(err)
+	}
+	sb := strings.Builder{}
+	if err := tree.WriteDOT(&sb, keyString, keyString); err != nil {
+		panic(err)
+	}
+	t.Log(sb.String())
 }
 
 func TestFindNull(t *testing.T) {
@@ -477,5 +494,352 @@ func TestFind(t *testing.T) {
 }
 
 func readInt64(p uintptr) int64 {
-	return *((*int64)(unsafe.Pointer(p)))
+	return *((*int64)(memory.UintptrPointer(p)))
+}
+
+func TestSearch(t *testing.T) {
+	directory := memory.New(1024)
+	tree := New(directory, nil, int64Keys, WithMultimap(), WithDegree(16))
+	insertKeys(tree, 1, 3, 3, 3, 5, 7) // [nil 1 3 3 3 5 7]
+	leaf := tree.root
+	for _, c := range []struct {
+		k     int64
+		after bool
+		pos   uint32
+		exact bool
+	}{
+		{0, false, 1, false}, {0, true, 1, false},
+		{1, false, 1, true}, {1, true, 2, true},
+		{3, false, 2, true}, {3, true, 5, true},
+		{4, false, 5, false}, {4, true, 5, false},
+		{7, false, 6, true}, {7, true, 7, true},
+		{8, false, 7, false}, {8, true, 7, false},
+	} {
+		*key = c.k
+		pos, exact := tree.search(leaf, unsafe.Pointer(key), c.after)
+		if pos != c.pos || exact != c.exact {
+			panic(fmt.Sprint(c, pos, exact))
+		}
+	}
+}
+
+func TestDegreeRandom(t *testing.T) {
+	for _, degree := range []int{3, 4, 5, 16, 64} {
+		for temp := 0; temp < 20; temp++ {
+			directory := memory.New(1 << 12)
+			tree := New(directory, nil, int64Keys, WithDegree(degree))
+			m := map[int64]int64{}
+			for i := 0; i < 1000; i++ {
+				*key = int64(rand.Int31n(500)) - 250
+				*key2 = rand.Int63()
+				m[*key] = *key2
+				tree.InsertPointer(unsafe.Pointer(key), unsafe.Pointer(key2), 8)
+			}
+			for k := int64(-260); k < 260; k++ {
+				*key = k
+				exist, value := tree.FindPointer(unsafe.Pointer(key))
+				v, ok := m[k]
+				if exist != ok || (ok && *(*int64)(value) != v) {
+					panic(fmt.Sprint(degree, k))
+				}
+			}
+			if keys := allKeys(tree); len(keys) != len(m) {
+				panic(fmt.Sprint(degree, len(keys), len(m)))
+			}
+		}
+	}
+}
+
+// BenchmarkDegree 不同度下随机插入和查找
+func BenchmarkDegree(b *testing.B) {
+	for _, degree := range []int{3, 8, 32, 128, 512} {
+		b.Run(fmt.Sprintf("insert/%d", degree), func(b *testing.B) {
+			r := rand.New(rand.NewSource(1))
+			tree := New(memory.New(1<<20), nil, int64Keys, WithDegree(degree))
+			b.ResetTimer()
+			for i := 0; i < b.N; i++ {
+				*key = r.Int63()
+				tree.InsertPointer(unsafe.Pointer(key), nil, 0)
+			}
+		})
+		b.Run(fmt.Sprintf("find/%d", degree), func(b *testing.B) {
+			r := rand.New(rand.NewSource(1))
+			tree := New(memory.New(1<<20), nil, int64Keys, WithDegree(degree))
+			for i := 0; i < 100000; i++ {
+				*key = r.Int63n(200000)
+				tree.InsertPointer(unsafe.Pointer(key), nil, 0)
+			}
+			b.ResetTimer()
+			for i := 0; i < b.N; i++ {
+				*key = r.Int63n(200000)
+				tree.FindPointer(unsafe.Pointer(key))
+			}
+		})
+	}
+}
+
+// 多棵树在不同的 goroutine 中共享一个 Directory，每棵树只由一个 goroutine 使用
+func TestSharedDirectory(t *testing.T) {
+	for _, dir := range []*memory.Directory{memory.New(1 << 12), memory.NewWithArenas(1 << 12)} {
+		trees := make([]*Tree, 8)
+		wg := sync.WaitGroup{}
+		for g := range trees {
+			g := g
+			trees[g] = New(dir, nil, WithKeyType(KeyInt64), WithDegree(5), WithChecksums(ChecksumAlways))
+			wg.Add(1)
+			go func() {
+				defer wg.Done()
+				for i := 0; i < 500; i++ {
+					k := binary.LittleEndian.AppendUint64(nil, uint64(i*7%500))
+					trees[g].InsertBytes(k, []byte(fmt.Sprint(g, "-", i*7%500)))
+				}
+			}()
+		}
+		wg.Wait()
+
+		for g, tree := range trees {
+			if err := tree.Verify(); err != nil {
+				panic(err)
+			}
+			for i := 0; i < 500; i++ {
+				value, exist := tree.GetBytes(binary.LittleEndian.AppendUint64(nil, uint64(i)))
+				if !exist || string(value) != fmt.Sprint(g, "-", i) {
+					panic(fmt.Sprint(g, i, string(value)))
+				}
+			}
+		}
+	}
+}
+
+// 常驻内存有上限的 dir，node 和 value 在操作之间会被换出再读回
+func TestTieredDirectory(t *testing.T) {
+	dir, err := memory.NewTiered(1024, 8*1024, t.TempDir())
+	if err != nil {
+		panic(err)
+	}
+	defer dir.Close()
+	opts := []Option{WithKeyType(KeyInt64), WithDegree(5), WithChecksums(ChecksumAlways), WithPointerAggregator(Int64StatsAggregator{})}
+	trees := []*Tree{New(dir, nil, opts...), New(dir, nil, opts...)}
+	for i := 0; i < 2000; i++ {
+		for j, tree := range trees {
+			k := binary.LittleEndian.AppendUint64(nil, uint64(i*7%2000))
+			tree.InsertBytes(k, binary.LittleEndian.AppendUint64(nil, uint64(i*7%2000*(j+1))))
+		}
+	}
+	if dir.SpilledBytes() == 0 {
+		panic(dir.String())
+	}
+
+	trees[1], err = Open(dir, trees[1].MetaLocation(), nil, opts...)
+	if err != nil {
+		panic(err)
+	}
+	for j, tree := range trees {
+		if err := tree.Verify(); err != nil {
+			panic(err)
+		}
+		i := uint64(0)
+		iter := tree.Scan()
+		for iter.Next() {
+			if binary.LittleEndian.Uint64(iter.ValueBytes()) != i*uint64(j+1) {
+				panic(i)
+			}
+			i++
+		}
+		stats, from, to := new(Int64Stats), new(int64), new(int64)
+		*to = 1999
+		tree.AggregatePointer(unsafe.Pointer(from), unsafe.Pointer(to), unsafe.Pointer(stats))
+		if i != 2000 || stats.Count != 2000 || stats.Sum != 1999*2000/2*int64(j+1) {
+			panic(fmt.Sprint(i, *stats))
+		}
+	}
+	// 最后一次操作用到的 block 在下一次操作结束时换出
+	trees[0].GetBytes(binary.LittleEndian.AppendUint64(nil, 1))
+	if dir.ResidentBytes() > 8*1024 {
+		panic(dir.String())
+	}
+}
+
+func TestBufferPoolDirectory(t *testing.T) {
+	file, err := os.Create(filepath.Join(t.TempDir(), "pages"))
+	if err != nil {
+		panic(err)
+	}
+	defer file.Close()
+	// 每次操作用到的页都不会换出，frame 比树高少也可以
+	dir := memory.NewBufferPool(file, 1024, 2)
+	opts := []Option{WithKeyType(KeyInt64), WithDegree(5), WithChecksums(ChecksumAlways), WithPointerAggregator(Int64StatsAggregator{})}
+	tree := New(dir, nil, opts...)
+	for i := 0; i < 2000; i++ {
+		k := binary.LittleEndian.AppendUint64(nil, uint64(i*7%2000))
+		tree.InsertBytes(k, binary.LittleEndian.AppendUint64(nil, uint64(i*7%2000)))
+	}
+	for i := 0; i < 2000; i += 2 {
+		k := binary.LittleEndian.AppendUint64(nil, uint64(i))
+		if !tree.DeleteOnePointer(unsafe.Pointer(&k[0]), unsafe.Pointer(&k[0]), 8) {
+			panic(i)
+		}
+	}
+	if s := dir.Stats(); s.Evictions == 0 || s.Reads == 0 {
+		panic(dir.String())
+	}
+	if err := dir.Flush(); err != nil {
+		panic(err)
+	}
+	if dir.DirtyPages() != 0 {
+		panic(dir.String())
+	}
+
+	// 新的 BufferPool 打开 Flush 过的文件，继续插入之后再次 Flush、打开
+	meta := tree.MetaLocation()
+	reopen := func() {
+		dir, err = memory.OpenBufferPool(file, 2)
+		if err != nil {
+			panic(err)
+		}
+		tree, err = Open(dir, meta, nil, opts...)
+		if err != nil {
+			panic(err)
+		}
+		if err := tree.Verify(); err != nil {
+			panic(err)
+		}
+	}
+	reopen()
+	i := uint64(1)
+	iter := tree.Scan()
+	for iter.Next() {
+		if binary.LittleEndian.Uint64(iter.ValueBytes()) != i {
+			panic(i)
+		}
+		i += 2
+	}
+	stats, from, to := new(Int64Stats), new(int64), new(int64)
+	*to = 1999
+	tree.AggregatePointer(unsafe.Pointer(from), unsafe.Pointer(to), unsafe.Pointer(stats))
+	if i != 2001 || stats.Count != 1000 || stats.Sum != 1000*1000 {
+		panic(fmt.Sprint(i, *stats))
+	}
+
+	for i := 0; i < 2000; i += 2 {
+		k := binary.LittleEndian.AppendUint64(nil, uint64(i))
+		tree.InsertBytes(k, k)
+	}
+	if err := dir.Flush(); err != nil {
+		panic(err)
+	}
+	reopen()
+	*stats = Int64Stats{}
+	tree.AggregatePointer(unsafe.Pointer(from), unsafe.Pointer(to), unsafe.Pointer(stats))
+	if stats.Count != 2000 || stats.Sum != 1999*2000/2 {
+		panic(fmt.Sprint(*stats))
+	}
+}
+
+// 遍历整棵树时 node 和 value 逐个 Pin、释放，用到的页不超过 frames 加上树高
+func TestBufferPoolWalk(t *testing.T) {
+	file, err := os.Create(filepath.Join(t.TempDir(), "pages"))
+	if err != nil {
+		panic(err)
+	}
+	defer file.Close()
+	dir := memory.NewBufferPool(file, 1024, 8)
+	tree := New(dir, nil, WithKeyType(KeyInt64), WithDegree(5), WithChecksums(ChecksumAlways), WithValueChecksums(), WithPointerAggregator(Int64StatsAggregator{}))
+	for i := 0; i < 2000; i++ {
+		k := binary.LittleEndian.AppendUint64(nil, uint64(i*7%2000))
+		tree.InsertBytes(k, k)
+	}
+	height := tree.Stats().Height
+	walks := map[string]func(){
+		"Verify": func() {
+			if err := tree.Verify(); err != nil {
+				panic(err)
+			}
+		},
+		"Stats": func() { tree.Stats() },
+		"Aggregate": func() {
+			stats, from, to := new(Int64Stats), new(int64), new(int64)
+			*from, *to = 1, 1998
+			tree.AggregatePointer(unsafe.Pointer(from), unsafe.Pointer(to), unsafe.Pointer(stats))
+		},
+		"WriteDOT": func() { tree.WriteDOTPointer(io.Discard, nil, nil) },
+		"Dump":     func() { tree.Dump(io.Discard) },
+		"AllKeys":  func() { allKeys(tree) },
+	}
+	for name, walk := range walks {
+		overflows := dir.Stats().Overflows
+		walk()
+		if n := dir.Stats().Overflows - overflows; n > uint64(height) {
+			panic(fmt.Sprint(name, " ", n, " ", dir.String()))
+		}
+	}
+}
+
+// 超过页大小的 value 使用连续的多页
+func TestBufferPoolLargeValue(t *testing.T) {
+	file, err := os.Create(filepath.Join(t.TempDir(), "pages"))
+	if err != nil {
+		panic(err)
+	}
+	defer file.Close()
+	dir := memory.NewBufferPool(file, 1024, 4)
+	tree := New(dir, nil, int64Keys, WithValueChecksums())
+	values := map[int64][]byte{}
+	for i := int64(1); i <= 20; i++ {
+		v := bytes.Repeat([]byte{byte(i)}, int(i)*500)
+		if err := tree.TryInsertPointer(unsafe.Pointer(&i), unsafe.Pointer(&v[0]), uint32(len(v))); err != nil {
+			panic(err)
+		}
+		values[i] = v
+	}
+	if err := dir.Flush(); err != nil {
+		panic(err)
+	}
+	for i, v := range values {
+		exist, p := tree.FindPointer(unsafe.Pointer(&i))
+		if !exist || !bytes.Equal(unsafe.Slice((*byte)(p), len(v)), v) {
+			panic(i)
+		}
+	}
+	if err := tree.Verify(); err != nil {
+		panic(err)
+	}
+}
+
+// 没有删除时，分裂产生的节点至少有 (degree+1)/2 个 item，不论插入顺序
+func TestSplitBalance(t *testing.T) {
+	for _, degree := range []int{3, 4, 5, 16} {
+		for _, order := range []string{"asc", "desc", "random"} {
+			tree := New(memory.New(1<<16), nil, WithKeyType(KeyInt64), WithDegree(degree))
+			r := rand.New(rand.NewSource(int64(degree)))
+			k := new(int64)
+			for i := int64(0); i < 1000; i++ {
+				switch order {
+				case "asc":
+					*k = i
+				case "desc":
+					*k = -i
+				default:
+					*k = r.Int63()
+				}
+				tree.InsertPointer(unsafe.Pointer(k), nil, 0)
+			}
+			if err := tree.Verify(); err != nil {
+				panic(err)
+			}
+			level := []*node{tree.root}
+			for len(level) > 0 {
+				next := []*node{}
+				for _, n := range level {
+					if n != tree.root && n.itemNumber.get() < uint32(degree+1)/2 {
+						panic(fmt.Sprint(degree, order, n.itemNumber.get()))
+					}
+					for i := uint32(0); !n.isLeaf() && i < n.itemNumber.get(); i++ {
+						next = append(next, tree.readNode(n.item(i).valueLoc))
+					}
+				}
+				level = next
+			}
+		}
+	}
 }
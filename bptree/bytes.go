@@ -0,0 +1,62 @@
+package bptree
+
+import (
+	"encoding/binary"
+	"fmt"
+	"github.com/madokast/bptree/memory"
+	"unsafe"
+)
+
+/**
+[]byte 接口
+Insert、Find 以 uintptr 传递 key 和 value，调用者需要保证内存在调用期间不被回收、不被移动（例如不能是栈上的变量）；InsertPointer 等 unsafe.Pointer 版本没有这个问题，但仍然需要 unsafe。
+InsertBytes、GetBytes 直接使用 []byte，不需要 unsafe：
+1. key 为 nil 表示 null key。定长 key 为 8 bytes，即 key 在内存中的表示（int64 等为小端）。变长 key 为数据部分，不含长度头
+2. value 为 nil 表示 null value，长度为 0 的非 nil value 不是 null
+3. GetBytes、Iterator.ValueBytes 返回的 value 直接指向 dir 中的内存（memory.Bytes），不复制，不能修改
+*/
+
+// InsertBytes 与 Insert 相同，key、value 以 []byte 传递
+func (t *Tree) InsertBytes(key, value []byte) {
+	t.enter()
+	defer t.exit()
+	k := t.bytesKey(key)
+	if k == nil && t.opts.noNullKeys {
+		panic(ErrNullKey)
+	}
+	if value == nil {
+		t.insert0(k, memory.Location{BlockId: nullBlockBidFlag})
+	} else {
+		t.insert0(k, t.newValueBytes(value))
+	}
+	t.flushTouched()
+}
+
+// GetBytes 与 Find 相同，key 以 []byte 传递，返回的 value 直接指向 dir 中的内存
+// 不存在时 exist 为 false，null value 返回 nil
+func (t *Tree) GetBytes(key []byte) (value []byte, exist bool) {
+	t.enter()
+	defer t.exit()
+	iter := t.FindAllPointer(t.bytesKey(key))
+	if !iter.Next() {
+		return nil, false
+	}
+	return iter.ValueBytes(), true
+}
+
+// bytesKey 把 key 写入 t.keyBuf，返回 key 指针。nil 返回 nil
+func (t *Tree) bytesKey(key []byte) unsafe.Pointer {
+	if key == nil {
+		return nil
+	}
+	if t.opts.varKeys {
+		t.keyBuf = binary.LittleEndian.AppendUint32(t.keyBuf[:0], uint32(len(key)))
+		t.keyBuf = append(t.keyBuf, key...)
+	} else {
+		if len(key) != keySize {
+			panic(fmt.Sprintf("bptree: key length %d, want %d", len(key), keySize))
+		}
+		t.keyBuf = append(t.keyBuf[:0], key...)
+	}
+	return unsafe.Pointer(&t.keyBuf[0])
+}
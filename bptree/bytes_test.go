@@ -0,0 +1,99 @@
+package bptree
+
+import (
+	"bytes"
+	"encoding/binary"
+	"fmt"
+	"github.com/madokast/bptree/memory"
+	"math/rand"
+	"testing"
+	"unsafe"
+)
+
+func TestInsertGetBytes(t *testing.T) {
+	for _, c := range []struct {
+		name  string
+		opts  []Option
+		keyOf func(k int64) []byte
+	}{
+		{"int64", []Option{WithKeyType(KeyInt64), WithValueChecksums()}, func(k int64) []byte {
+			return binary.LittleEndian.AppendUint64(nil, uint64(k))
+		}},
+		{"varKeys", []Option{WithKeyType(KeyBytes), WithVarKeys(), WithDegree(5)}, func(k int64) []byte {
+			return []byte(fmt.Sprintf("key-%d", k))
+		}},
+	} {
+		tree := New(memory.New(1<<12), nil, c.opts...)
+		m := map[int64][]byte{}
+		for i := 0; i < 500; i++ {
+			k := int64(rand.Intn(300)) - 150
+			var value []byte
+			if rand.Intn(10) > 0 {
+				value = make([]byte, rand.Intn(20))
+				rand.Read(value)
+			}
+			m[k] = value
+			tree.InsertBytes(c.keyOf(k), value)
+		}
+		tree.InsertBytes(nil, []byte("null"))
+		if err := tree.Verify(); err != nil {
+			panic(err)
+		}
+
+		for k := int64(-160); k < 160; k++ {
+			value, exist := tree.GetBytes(c.keyOf(k))
+			want, ok := m[k]
+			if exist != ok || !bytes.Equal(value, want) || (value == nil) != (want == nil) {
+				panic(fmt.Sprint(c.name, k, value, want))
+			}
+		}
+		if value, exist := tree.GetBytes(nil); !exist || string(value) != "null" {
+			panic(c.name)
+		}
+
+		// 与 uintptr 接口一致
+		iter := tree.Scan()
+		for iter.Next() {
+			value := iter.ValueBytes()
+			if (value == nil) != (iter.Value() == 0) || uint32(len(value)) != iter.ValueLength() {
+				panic(c.name)
+			}
+			if len(value) > 0 && uintptr(unsafe.Pointer(&value[0])) != iter.Value() {
+				panic(c.name) // 不复制
+			}
+		}
+	}
+
+	// 定长 key 必须是 8 bytes
+	defer func() {
+		if recover() == nil {
+			panic("short key")
+		}
+	}()
+	New(memory.New(1024), nil, WithKeyType(KeyInt64)).InsertBytes([]byte{1}, nil)
+}
+
+// value 比 block 大时放在单独的 huge block 中
+func TestHugeValue(t *testing.T) {
+	dir := memory.New(1024, memory.WithGrowth(4096))
+	tree := New(dir, nil, WithKeyType(KeyInt64), WithValueChecksums())
+	huge := bytes.Repeat([]byte("0123456789"), 1000)
+	for i := 0; i < 20; i++ {
+		k := binary.LittleEndian.AppendUint64(nil, uint64(i))
+		if i%5 == 0 {
+			tree.InsertBytes(k, huge)
+		} else {
+			tree.InsertBytes(k, k)
+		}
+	}
+	if err := tree.Verify(); err != nil {
+		panic(err)
+	}
+	for i := 0; i < 20; i++ {
+		k := binary.LittleEndian.AppendUint64(nil, uint64(i))
+		value, _ := tree.GetBytes(k)
+		if (i%5 == 0 && !bytes.Equal(value, huge)) || (i%5 != 0 && !bytes.Equal(value, k)) {
+			panic(i)
+		}
+	}
+}
@@ -0,0 +1,163 @@
+package bptree
+
+import (
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"github.com/madokast/bptree/memory"
+	"hash/crc32"
+	"unsafe"
+)
+
+/**
+校验和
+持久化的 MemManager 中，写入可能只完成一半，数据也可能位翻转。
+WithChecksums 时每个 node 保存一个 CRC32C，覆盖 node 头、前 itemNumber 个 item 和聚合值。
+node 头的 32 bytes 已经用满，校验和放在聚合值之后，只有开启时才分配，不改变其它树的格式。
+一次操作中 node 可能被多次修改，所以在操作结束（flushTouched）时统一重算，读取（readNode）时按 ChecksumMode 校验，本次操作修改过的 node 不校验。
+WithValueChecksums 时 value 数据的 CRC32C 保存在 value 记录的保留字段中，读取 value 时校验。
+校验失败 panic(*ChecksumError)，TryInsert、TryFind 返回该错误。Verify 不论 ChecksumMode 都会校验全部的校验和
+*/
+
+// ChecksumMode 读取时何时校验
+type ChecksumMode byte
+
+const (
+	ChecksumAlways  ChecksumMode = iota // 每次读取都校验，默认
+	ChecksumSampled                     // 随机抽取 1/2^checksumSampleBits 的读取校验
+	ChecksumOff                         // 读取时不校验，只写入，由 Verify 校验
+)
+
+const (
+	checksumSz         = uint32(4)
+	checksumSampleBits = 4 // ChecksumSampled 校验 1/16 的读取
+)
+
+var castagnoli = crc32.MakeTable(crc32.Castagnoli)
+
+var ErrChecksum = errors.New("bptree: checksum mismatch")
+
+// ChecksumError 校验失败的 node 或 value 的地址。errors.Is 对 ErrChecksum 和 ErrCorrupt 都成立
+type ChecksumError struct {
+	Loc   memory.Location
+	Value bool // true 表示 value 校验失败，否则是 node
+}
+
+func (e *ChecksumError) Error() string {
+	kind := "node"
+	if e.Value {
+		kind = "value"
+	}
+	return fmt.Sprintf("%v: %s %v", ErrChecksum, kind, e.Loc)
+}
+
+func (e *ChecksumError) Is(target error) bool {
+	return target == ErrChecksum || target == ErrCorrupt
+}
+
+// WithChecksums 每个 node 保存 CRC32C，读取时按 mode 校验。mode 不持久化，重新打开时可以不同
+func WithChecksums(mode ChecksumMode) Option {
+	return func(o *options) {
+		o.checksums = true
+		o.checksumMode = mode
+	}
+}
+
+// WithValueChecksums 每个 value 保存 CRC32C，读取时校验。校验的时机由 WithChecksums 的 mode 决定，默认每次都校验
+func WithValueChecksums() Option {
+	return func(o *options) {
+		o.valueChecksums = true
+	}
+}
+
+// checksumSize node 之后附带的校验和大小
+func (t *Tree) checksumSize() uint32 {
+	if !t.opts.checksums {
+		return 0
+	}
+	return checksumSz
+}
+
+// nodeChecksum 计算 n 的校验和。itemNumber 损坏时只计算到 degree，结果必然不一致
+func (t *Tree) nodeChecksum(n *node) uint32 {
+	number := n.itemNumber.get()
+	if number > t.opts.degree {
+		number = t.opts.degree
+	}
+	crc := crc32.Update(0, castagnoli, unsafe.Slice((*byte)(unsafe.Pointer(n)), nodeHeaderSz+number*itemSz))
+	if size := t.summarySize(); size > 0 {
+		crc = crc32.Update(crc, castagnoli, unsafe.Slice((*byte)(t.summaryOf(n)), size))
+	}
+	return crc
+}
+
+// storedChecksum node 中保存的校验和，位于聚合值之后
+func (t *Tree) storedChecksum(n *node) *[checksumSz]byte {
+	return (*[checksumSz]byte)(unsafe.Add(unsafe.Pointer(n), t.nodeSize()+t.summarySize()))
+}
+
+// seal 重算并写入 n 的校验和
+func (t *Tree) seal(n *node) {
+	if t.opts.checksums {
+		binary.LittleEndian.PutUint32(t.storedChecksum(n)[:], t.nodeChecksum(n))
+	}
+}
+
+// checkNode 校验 loc 处的 node，失败返回 *ChecksumError
+func (t *Tree) checkNode(loc memory.Location, n *node) error {
+	if binary.LittleEndian.Uint32(t.storedChecksum(n)[:]) != t.nodeChecksum(n) {
+		return &ChecksumError{Loc: loc}
+	}
+	return nil
+}
+
+// valueChecksum value 记录 record 中数据的校验和
+func valueChecksum(record unsafe.Pointer) uint32 {
+	return crc32.Checksum(recordBytes(record), castagnoli)
+}
+
+// storedValueChecksum value 记录保留字段中的校验和
+func storedValueChecksum(record unsafe.Pointer) *[checksumSz]byte {
+	return (*[checksumSz]byte)(unsafe.Add(record, 4))
+}
+
+// checkValue 校验 valLoc 处的 value 记录 record，失败返回 *ChecksumError
+func (t *Tree) checkValue(valLoc memory.Location, record unsafe.Pointer) error {
+	if binary.LittleEndian.Uint32(storedValueChecksum(record)[:]) != valueChecksum(record) {
+		return &ChecksumError{Loc: valLoc, Value: true}
+	}
+	return nil
+}
+
+// verifyValue 读取 value 时按 ChecksumMode 校验 valLoc 处的记录 record，失败 panic(*ChecksumError)
+func (t *Tree) verifyValue(valLoc memory.Location, record unsafe.Pointer) {
+	if t.opts.valueChecksums && t.shouldVerify() {
+		if err := t.checkValue(valLoc, record); err != nil {
+			panic(err)
+		}
+	}
+}
+
+// shouldVerify 本次读取是否需要校验
+func (t *Tree) shouldVerify() bool {
+	switch t.opts.checksumMode {
+	case ChecksumAlways:
+		return true
+	case ChecksumSampled:
+		// 线性同余，取高位。按固定间隔抽样时，每次查找读取的 node 数目与间隔成倍数的话，同一层的 node 永远不会被校验
+		t.checksumSeed = t.checksumSeed*1664525 + 1013904223
+		return t.checksumSeed>>(32-checksumSampleBits) == 0
+	default:
+		return false
+	}
+}
+
+// isTouched n 是否在本次操作中被修改过，这样的 node 还没有重算校验和
+func (t *Tree) isTouched(n *node) bool {
+	for _, m := range t.touched {
+		if m == n {
+			return true
+		}
+	}
+	return false
+}
@@ -0,0 +1,127 @@
+package bptree
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"github.com/madokast/bptree/memory"
+	"math/rand"
+	"testing"
+	"unsafe"
+)
+
+func TestChecksumNode(t *testing.T) {
+	for _, mode := range []ChecksumMode{ChecksumAlways, ChecksumSampled, ChecksumOff} {
+		faulty := memory.NewFaulty(memory.New(1 << 12))
+		tree := New(faulty, nil, WithKeyType(KeyInt64), WithChecksums(mode), WithPointerAggregator(Int64StatsAggregator{}), WithDegree(4))
+		for i := int64(0); i < 200; i++ {
+			*key2 = i
+			tree.InsertPointer(int64KeyOf(i), unsafe.Pointer(key2), 8)
+		}
+		if err := tree.Verify(); err != nil {
+			panic(err)
+		}
+
+		// 翻转 key 为 100 的叶子中的一位
+		leaf := tree.findLeaf(int64KeyOf(100), nil)
+		loc := leaf.selfPoint.get()
+		offset := nodeHeaderSz + itemSz + 8
+		original := leaf.item(1).key
+		faulty.Corrupt(loc, offset, []byte{original[0] ^ 1})
+
+		err := tree.Verify()
+		var cerr *ChecksumError
+		if !errors.As(err, &cerr) || cerr.Loc != loc || cerr.Value || !errors.Is(err, ErrCorrupt) {
+			panic(fmt.Sprint(mode, err))
+		}
+
+		// 读取时按 mode 校验
+		detected := false
+		for i := 0; i < 16<<checksumSampleBits && !detected; i++ {
+			_, _, err = tree.TryFindPointer(int64KeyOf(100))
+			detected = err != nil
+		}
+		if detected != (mode != ChecksumOff) {
+			panic(fmt.Sprint(mode, err))
+		}
+		if detected && (!errors.As(err, &cerr) || cerr.Loc != loc) {
+			panic(fmt.Sprint(mode, err))
+		}
+		if mode == ChecksumAlways {
+			*key2 = 0
+			if err := tree.TryInsertPointer(int64KeyOf(100), unsafe.Pointer(key2), 8); !errors.Is(err, ErrChecksum) {
+				panic(err)
+			}
+		}
+
+		faulty.Corrupt(loc, offset, original[:1])
+		if err := tree.Verify(); err != nil {
+			panic(fmt.Sprint(mode, err))
+		}
+	}
+}
+
+func TestChecksumValue(t *testing.T) {
+	faulty := memory.NewFaulty(memory.New(1 << 12))
+	tree := New(faulty, nil, WithKeyType(KeyInt64), WithValueChecksums())
+	for i := int64(0); i < 50; i++ {
+		*key2 = i
+		tree.InsertPointer(int64KeyOf(i), unsafe.Pointer(key2), 8)
+	}
+	leaf := tree.findLeaf(int64KeyOf(30), nil)
+	local, _ := tree.search(leaf, int64KeyOf(30), false)
+	valLoc := leaf.item(local).valueLoc
+
+	faulty.Corrupt(valLoc, valueHeaderSz, []byte{0xFF})
+	var cerr *ChecksumError
+	if _, _, err := tree.TryFindPointer(int64KeyOf(30)); !errors.As(err, &cerr) || cerr.Loc != valLoc || !cerr.Value {
+		panic(err)
+	}
+	if err := tree.Verify(); !errors.As(err, &cerr) || cerr.Loc != valLoc {
+		panic(err)
+	}
+	// 其它 value 不受影响
+	if exist, value, err := tree.TryFindPointer(int64KeyOf(31)); err != nil || !exist || *(*int64)(value) != 31 {
+		panic(err)
+	}
+	faulty.Corrupt(valLoc, valueHeaderSz, []byte{30})
+	if exist, value, err := tree.TryFindPointer(int64KeyOf(30)); err != nil || !exist || *(*int64)(value) != 30 {
+		panic(err)
+	}
+}
+
+func TestChecksumOpenRestore(t *testing.T) {
+	dir := memory.New(1 << 12)
+	opts := []Option{WithKeyType(KeyBytes), WithVarKeys(), WithChecksums(ChecksumAlways), WithValueChecksums(), WithDegree(6)}
+	tree := New(dir, nil, opts...)
+	for i := 0; i < 300; i++ {
+		*key2 = int64(i)
+		tree.InsertPointer(varKeyOf(rand.Int63n(1000)), unsafe.Pointer(key2), 8)
+	}
+	if err := tree.Verify(); err != nil {
+		panic(err)
+	}
+
+	// mode 不持久化，可以不同；是否开启校验和必须一致
+	reopen, err := Open(dir, tree.MetaLocation(), nil, WithKeyType(KeyBytes), WithVarKeys(), WithChecksums(ChecksumSampled), WithValueChecksums(), WithDegree(6))
+	if err != nil {
+		panic(err)
+	}
+	if pairsOf(reopen, rawString) != pairsOf(tree, rawString) {
+		panic("reopen")
+	}
+	if _, err := Open(dir, tree.MetaLocation(), nil, WithKeyType(KeyBytes), WithVarKeys(), WithValueChecksums(), WithDegree(6)); !errors.Is(err, ErrOptionsMismatch) {
+		panic(err)
+	}
+
+	restored, err := Restore(bytes.NewReader(dumpOf(tree)), memory.New(1<<12), nil, opts...)
+	if err != nil {
+		panic(err)
+	}
+	if err := restored.Verify(); err != nil {
+		panic(err)
+	}
+	if pairsOf(restored, rawString) != pairsOf(tree, rawString) {
+		panic("restore")
+	}
+}
@@ -0,0 +1,211 @@
+package bptree
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"github.com/madokast/bptree/bptree/keys"
+	"github.com/madokast/bptree/memory"
+	"math"
+	"unsafe"
+)
+
+/**
+内置 key 类型和比较函数
+WithKeyType 指定 key 类型后可以不传 compareFunc。key 类型持久化在元数据中，
+传入 compareFunc 时会用一组样本检查它和 key 类型的顺序是否一致，不一致说明比较函数用错了
+*/
+
+// KeyType key 的类型，决定排序方式
+type KeyType byte
+
+const (
+	KeyCustom  KeyType = iota // 自定义 compareFunc，默认
+	KeyInt64                  // int64，按有符号整数比较
+	KeyUint64                 // uint64，按无符号整数比较
+	KeyFloat64                // float64 全序：-Inf < 负数 < -0 = +0 < 正数 < +Inf < NaN，所有 NaN 相等
+	KeyBytes                  // 按字节序比较（大端无符号）。定长 key 比较 8 bytes，变长 key 比较数据部分
+)
+
+var ErrComparatorMismatch = errors.New("bptree: comparator does not match key type")
+
+func (kt KeyType) String() string {
+	switch kt {
+	case KeyCustom:
+		return "custom"
+	case KeyInt64:
+		return "int64"
+	case KeyUint64:
+		return "uint64"
+	case KeyFloat64:
+		return "float64"
+	case KeyBytes:
+		return "bytes"
+	default:
+		return fmt.Sprintf("KeyType(%d)", byte(kt))
+	}
+}
+
+// CompareInt64 KeyInt64 的比较函数
+func CompareInt64(k1, k2 uintptr) int {
+	return compareInt64(memory.UintptrPointer(k1), memory.UintptrPointer(k2))
+}
+
+// CompareUint64 KeyUint64 的比较函数
+func CompareUint64(k1, k2 uintptr) int {
+	return compareUint64(memory.UintptrPointer(k1), memory.UintptrPointer(k2))
+}
+
+// CompareFloat64 KeyFloat64 的比较函数
+func CompareFloat64(k1, k2 uintptr) int {
+	return compareFloat64(memory.UintptrPointer(k1), memory.UintptrPointer(k2))
+}
+
+// CompareBytes 定长 key 的 KeyBytes 比较函数，8 bytes 按字节序比较
+func CompareBytes(k1, k2 uintptr) int {
+	return compareBytes(memory.UintptrPointer(k1), memory.UintptrPointer(k2))
+}
+
+func compareInt64(k1, k2 unsafe.Pointer) int {
+	n1 := *((*int64)(k1))
+	n2 := *((*int64)(k2))
+	if n1 > n2 {
+		return 1
+	} else if n1 < n2 {
+		return -1
+	} else {
+		return 0
+	}
+}
+
+func compareUint64(k1, k2 unsafe.Pointer) int {
+	n1 := *((*uint64)(k1))
+	n2 := *((*uint64)(k2))
+	if n1 > n2 {
+		return 1
+	} else if n1 < n2 {
+		return -1
+	} else {
+		return 0
+	}
+}
+
+func compareFloat64(k1, k2 unsafe.Pointer) int {
+	n1 := keys.FloatBits(*((*float64)(k1)))
+	n2 := keys.FloatBits(*((*float64)(k2)))
+	if n1 > n2 {
+		return 1
+	} else if n1 < n2 {
+		return -1
+	} else {
+		return 0
+	}
+}
+
+func compareBytes(k1, k2 unsafe.Pointer) int {
+	return bytes.Compare((*[keySize]byte)(k1)[:], (*[keySize]byte)(k2)[:])
+}
+
+// builtinCompare key 类型对应的内置比较函数
+func (o *options) builtinCompare() func(k1, k2 unsafe.Pointer) int {
+	switch o.keyType {
+	case KeyInt64:
+		return compareInt64
+	case KeyUint64:
+		return compareUint64
+	case KeyFloat64:
+		return compareFloat64
+	case KeyBytes:
+		if o.varKeys {
+			return keys.ComparePointer
+		}
+		return compareBytes
+	default:
+		return nil
+	}
+}
+
+// resolveCompare 确定实际使用的比较函数。compareFunc 和 WithCompare 都没有指定时使用内置的，否则检查它与 key 类型是否一致
+func (o *options) resolveCompare(uintptrCompare func(k1, k2 uintptr) int) (func(k1, k2 unsafe.Pointer) int, error) {
+	compareFunc := o.compare
+	if uintptrCompare != nil {
+		if compareFunc != nil {
+			return nil, fmt.Errorf("%w: both compareFunc and WithCompare", ErrComparatorMismatch)
+		}
+		compareFunc = func(k1, k2 unsafe.Pointer) int {
+			return uintptrCompare(uintptr(k1), uintptr(k2))
+		}
+	}
+	builtin := o.builtinCompare()
+	if compareFunc == nil {
+		if builtin == nil {
+			return nil, fmt.Errorf("%w: %v needs compareFunc", ErrComparatorMismatch, o.keyType)
+		}
+		return builtin, nil
+	}
+	if builtin == nil {
+		return compareFunc, nil
+	}
+	if o.varKeys && o.keyType != KeyBytes {
+		return nil, fmt.Errorf("%w: %v cannot be var keys", ErrComparatorMismatch, o.keyType)
+	}
+
+	samples := o.keyType.samples(o.varKeys)
+	for i := range samples {
+		for j := range samples {
+			k1, k2 := unsafe.Pointer(&samples[i][0]), unsafe.Pointer(&samples[j][0])
+			if sign(compareFunc(k1, k2)) != sign(builtin(k1, k2)) {
+				return nil, fmt.Errorf("%w: %v, sample %d vs %d", ErrComparatorMismatch, o.keyType, i, j)
+			}
+		}
+	}
+	return compareFunc, nil
+}
+
+// samples 用于检查比较函数的样本，每个样本是一个 key 的内存
+func (kt KeyType) samples(varKeys bool) [][]byte {
+	samples := make([][]byte, 0)
+	newSample := func() (b []byte, p unsafe.Pointer) {
+		b = make([]byte, keySize)
+		samples = append(samples, b)
+		return b, unsafe.Pointer(&b[0])
+	}
+	switch kt {
+	case KeyInt64:
+		for _, v := range []int64{math.MinInt64, -2, -1, 0, 1, 2, math.MaxInt64} {
+			_, p := newSample()
+			*(*int64)(p) = v
+		}
+	case KeyUint64:
+		for _, v := range []uint64{0, 1, 2, 1 << 63, math.MaxUint64} {
+			_, p := newSample()
+			*(*uint64)(p) = v
+		}
+	case KeyFloat64:
+		for _, v := range []float64{math.Inf(-1), -2, -1, -0.5, math.Copysign(0, -1), 0, 0.5, 1, 2, math.Inf(1), math.NaN()} {
+			_, p := newSample()
+			*(*float64)(p) = v
+		}
+	case KeyBytes:
+		if varKeys {
+			for _, s := range []string{"", "\x00", "a", "ab", "b", "\xff"} {
+				samples = append(samples, keys.New().Bytes([]byte(s), keys.Asc).Key())
+			}
+		} else {
+			for _, s := range []string{"\x00", "\x01", "\x01\x00\x00\x00\x00\x00\x00\x01", "\x7f", "\x80", "\xff"} {
+				b, _ := newSample()
+				copy(b, s)
+			}
+		}
+	}
+	return samples
+}
+
+func sign(c int) int {
+	if c > 0 {
+		return 1
+	} else if c < 0 {
+		return -1
+	}
+	return 0
+}
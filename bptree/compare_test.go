@@ -0,0 +1,101 @@
+package bptree
+
+import (
+	"errors"
+	"fmt"
+	"github.com/madokast/bptree/bptree/keys"
+	"github.com/madokast/bptree/memory"
+	"math"
+	"math/rand"
+	"testing"
+	"unsafe"
+)
+
+var fkey = new(float64)
+var ukey = new(uint64)
+
+func TestFloat64Keys(t *testing.T) {
+	directory := memory.New(1024)
+	tree := New(directory, nil, WithKeyType(KeyFloat64))
+	values := []float64{3.14, -1, math.NaN(), math.Inf(1), -2.5, math.Copysign(0, -1), math.Inf(-1), 1e-300, -1e-300}
+	for _, v := range values {
+		*fkey = v
+		tree.InsertPointer(unsafe.Pointer(fkey), nil, 0)
+	}
+	// -0 与 0 相等，NaN 与 NaN 相等，覆盖而不是新增
+	*fkey = 0
+	tree.InsertPointer(unsafe.Pointer(fkey), nil, 0)
+	*fkey = -math.NaN()
+	tree.InsertPointer(unsafe.Pointer(fkey), nil, 0)
+
+	got := fmt.Sprint(scanKeys(tree, func(p unsafe.Pointer) interface{} { return *(*float64)(p) }))
+	if got != "[-Inf -2.5 -1 -1e-300 -0 1e-300 3.14 +Inf NaN]" {
+		panic(got)
+	}
+}
+
+func TestUint64Keys(t *testing.T) {
+	directory := memory.New(1024)
+	tree := New(directory, nil, WithKeyType(KeyUint64))
+	for _, v := range []uint64{math.MaxUint64, 1 << 63, 0, 1, 1<<63 - 1} {
+		*ukey = v
+		tree.InsertPointer(unsafe.Pointer(ukey), nil, 0)
+	}
+	got := fmt.Sprint(scanKeys(tree, func(p unsafe.Pointer) interface{} { return *(*uint64)(p) }))
+	if got != "[0 1 9223372036854775807 9223372036854775808 18446744073709551615]" {
+		panic(got)
+	}
+}
+
+func TestBytesKeys(t *testing.T) {
+	directory := memory.New(1024)
+	tree := New(directory, nil, WithKeyType(KeyBytes))
+	for i := 0; i < 100; i++ {
+		*ukey = rand.Uint64()
+		tree.InsertPointer(unsafe.Pointer(ukey), nil, 0)
+	}
+	all := scanKeys(tree, func(p unsafe.Pointer) interface{} { return *(*[keySize]byte)(p) })
+	for i := 1; i < len(all); i++ {
+		a, b := all[i-1].([keySize]byte), all[i].([keySize]byte)
+		if string(a[:]) >= string(b[:]) {
+			panic(fmt.Sprint(a, b))
+		}
+	}
+
+	// 变长
+	tree = New(directory, nil, WithKeyType(KeyBytes), WithVarKeys())
+	for _, s := range []string{"b", "ab", "", "a"} {
+		tree.InsertPointer(keys.New().String(s, keys.Asc).Key().UnsafePointer(), nil, 0)
+	}
+	got := fmt.Sprint(scanKeys(tree, func(p unsafe.Pointer) interface{} { return tupleString(p) }))
+	if got != "[[] [a] [ab] [b]]" {
+		panic(got)
+	}
+}
+
+func TestComparatorMismatch(t *testing.T) {
+	directory := memory.New(1024)
+	tree := New(directory, nil, WithKeyType(KeyFloat64))
+
+	// int64 的比较函数会把负的 float64 排错
+	if _, err := Open(directory, tree.MetaLocation(), nil, WithCompare(compareInt64), WithKeyType(KeyFloat64)); !errors.Is(err, ErrComparatorMismatch) {
+		panic(err)
+	}
+	if _, err := Open(directory, tree.MetaLocation(), nil, WithKeyType(KeyInt64)); !errors.Is(err, ErrOptionsMismatch) {
+		panic(err)
+	}
+	if _, err := Open(directory, tree.MetaLocation(), nil, WithCompare(compareFloat64), WithKeyType(KeyFloat64)); err != nil {
+		panic(err)
+	}
+	if _, err := Open(directory, tree.MetaLocation(), nil); !errors.Is(err, ErrComparatorMismatch) {
+		panic(err)
+	}
+
+	defer func() {
+		r := recover()
+		if err, ok := r.(error); !ok || !errors.Is(err, ErrComparatorMismatch) {
+			panic(r)
+		}
+	}()
+	New(directory, nil, int64Keys, WithKeyType(KeyUint64))
+}
@@ -0,0 +1,135 @@
+package bptree
+
+import (
+	"fmt"
+	"github.com/madokast/bptree/memory"
+	"io"
+	"strconv"
+	"strings"
+	"unsafe"
+)
+
+/**
+Graphviz 导出
+每个 node 是一个 record，第一格为模式和地址，之后每个 item 一格。
+中间节点的 item 用实线指向子节点，同一层的 nextPoint 用虚线相连，同一层的 node 排在同一行。
+dot -Tsvg tree.dot -o tree.svg 即可查看
+*/
+
+// WriteDOT 以 Graphviz DOT 格式输出树的结构。keyFmt、valFmt 为 nil 时按 int64 输出，与 PrintTree 一致
+// uintptr 不能通过 checkptr 检查，见 WriteDOTPointer
+func (t *Tree) WriteDOT(w io.Writer, keyFmt func(p uintptr) string, valFmt func(p uintptr) string) error {
+	return t.WriteDOTPointer(w, uintptrFormat(keyFmt), uintptrFormat(valFmt))
+}
+
+// WriteDOTPointer 与 WriteDOT 相同，keyFmt、valFmt 以 unsafe.Pointer 接收 key、value
+func (t *Tree) WriteDOTPointer(w io.Writer, keyFmt func(p unsafe.Pointer) string, valFmt func(p unsafe.Pointer) string) error {
+	t.enter()
+	defer t.exit()
+	if keyFmt == nil {
+		keyFmt = func(p unsafe.Pointer) string {
+			return strconv.Itoa(int(*((*int64)(p))))
+		}
+	}
+	if valFmt == nil {
+		valFmt = keyFmt
+	}
+
+	dw := dotWriter{w: w}
+	dw.printf("digraph bptree {\n")
+	dw.printf("\tnode [shape=record, fontname=monospace];\n")
+	if t.root != nil {
+		// 按地址逐层遍历，每次只读取一个 node
+		level := []memory.Location{t.root.selfPoint.get()}
+		for len(level) > 0 {
+			next := make([]memory.Location, 0)
+			ids := make([]string, 0, len(level))
+			for _, loc := range level {
+				n := t.readNode(loc)
+				id := dotId(n.selfPoint.get())
+				ids = append(ids, id)
+
+				cells := []string{dotEscape(n.modeStr() + " " + fmt.Sprint(n.selfPoint.get()))}
+				for i := uint32(0); i < n.itemNumber.get(); i++ {
+					it := n.item(i)
+					cell := nullStr
+					if !it.isNullKey() {
+						cell = keyFmt(t.keyPointer(it))
+					}
+					if n.isLeaf() {
+						if it.isNullValue() {
+							cell += ":" + nullStr
+						} else {
+							cell += ":" + t.formatValue(valFmt, it.valueLoc)
+						}
+					}
+					cells = append(cells, fmt.Sprintf("<i%d>%s", i, dotEscape(cell)))
+				}
+				dw.printf("\t%s [label=\"{%s}\"];\n", id, strings.Join(cells, "|"))
+
+				if !n.isLeaf() {
+					for i := uint32(0); i < n.itemNumber.get(); i++ {
+						child := n.item(i).valueLoc
+						dw.printf("\t%s:i%d -> %s;\n", id, i, dotId(child))
+						next = append(next, child)
+					}
+				}
+				if n.hasNext() {
+					dw.printf("\t%s -> %s [style=dashed, constraint=false];\n", id, dotId(n.nextPoint.get()))
+				}
+				t.releaseNode(n)
+			}
+			dw.printf("\t{rank=same; %s}\n", strings.Join(ids, "; "))
+			level = next
+		}
+	}
+	dw.printf("}\n")
+	return dw.err
+}
+
+// formatValue 用 valFmt 格式化 valLoc 处的 value，见 pinValue
+func (t *Tree) formatValue(valFmt func(p unsafe.Pointer) string, valLoc memory.Location) string {
+	record := t.pinValue(valLoc)
+	defer t.releaseValue(valLoc)
+	t.verifyValue(valLoc, record)
+	return valFmt(recordPointer(record))
+}
+
+// uintptrFormat 把 uintptr 的格式化函数适配为 unsafe.Pointer 的，nil 保持 nil
+func uintptrFormat(f func(p uintptr) string) func(p unsafe.Pointer) string {
+	if f == nil {
+		return nil
+	}
+	return func(p unsafe.Pointer) string {
+		return f(uintptr(p))
+	}
+}
+
+// dotWriter 记录第一个写入错误，之后的写入都忽略
+type dotWriter struct {
+	w   io.Writer
+	err error
+}
+
+func (dw *dotWriter) printf(format string, args ...interface{}) {
+	if dw.err == nil {
+		_, dw.err = fmt.Fprintf(dw.w, format, args...)
+	}
+}
+
+func dotId(loc memory.Location) string {
+	return fmt.Sprintf("n%d_%d", loc.BlockId, loc.BlockOffset)
+}
+
+// dotEscape 转义 record label 中的特殊字符
+func dotEscape(s string) string {
+	sb := strings.Builder{}
+	for _, r := range s {
+		switch r {
+		case '{', '}', '|', '<', '>', '"', '\\', ' ':
+			sb.WriteByte('\\')
+		}
+		sb.WriteRune(r)
+	}
+	return sb.String()
+}
@@ -0,0 +1,72 @@
+package bptree
+
+import (
+	"errors"
+	"fmt"
+	"github.com/madokast/bptree/memory"
+	"strings"
+	"testing"
+	"unsafe"
+)
+
+func TestWriteDOTEmpty(t *testing.T) {
+	sb := strings.Builder{}
+	if err := New(memory.New(1024), nil, int64Keys).WriteDOT(&sb, nil, nil); err != nil {
+		panic(err)
+	}
+	if sb.String() != "digraph bptree {\n\tnode [shape=record, fontname=monospace];\n}\n" {
+		panic(sb.String())
+	}
+}
+
+func TestWriteDOT(t *testing.T) {
+	tree := New(memory.New(1024), nil, int64Keys)
+	for i := int64(1); i <= 5; i++ {
+		*key = i
+		*key2 = i * 10
+		tree.InsertPointer(unsafe.Pointer(key), unsafe.Pointer(key2), 8)
+	}
+	tree.InsertPointer(nil, nil, 0)
+
+	sb := strings.Builder{}
+	if err := tree.WriteDOT(&sb, nil, nil); err != nil {
+		panic(err)
+	}
+	dot := sb.String()
+	t.Log(dot)
+
+	root, leaf := dotId(tree.root.selfPoint.get()), tree.firstLeaf()
+	next := tree.readNode(leaf.nextPoint.get())
+	for _, want := range []string{
+		root + " [label=\"{" + dotEscape("(R) "+fmt.Sprint(tree.root.selfPoint.get())) + "|<i0>2|<i1>5}\"];",
+		root + ":i0 -> ",
+		dotId(leaf.selfPoint.get()) + " [label=\"{" + dotEscape("(E) "+fmt.Sprint(leaf.selfPoint.get())) + "|<i0>nil:nil|<i1>1:10|<i2>2:20}\"];",
+		dotId(leaf.selfPoint.get()) + " -> " + dotId(next.selfPoint.get()) + " [style=dashed, constraint=false];",
+		"{rank=same; " + root + "}",
+	} {
+		if !strings.Contains(dot, want) {
+			panic(want)
+		}
+	}
+	if strings.Count(dot, "->") != 2+1 {
+		panic(dot)
+	}
+}
+
+type failWriter struct{ n int }
+
+func (w *failWriter) Write(p []byte) (int, error) {
+	if w.n == 0 {
+		return 0, errors.New("disk full")
+	}
+	w.n--
+	return len(p), nil
+}
+
+func TestWriteDOTError(t *testing.T) {
+	tree := New(memory.New(1024), nil, int64Keys)
+	insertKeys(tree, 1, 2, 3, 4)
+	if err := tree.WriteDOT(&failWriter{n: 3}, nil, nil); err == nil || err.Error() != "disk full" {
+		panic(err)
+	}
+}
@@ -0,0 +1,452 @@
+package bptree
+
+import (
+	"bufio"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"github.com/madokast/bptree/memory"
+	"hash"
+	"hash/crc32"
+	"io"
+	"unsafe"
+)
+
+/**
+导出与导入
+Dump 把键值对按顺序写成与平台无关的数据流，Restore 由数据流批量构建一棵新树，用于备份和在机器之间迁移。
+数据流全部为小端，格式为
+	头部 [magic "BPTD"][version uint16][flags uint32][keyType byte][degree uint16]
+	键值对 [tag byte][key][value]...
+	尾部 [dumpEnd byte][count uint64][crc32 uint32]
+tag 的 dumpNullKey、dumpNullValue 位表示 key、value 为 null。
+非 null 的定长 key 写 8 bytes：KeyBytes 原样写出，其余类型作为 uint64 按小端写出；变长 key 写 [uvarint 长度][数据]。
+非 null 的 value 写 [uvarint 长度][数据]。crc32 (IEEE) 覆盖之前的所有字节。
+聚合器不能序列化，Restore 时由 opts 指定，其余持久化的选项都来自数据流
+*/
+
+const (
+	dumpVersion   = uint16(1)
+	dumpNullKey   = byte(1 << 0)
+	dumpNullValue = byte(1 << 1)
+	dumpEnd       = byte(0xFF)
+)
+
+var dumpMagic = [4]byte{'B', 'P', 'T', 'D'}
+
+var ErrBadDump = errors.New("bptree: bad dump")
+
+// Dump 把树中的键值对按顺序写入 w
+func (t *Tree) Dump(w io.Writer) error {
+	t.enter()
+	defer t.exit()
+	dw := dumpWriter{w: bufio.NewWriter(w), crc: crc32.NewIEEE()}
+	dw.write(dumpMagic[:])
+	dw.uint16(dumpVersion)
+	dw.uint32(t.opts.flags())
+	dw.write([]byte{byte(t.opts.keyType)})
+	dw.uint16(uint16(t.opts.degree))
+
+	count := uint64(0)
+	for leaf := t.firstLeafOrNil(); leaf != nil; leaf = t.nextOrNil(leaf) {
+		for i := uint32(0); i < leaf.itemNumber.get(); i++ {
+			it := leaf.item(i)
+			tag := byte(0)
+			if it.isNullKey() {
+				tag |= dumpNullKey
+			}
+			if it.isNullValue() {
+				tag |= dumpNullValue
+			}
+			dw.write([]byte{tag})
+			if !it.isNullKey() {
+				switch {
+				case t.opts.varKeys:
+					dw.bytes(varKeyBytes(t.keyPointer(it)))
+				case t.opts.keyType == KeyBytes:
+					dw.write(it.key[:])
+				default:
+					dw.uint64(*(*uint64)(unsafe.Pointer(&it.key)))
+				}
+			}
+			if !it.isNullValue() {
+				t.dumpValue(&dw, it.valueLoc)
+			}
+			count++
+		}
+	}
+
+	dw.write([]byte{dumpEnd})
+	dw.uint64(count)
+	sum := dw.crc.Sum32()
+	dw.uint32(sum)
+	if dw.err != nil {
+		return dw.err
+	}
+	return dw.w.Flush()
+}
+
+// Restore 在 dir 中由 Dump 的数据流构建一棵新树
+// 排序、null、multimap、key 类型、度等持久化的选项来自数据流，opts 只用于聚合器这样不持久化的选项
+// compareFunc 的要求与 New 相同，数据流损坏、不完整或者键值对的顺序与 compareFunc 不一致时返回 ErrBadDump
+// node 填到 degree 的 3/4（见 bulkFill），构建时只访问每层最右边的 node，dir 中的页不必同时留在缓存中
+func Restore(r io.Reader, dir memory.MemManager, compareFunc func(k1, k2 uintptr) int, opts ...Option) (*Tree, error) {
+	if !littleEndianHost {
+		return nil, ErrBigEndianHost
+	}
+	dr := dumpReader{r: bufio.NewReader(r), crc: crc32.NewIEEE()}
+	var magic [4]byte
+	dr.read(magic[:])
+	version := dr.uint16()
+	flags := dr.uint32()
+	keyType := KeyType(dr.byte())
+	degree := dr.uint16()
+	if dr.err != nil {
+		return nil, fmt.Errorf("%w: %v", ErrBadDump, dr.err)
+	}
+	if magic != dumpMagic || version != dumpVersion {
+		return nil, fmt.Errorf("%w: magic %q version %d", ErrBadDump, magic[:], version)
+	}
+	if flags&^allFlags != 0 || degree < defaultDegree || degree > maxDegree {
+		return nil, fmt.Errorf("%w: flags %b degree %d", ErrBadDump, flags, degree)
+	}
+
+	o := newOptions(opts)
+	o.setFlags(flags)
+	o.keyType = keyType
+	o.degree = uint32(degree)
+	compare, err := o.resolveCompare(compareFunc)
+	if err != nil {
+		return nil, err
+	}
+	t := &Tree{dir: dir, opts: o}
+	t.compare = o.wrapCompare(compare, t.slotPointer)
+	t.detectDir()
+	t.enter()
+	defer t.exit()
+	t.newMeta()
+
+	b := bulkLoader{t: t, fill: bulkFill(o.degree)}
+	count := uint64(0)
+	buf := make([]byte, 0)
+	for {
+		tag := dr.byte()
+		if dr.err != nil {
+			return nil, fmt.Errorf("%w: %v", ErrBadDump, dr.err)
+		}
+		if tag == dumpEnd {
+			break
+		}
+		if tag&^(dumpNullKey|dumpNullValue) != 0 {
+			return nil, fmt.Errorf("%w: entry %d bad tag %x", ErrBadDump, count, tag)
+		}
+
+		it := item{null: notNullKeyFlag}
+		if tag&dumpNullKey != 0 {
+			it.null = nullKeyFlag
+		} else if o.varKeys {
+			buf = dr.bytes(buf)
+			if dr.err == nil {
+				*(*memory.Location)(unsafe.Pointer(&it.key)) = t.newVarKeyBytes(buf)
+			}
+		} else if o.keyType == KeyBytes {
+			dr.read(it.key[:])
+		} else {
+			*(*uint64)(unsafe.Pointer(&it.key)) = dr.uint64()
+		}
+		it.valueLoc.BlockId = nullBlockBidFlag
+		if tag&dumpNullValue == 0 {
+			buf = dr.bytes(buf)
+			if dr.err == nil {
+				it.valueLoc = t.newValueBytes(buf)
+			}
+		}
+		if dr.err != nil {
+			return nil, fmt.Errorf("%w: entry %d: %v", ErrBadDump, count, dr.err)
+		}
+		if it.null == nullKeyFlag && o.noNullKeys {
+			return nil, fmt.Errorf("%w: entry %d: %v", ErrBadDump, count, ErrNullKey)
+		}
+		if !b.add(it) {
+			return nil, fmt.Errorf("%w: entry %d out of order", ErrBadDump, count)
+		}
+		count++
+		// 每个键值对一个作用域，写完的 node 和 value 不必留在缓存中，bulkLoader 只保存地址
+		t.exit()
+		t.enter()
+	}
+
+	want := dr.uint64()
+	sum := dr.crc.Sum32()
+	got := dr.uint32()
+	if dr.err != nil {
+		return nil, fmt.Errorf("%w: %v", ErrBadDump, dr.err)
+	}
+	if got != sum || want != count {
+		return nil, fmt.Errorf("%w: crc %x, want %x, count %d, want %d", ErrBadDump, got, sum, count, want)
+	}
+	b.finish()
+	return t, nil
+}
+
+/*========== bulk load =============*/
+
+// bulkLoader 由有序的 item 自底向上构建树。每层只记录最右边、还没有写完的 node 的地址：
+// 一个 node 放满 fill 个 item 之后接上新的兄弟，把自己的分隔 item 放到上一层，计算聚合值、封存，之后不再访问。
+// 构建过程中只用到每层最右边的 node，Restore 每个键值对一个作用域，写完的 node 可以被换出（例如 memory.BufferPool）
+type bulkLoader struct {
+	t    *Tree
+	fill uint32            // 每个 node 放的 item 数，见 bulkFill
+	open []memory.Location // open[i] 第 i 层（0 为叶子）最右边的 node
+	prev *item             // 上一个 item 的副本，用于检查顺序。在堆上，key 的指针可以交给 compareFunc
+}
+
+// bulkFill Restore 时每个 node 填到 degree 的 3/4，留出空位，之后的插入不会立刻让每个 node 分裂
+func bulkFill(degree uint32) uint32 {
+	return degree - degree/4
+}
+
+// add 在最后追加一个叶子 item，返回 false 表示顺序不对
+// 先写入叶子再比较，不使用栈上 item 的 key 指针
+func (b *bulkLoader) add(it item) bool {
+	t := b.t
+	var leaf *node
+	if len(b.open) > 0 {
+		leaf = t.nodeAt(b.open[0])
+	}
+	if leaf == nil || leaf.itemNumber.get() == b.fill {
+		leaf = b.grow(0)
+	}
+	cur := leaf.item(leaf.itemNumber.get())
+	*cur = it
+	leaf.itemNumber.set(leaf.itemNumber.get() + 1)
+	// 叶子可能在之前的作用域中被写回、换出过，每次修改都要标记
+	t.dirty(leaf)
+	if b.prev == nil {
+		b.prev = new(item)
+	} else {
+		c := t.compare(t.keyPointer(cur), &b.prev.key, b.prev.null)
+		if c < 0 || (c == 0 && !t.opts.multimap) {
+			return false
+		}
+	}
+	*b.prev = *cur
+	return true
+}
+
+// grow 在第 level 层最右边开始一个新 node。原来最右边的 node 已经放满，接上新 node 之后由 push 写完
+func (b *bulkLoader) grow(level int) *node {
+	t := b.t
+	n := t.newNode()
+	n.mode = modeMid
+	if level == 0 {
+		n.mode = modeLeaf
+	}
+	n.nextPoint.set(memory.Location{BlockId: nullBlockBidFlag})
+	if level == len(b.open) {
+		b.open = append(b.open, n.selfPoint.get())
+		return n
+	}
+	full := t.nodeAt(b.open[level])
+	full.nextPoint.set(n.selfPoint.get())
+	b.open[level] = n.selfPoint.get()
+	b.push(level, full)
+	return n
+}
+
+// push 写完第 level 层的 n：分隔 item 放到上一层最右边的 node，上一层没有或者已经放满时 grow。之后计算聚合值、封存
+func (b *bulkLoader) push(level int, n *node) {
+	t := b.t
+	var father *node
+	if level+1 < len(b.open) {
+		father = t.nodeAt(b.open[level+1])
+	}
+	if father == nil || father.itemNumber.get() == b.fill {
+		father = b.grow(level + 1)
+	}
+	*father.item(father.itemNumber.get()) = n.separator()
+	father.itemNumber.set(father.itemNumber.get() + 1)
+	t.dirty(father)
+	n.fatherPoint.set(father.selfPoint.get())
+	b.seal(n)
+}
+
+// seal n 的 item 和子节点都已确定，计算聚合值并封存
+func (b *bulkLoader) seal(n *node) {
+	t := b.t
+	if t.opts.aggregator != nil {
+		t.refreshSummary(n)
+		return
+	}
+	t.seal(n)
+	t.dirty(n)
+}
+
+// finish 自底向上写完每层最右边的 node，最上层唯一的 node 是根。没有 item 时是空树
+func (b *bulkLoader) finish() {
+	t := b.t
+	for level := 0; level < len(b.open); level++ {
+		n := t.nodeAt(b.open[level])
+		if level < len(b.open)-1 {
+			b.push(level, n)
+			continue
+		}
+		n.mode |= modeRoot
+		n.mode &^= modeMid
+		n.fatherPoint.set(memory.Location{BlockId: nullBlockBidFlag})
+		b.seal(n)
+		t.root = n
+		t.rootLoc = n.selfPoint.get()
+		t.setMetaRoot(t.rootLoc)
+	}
+}
+
+/*========== helpers =============*/
+
+// firstLeafOrNil 最左边的叶子节点，空树返回 nil
+func (t *Tree) firstLeafOrNil() *node {
+	if t.root == nil {
+		return nil
+	}
+	return t.firstLeaf()
+}
+
+// nextOrNil 下一个兄弟节点，没有返回 nil。之后不再使用 n，释放它
+func (t *Tree) nextOrNil(n *node) *node {
+	defer t.releaseNode(n)
+	if !n.hasNext() {
+		return nil
+	}
+	return t.readNode(n.nextPoint.get())
+}
+
+// dumpValue 写入 valLoc 处的 value，见 pinValue
+func (t *Tree) dumpValue(dw *dumpWriter, valLoc memory.Location) {
+	record := t.pinValue(valLoc)
+	defer t.releaseValue(valLoc)
+	t.verifyValue(valLoc, record)
+	dw.bytes(recordBytes(record))
+}
+
+// dumpWriter 小端写入并计算 crc，记录第一个错误
+type dumpWriter struct {
+	w   *bufio.Writer
+	crc hash.Hash32
+	err error
+	buf [binary.MaxVarintLen64]byte
+}
+
+func (dw *dumpWriter) write(p []byte) {
+	if dw.err != nil {
+		return
+	}
+	dw.crc.Write(p)
+	_, dw.err = dw.w.Write(p)
+}
+
+func (dw *dumpWriter) uint16(v uint16) {
+	binary.LittleEndian.PutUint16(dw.buf[:], v)
+	dw.write(dw.buf[:2])
+}
+
+func (dw *dumpWriter) uint32(v uint32) {
+	binary.LittleEndian.PutUint32(dw.buf[:], v)
+	dw.write(dw.buf[:4])
+}
+
+func (dw *dumpWriter) uint64(v uint64) {
+	binary.LittleEndian.PutUint64(dw.buf[:], v)
+	dw.write(dw.buf[:8])
+}
+
+// bytes 写入 [uvarint 长度][数据]
+func (dw *dumpWriter) bytes(p []byte) {
+	n := binary.PutUvarint(dw.buf[:], uint64(len(p)))
+	dw.write(dw.buf[:n])
+	dw.write(p)
+}
+
+// dumpReader 小端读取并计算 crc，记录第一个错误，之后读到的都是 0
+type dumpReader struct {
+	r   *bufio.Reader
+	crc hash.Hash32
+	err error
+	buf [8]byte
+}
+
+func (dr *dumpReader) read(p []byte) {
+	if dr.err != nil {
+		return
+	}
+	if _, dr.err = io.ReadFull(dr.r, p); dr.err == io.EOF {
+		dr.err = io.ErrUnexpectedEOF
+	}
+	dr.crc.Write(p)
+}
+
+func (dr *dumpReader) byte() byte {
+	dr.read(dr.buf[:1])
+	if dr.err != nil {
+		return 0
+	}
+	return dr.buf[0]
+}
+
+func (dr *dumpReader) uint16() uint16 {
+	dr.read(dr.buf[:2])
+	if dr.err != nil {
+		return 0
+	}
+	return binary.LittleEndian.Uint16(dr.buf[:])
+}
+
+func (dr *dumpReader) uint32() uint32 {
+	dr.read(dr.buf[:4])
+	if dr.err != nil {
+		return 0
+	}
+	return binary.LittleEndian.Uint32(dr.buf[:])
+}
+
+func (dr *dumpReader) uint64() uint64 {
+	dr.read(dr.buf[:8])
+	if dr.err != nil {
+		return 0
+	}
+	return binary.LittleEndian.Uint64(dr.buf[:])
+}
+
+// ReadByte 实现 io.ByteReader，用于 binary.ReadUvarint
+func (dr *dumpReader) ReadByte() (byte, error) {
+	b := dr.byte()
+	return b, dr.err
+}
+
+// bytes 读取 [uvarint 长度][数据]，复用 buf
+// 长度可能已经损坏，按块读取，数据流提前结束时不会按错误的长度分配内存
+func (dr *dumpReader) bytes(buf []byte) []byte {
+	buf = buf[:0]
+	if dr.err != nil {
+		return buf
+	}
+	n, err := binary.ReadUvarint(dr)
+	if err != nil {
+		dr.err = err
+		return buf
+	}
+	if n > uint64(^uint32(0)) {
+		dr.err = fmt.Errorf("length %d is too large", n)
+		return buf
+	}
+	const chunk = 1 << 16
+	for remaining := int(n); remaining > 0 && dr.err == nil; {
+		size := remaining
+		if size > chunk {
+			size = chunk
+		}
+		buf = append(buf, make([]byte, size)...)
+		dr.read(buf[len(buf)-size:])
+		remaining -= size
+	}
+	return buf
+}
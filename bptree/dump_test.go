@@ -0,0 +1,212 @@
+package bptree
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"github.com/madokast/bptree/bptree/keys"
+	"github.com/madokast/bptree/memory"
+	"math/rand"
+	"os"
+	"path/filepath"
+	"testing"
+	"unsafe"
+)
+
+// pairsOf 按顺序列出所有键值对，用于比较两棵树
+func pairsOf(tree *Tree, keyString func(p unsafe.Pointer) string) string {
+	sb := bytes.Buffer{}
+	iter := tree.Scan()
+	for iter.Next() {
+		if iter.KeyPointer() == nil {
+			sb.WriteString(nullStr)
+		} else {
+			sb.WriteString(keyString(iter.KeyPointer()))
+		}
+		if iter.ValuePointer() == nil {
+			sb.WriteString(":nil ")
+		} else {
+			sb.WriteString(fmt.Sprintf(":%x ", iter.ValueBytes()))
+		}
+	}
+	return sb.String()
+}
+
+func dumpOf(tree *Tree) []byte {
+	buf := bytes.Buffer{}
+	if err := tree.Dump(&buf); err != nil {
+		panic(err)
+	}
+	return buf.Bytes()
+}
+
+func TestDumpRestore(t *testing.T) {
+	for _, c := range []struct {
+		name      string
+		opts      []Option
+		keyOf     func(k int64) unsafe.Pointer
+		keyString func(p unsafe.Pointer) string
+	}{
+		{"int64", []Option{WithKeyType(KeyInt64)}, int64KeyOf, int64String},
+		{"nullsLastDescending", []Option{int64Keys, WithNullOrder(NullsLast), WithDescending(), WithMultimap(), WithDegree(5)}, int64KeyOf, int64String},
+		{"varKeys", []Option{WithKeyType(KeyBytes), WithVarKeys()}, varKeyOf, rawString},
+		{"tuple", []Option{WithCompare(keys.ComparePointer), WithVarKeys(), WithMultimap(), WithDegree(8)}, func(k int64) unsafe.Pointer {
+			varKeyBuf = tupleKey(k%7, k, k)
+			return unsafe.Pointer(&varKeyBuf[0])
+		}, tupleString},
+	} {
+		for _, n := range []int{0, 1, 3, 4, 100, 1000} {
+			tree := New(memory.New(1<<12), nil, c.opts...)
+			for i := 0; i < n; i++ {
+				k := int64(rand.Intn(n*2)) - int64(n)
+				switch rand.Intn(10) {
+				case 0:
+					tree.InsertPointer(nil, nil, 0)
+				case 1:
+					tree.InsertPointer(c.keyOf(k), nil, 0)
+				default:
+					value := make([]byte, rand.Intn(20))
+					rand.Read(value)
+					if len(value) == 0 {
+						value = append(value, 0)[:0:1] // 长度为 0 的非 null value
+					}
+					tree.InsertPointer(c.keyOf(k), unsafe.Pointer(&value[:1][0]), uint32(len(value)))
+				}
+			}
+
+			data := dumpOf(tree)
+			restored, err := Restore(bytes.NewReader(data), memory.New(1<<12), nil, c.opts...)
+			if err != nil {
+				panic(fmt.Sprint(c.name, n, err))
+			}
+			if err := restored.Verify(); err != nil {
+				panic(fmt.Sprint(c.name, n, err))
+			}
+			if pairsOf(restored, c.keyString) != pairsOf(tree, c.keyString) {
+				panic(fmt.Sprint(c.name, n, "\n", pairsOf(restored, c.keyString), "\n", pairsOf(tree, c.keyString)))
+			}
+			// 再次导出的数据相同
+			if !bytes.Equal(dumpOf(restored), data) {
+				panic(fmt.Sprint(c.name, n))
+			}
+
+			// 恢复的树可以继续修改
+			for i := 0; i < 100; i++ {
+				k := int64(rand.Intn(1000))
+				*key2 = k
+				restored.InsertPointer(c.keyOf(k), unsafe.Pointer(key2), 8)
+				tree.InsertPointer(c.keyOf(k), unsafe.Pointer(key2), 8)
+			}
+			if err := restored.Verify(); err != nil {
+				panic(fmt.Sprint(c.name, n, err))
+			}
+			if pairsOf(restored, c.keyString) != pairsOf(tree, c.keyString) {
+				panic(fmt.Sprint(c.name, n))
+			}
+		}
+	}
+}
+
+func TestRestoreAggregate(t *testing.T) {
+	tree := New(memory.New(1024), nil, int64Keys, WithPointerAggregator(Int64StatsAggregator{}))
+	m := map[int64]*int64{}
+	for i := 0; i < 300; i++ {
+		*key = int64(rand.Intn(200)) - 100
+		*key2 = int64(rand.Intn(1000))
+		v := *key2
+		m[*key] = &v
+		tree.InsertPointer(unsafe.Pointer(key), unsafe.Pointer(key2), 8)
+	}
+	restored, err := Restore(bytes.NewReader(dumpOf(tree)), memory.New(1024), nil, int64Keys, WithPointerAggregator(Int64StatsAggregator{}))
+	if err != nil {
+		panic(err)
+	}
+	if err := restored.Verify(); err != nil {
+		panic(err)
+	}
+	for i := 0; i < 50; i++ {
+		from := int64(rand.Intn(240)) - 120
+		to := from + int64(rand.Intn(100))
+		if got, want := aggregateOf(restored, from, to), bruteStats(m, from, to); got != want {
+			panic(fmt.Sprint(from, to, got, want))
+		}
+	}
+}
+
+// Restore 的 node 填到 3/4，每层只用到最右边的 node，写入 BufferPool 时用到的页不超过 frames 加上树高
+func TestRestoreBufferPool(t *testing.T) {
+	opts := []Option{WithKeyType(KeyInt64), WithDegree(8), WithChecksums(ChecksumAlways), WithPointerAggregator(Int64StatsAggregator{})}
+	tree := New(memory.New(1<<16), nil, opts...)
+	const n = 3000
+	for i := int64(0); i < n; i++ {
+		*key, *key2 = i, i
+		tree.InsertPointer(unsafe.Pointer(key), unsafe.Pointer(key2), 8)
+	}
+	file, err := os.Create(filepath.Join(t.TempDir(), "pages"))
+	if err != nil {
+		panic(err)
+	}
+	defer file.Close()
+	dir := memory.NewBufferPool(file, 1024, 8)
+	restored, err := Restore(bytes.NewReader(dumpOf(tree)), dir, nil, opts...)
+	if err != nil {
+		panic(err)
+	}
+	stats := restored.Stats()
+	if s := dir.Stats(); s.Evictions == 0 || s.Overflows > uint64(stats.Height) {
+		panic(dir.String())
+	}
+	if err := restored.Verify(); err != nil {
+		panic(err)
+	}
+	fill := int(bulkFill(8))
+	if stats.Entries != n || stats.Leaves != (n+fill-1)/fill {
+		panic(fmt.Sprint(stats))
+	}
+	if got := aggregateOf(restored, 0, n); got.Count != n || got.Sum != n*(n-1)/2 {
+		panic(fmt.Sprint(got))
+	}
+	// 留出的空位让插入不会立刻分裂
+	*key, *key2 = n/2, 0
+	restored.InsertPointer(unsafe.Pointer(key), unsafe.Pointer(key2), 8)
+	if s := restored.Stats(); s.Nodes != stats.Nodes {
+		panic(fmt.Sprint(s, stats))
+	}
+}
+
+func TestRestoreBadDump(t *testing.T) {
+	tree := New(memory.New(1024), nil, WithKeyType(KeyInt64))
+	insertKeys(tree, 5, 3, 1, 4)
+	data := dumpOf(tree)
+
+	restore := func(data []byte) error {
+		_, err := Restore(bytes.NewReader(data), memory.New(1024), nil)
+		return err
+	}
+	if err := restore(data); err != nil {
+		panic(err)
+	}
+
+	// 任意一个字节损坏或者截断都能发现
+	for i := range data {
+		corrupt := append([]byte{}, data...)
+		corrupt[i] ^= 0x10
+		if err := restore(corrupt); !errors.Is(err, ErrBadDump) && !errors.Is(err, ErrComparatorMismatch) {
+			panic(fmt.Sprint(i, err))
+		}
+		if err := restore(data[:i]); !errors.Is(err, ErrBadDump) {
+			panic(fmt.Sprint(i, err))
+		}
+	}
+
+	// 比较函数与数据流中的顺序不一致
+	desc := WithCompare(func(k1, k2 unsafe.Pointer) int { return -compareInt64(k1, k2) })
+	if _, err := Restore(bytes.NewReader(dumpOf(New(memory.New(1024), nil, int64Keys))), memory.New(1024), nil, desc); err != nil {
+		panic(err) // 空树没有顺序问题
+	}
+	custom := New(memory.New(1024), nil, int64Keys)
+	insertKeys(custom, 1, 2)
+	if _, err := Restore(bytes.NewReader(dumpOf(custom)), memory.New(1024), nil, desc); !errors.Is(err, ErrBadDump) {
+		panic(err)
+	}
+}
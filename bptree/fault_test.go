@@ -0,0 +1,157 @@
+package bptree
+
+import (
+	"errors"
+	"fmt"
+	"github.com/madokast/bptree/memory"
+	"math/rand"
+	"strings"
+	"testing"
+	"unsafe"
+)
+
+// varKeyBuf 变长 key 的记录，放在堆上
+var varKeyBuf []byte
+
+func int64KeyOf(k int64) unsafe.Pointer {
+	*key = k
+	return unsafe.Pointer(key)
+}
+
+func varKeyOf(k int64) unsafe.Pointer {
+	varKeyBuf = rawKey(fmt.Sprintf("https://example.com/item/%06d", k))
+	return unsafe.Pointer(&varKeyBuf[0])
+}
+
+func TestTryInsertOutOfSpace(t *testing.T) {
+	for _, c := range []struct {
+		name  string
+		opts  []Option
+		keyOf func(k int64) unsafe.Pointer
+	}{
+		{"default", []Option{WithKeyType(KeyInt64)}, int64KeyOf},
+		{"aggregate", []Option{WithKeyType(KeyInt64), WithPointerAggregator(Int64StatsAggregator{}), WithDegree(4)}, int64KeyOf},
+		{"multimap", []Option{WithKeyType(KeyInt64), WithMultimap()}, int64KeyOf},
+		{"varkeys", []Option{WithKeyType(KeyBytes), WithVarKeys()}, varKeyOf},
+	} {
+		for failAfter := 0; failAfter < 80; failAfter++ {
+			r := rand.New(rand.NewSource(int64(failAfter)))
+			faulty := memory.NewFaulty(memory.New(1 << 12))
+			tree := New(faulty, nil, c.opts...)
+			faulty.FailAfter(failAfter)
+
+			inserted := map[int64]bool{}
+			var err error
+			for err == nil {
+				k := int64(r.Intn(1000))
+				*key2 = k
+				if err = tree.TryInsertPointer(c.keyOf(k), unsafe.Pointer(key2), 8); err == nil {
+					inserted[k] = true
+				}
+			}
+			if !errors.Is(err, memory.ErrOutOfSpace) {
+				panic(err)
+			}
+			check := func() {
+				if err := tree.Verify(); err != nil {
+					panic(fmt.Sprint(c.name, failAfter, err))
+				}
+				for k := range inserted {
+					if exist, value := tree.FindPointer(c.keyOf(k)); !exist || *(*int64)(value) != k {
+						panic(fmt.Sprint(c.name, failAfter, k))
+					}
+				}
+			}
+			check()
+
+			// 恢复后可以继续插入
+			faulty.Heal()
+			for i := 0; i < 100; i++ {
+				k := int64(r.Intn(1000))
+				*key2 = k
+				tree.InsertPointer(c.keyOf(k), unsafe.Pointer(key2), 8)
+				inserted[k] = true
+			}
+			check()
+		}
+	}
+}
+
+// nodeLocations 树中所有 node 的地址
+func nodeLocations(tree *Tree) []memory.Location {
+	locs := make([]memory.Location, 0)
+	nodes := []*node{tree.root}
+	for len(nodes) > 0 {
+		n := nodes[0]
+		nodes = nodes[1:]
+		locs = append(locs, n.selfPoint.get())
+		if !n.isLeaf() {
+			for i := uint32(0); i < n.itemNumber.get(); i++ {
+				nodes = append(nodes, tree.readNode(n.item(i).valueLoc))
+			}
+		}
+	}
+	return locs
+}
+
+func TestVerifyRandomCorruption(t *testing.T) {
+	faulty := memory.NewFaulty(memory.New(1 << 12))
+	tree := New(faulty, nil, WithKeyType(KeyBytes), WithVarKeys(), WithPointerAggregator(Int64StatsAggregator{}), WithDegree(5))
+	for i := int64(0); i < 300; i++ {
+		*key2 = i
+		tree.InsertPointer(varKeyOf(rand.Int63n(10000)), unsafe.Pointer(key2), 8)
+	}
+	locs := nodeLocations(tree)
+
+	detected := 0
+	for i := 0; i < 2000; i++ {
+		loc := locs[rand.Intn(len(locs))]
+		offset := uint32(rand.Intn(int(tree.nodeSize())))
+		garbage := make([]byte, 1+rand.Intn(8))
+		rand.Read(garbage)
+		if int(offset)+len(garbage) > int(tree.nodeSize()) {
+			garbage = garbage[:tree.nodeSize()-offset]
+		}
+		original := append([]byte{}, faulty.Bytes(loc, tree.nodeSize())[offset:int(offset)+len(garbage)]...)
+
+		faulty.Corrupt(loc, offset, garbage)
+		if err := tree.Verify(); err != nil {
+			if !errors.Is(err, ErrCorrupt) {
+				panic(err)
+			}
+			detected++
+		}
+		faulty.Corrupt(loc, offset, original)
+	}
+	t.Log("detected", detected)
+	if err := tree.Verify(); err != nil {
+		panic(err)
+	}
+	if detected == 0 {
+		panic(detected)
+	}
+
+	// 子节点地址指向分配之外，检查地址而不是读到垃圾
+	root := tree.root
+	child := root.item(0).valueLoc
+	root.item(0).valueLoc = memory.Location{BlockId: 1000, BlockOffset: 12}
+	if err := tree.Verify(); !errors.Is(err, ErrCorrupt) || !strings.Contains(err.Error(), "bad child location") {
+		panic(err)
+	}
+	root.item(0).valueLoc = child
+
+	// 变长 key 的地址越界
+	leaf := tree.firstLeaf()
+	k := leaf.item(0).key
+	*(*memory.Location)(unsafe.Pointer(&leaf.item(0).key)) = memory.Location{BlockId: 0, BlockOffset: 1 << 20}
+	if err := tree.Verify(); !errors.Is(err, ErrCorrupt) || !strings.Contains(err.Error(), "bad key location") {
+		panic(err)
+	}
+	leaf.item(0).key = k
+
+	// item 数目超过度
+	leaf.itemNumber.set(1 << 20)
+	if err := tree.Verify(); !errors.Is(err, ErrCorrupt) || !strings.Contains(err.Error(), "degree") {
+		panic(err)
+	}
+}
@@ -0,0 +1,104 @@
+package bptree
+
+import (
+	"github.com/madokast/bptree/memory"
+	"unsafe"
+)
+
+// Iterator 沿叶子节点兄弟指针顺序遍历键值对
+// 用法：for it.Next() { it.Key(); it.Value() }。遍历期间不能修改树
+// dir 实现了 memory.Scoped 时（例如 memory.Tiered），Key、Value 等返回的指针只保证在下一次调用之前有效
+type Iterator struct {
+	t       *Tree
+	leaf    *node               // 当前叶子，nil 表示遍历结束
+	leafLoc memory.Location     // 当前叶子的地址，见 current
+	index   uint32              // 当前 item 在 leaf 中的位置
+	started bool                // 是否已经调用过 Next
+	stop    func(it *item) bool // 返回 true 表示遍历到 it 时结束，nil 表示遍历到最后
+}
+
+func (t *Tree) newIterator(leaf *node, index uint32, stop func(it *item) bool) *Iterator {
+	return &Iterator{t: t, leaf: leaf, leafLoc: leaf.selfPoint.get(), index: index, stop: stop}
+}
+
+// current 当前 item。调用者在 enter、exit 之间，dir 可能移动内存时由 leafLoc 重新得到叶子
+func (it *Iterator) current() *item {
+	if it.t.scoped {
+		it.leaf = it.t.nodeAt(it.leafLoc)
+	}
+	return it.leaf.item(it.index)
+}
+
+// Next 移动到下一个键值对，没有了返回 false
+func (it *Iterator) Next() bool {
+	if it.leaf == nil {
+		return false
+	}
+	it.t.enter()
+	defer it.t.exit()
+	if it.t.scoped {
+		it.leaf = it.t.nodeAt(it.leafLoc)
+	}
+	if it.started {
+		it.index++
+	} else {
+		it.started = true
+	}
+
+	// 跳过已经遍历完的叶子，删除后叶子可能为空
+	for it.index >= it.leaf.itemNumber.get() {
+		if !it.leaf.hasNext() {
+			it.leaf = nil
+			return false
+		}
+		prev := it.leaf
+		it.leaf = it.t.readNode(it.leaf.nextPoint.get())
+		it.leafLoc = it.leaf.selfPoint.get()
+		it.t.releaseNode(prev)
+		it.index = 0
+	}
+
+	if it.stop != nil && it.stop(it.leaf.item(it.index)) {
+		it.leaf = nil
+		return false
+	}
+	return true
+}
+
+// Key 当前 key 的指针，0 表示 null
+func (it *Iterator) Key() uintptr {
+	return uintptr(it.KeyPointer())
+}
+
+// KeyPointer 当前 key 的指针，nil 表示 null
+func (it *Iterator) KeyPointer() unsafe.Pointer {
+	it.t.enter()
+	defer it.t.exit()
+	return it.t.keyPointer(it.current())
+}
+
+// Value 当前 value 的指针，0 表示 null
+func (it *Iterator) Value() uintptr {
+	return uintptr(it.ValuePointer())
+}
+
+// ValuePointer 当前 value 的指针，nil 表示 null
+func (it *Iterator) ValuePointer() unsafe.Pointer {
+	it.t.enter()
+	defer it.t.exit()
+	return it.t.valuePointer(it.current().valueLoc)
+}
+
+// ValueBytes 当前 value，直接指向 dir 中的内存，不能修改。null value 返回 nil
+func (it *Iterator) ValueBytes() []byte {
+	it.t.enter()
+	defer it.t.exit()
+	return it.t.valueBytes(it.current().valueLoc)
+}
+
+// ValueLength 当前 value 的长度，null value 为 0
+func (it *Iterator) ValueLength() uint32 {
+	it.t.enter()
+	defer it.t.exit()
+	return it.t.valueLength(it.current().valueLoc)
+}
@@ -0,0 +1,172 @@
+package bptree
+
+import (
+	"fmt"
+	"github.com/madokast/bptree/memory"
+	"math/rand"
+	"sort"
+	"testing"
+	"unsafe"
+)
+
+func findAllInt64(tree *Tree, k int64) []int64 {
+	*key = k
+	values := make([]int64, 0)
+	iter := tree.FindAllPointer(unsafe.Pointer(key))
+	for iter.Next() {
+		if iter.ValueLength() != 8 {
+			panic(iter.ValueLength())
+		}
+		values = append(values, *(*int64)(iter.ValuePointer()))
+	}
+	return values
+}
+
+func TestFindAllEmpty(t *testing.T) {
+	tree := New(memory.New(1024), nil, int64Keys, WithMultimap())
+	if len(findAllInt64(tree, 1)) != 0 {
+		panic("not empty")
+	}
+	*key = 1
+	if exist, _ := tree.FindPointer(unsafe.Pointer(key)); exist {
+		panic(exist)
+	}
+}
+
+func TestMultimapDuplicateRun(t *testing.T) {
+	// 相同 key 的值跨越多个叶子
+	directory := memory.New(1024)
+	tree := New(directory, nil, int64Keys, WithMultimap())
+	for i := 0; i < 20; i++ {
+		*key = int64(i % 3)
+		*key2 = int64(i)
+		tree.InsertPointer(unsafe.Pointer(key), unsafe.Pointer(key2), 8)
+	}
+
+	for k := int64(0); k < 3; k++ {
+		values := findAllInt64(tree, k)
+		if len(values) != 7 && !(k == 2 && len(values) == 6) {
+			panic(fmt.Sprint(k, values))
+		}
+		for i, v := range values {
+			if v != k+int64(i)*3 {
+				panic(fmt.Sprint(k, values))
+			}
+		}
+	}
+
+	*key = 1
+	*key2 = 10
+	if !tree.DeleteOnePointer(unsafe.Pointer(key), unsafe.Pointer(key2), 8) {
+		panic("delete fail")
+	}
+	if tree.DeleteOnePointer(unsafe.Pointer(key), unsafe.Pointer(key2), 8) {
+		panic("delete twice")
+	}
+	if fmt.Sprint(findAllInt64(tree, 1)) != "[1 4 7 13 16 19]" {
+		panic(fmt.Sprint(findAllInt64(tree, 1)))
+	}
+}
+
+func TestMultimapNull(t *testing.T) {
+	directory := memory.New(1024)
+	tree := New(directory, nil, int64Keys, WithMultimap())
+	for i := 0; i < 5; i++ {
+		tree.InsertPointer(nil, nil, 0)
+	}
+	*key = 1
+	tree.InsertPointer(unsafe.Pointer(key), nil, 0)
+	iter := tree.FindAllPointer(nil)
+	count := 0
+	for iter.Next() {
+		if iter.KeyPointer() != nil || iter.ValuePointer() != nil {
+			panic("not null")
+		}
+		count++
+	}
+	if count != 5 {
+		panic(count)
+	}
+	for i := 0; i < 5; i++ {
+		if !tree.DeleteOnePointer(nil, nil, 0) {
+			panic(i)
+		}
+	}
+	if exist, _ := tree.FindPointer(nil); exist {
+		panic(exist)
+	}
+}
+
+func TestMultimapRandom(t *testing.T) {
+	for temp := 0; temp < 100; temp++ {
+		directory := memory.New(1024)
+		tree := New(directory, nil, int64Keys, WithMultimap(), WithPointerAggregator(Int64StatsAggregator{}))
+		m := map[int64][]int64{}
+		for i := 0; i < 500; i++ {
+			k := int64(rand.Int31n(20)) - 10
+			*key = k
+			if rand.Intn(3) == 0 && len(m[k]) > 0 {
+				// 删除随机一个
+				j := rand.Intn(len(m[k]))
+				*key2 = m[k][j]
+				if !tree.DeleteOnePointer(unsafe.Pointer(key), unsafe.Pointer(key2), 8) {
+					panic("delete fail")
+				}
+				m[k] = append(m[k][:j], m[k][j+1:]...)
+			} else {
+				*key2 = int64(i)
+				tree.InsertPointer(unsafe.Pointer(key), unsafe.Pointer(key2), 8)
+				m[k] = append(m[k], int64(i))
+			}
+		}
+
+		all := make([]int64, 0)
+		for k, values := range m {
+			if fmt.Sprint(findAllInt64(tree, k)) != fmt.Sprint(values) {
+				panic(fmt.Sprint(k, findAllInt64(tree, k), values))
+			}
+			for range values {
+				all = append(all, k)
+			}
+		}
+		sort.Slice(all, func(i, j int) bool { return all[i] < all[j] })
+		if fmt.Sprint(allKeys(tree)) != fmt.Sprint(all) {
+			panic(fmt.Sprint(allKeys(tree), all))
+		}
+		s := aggregateOf(tree, -100, 100)
+		if s.Count != int64(len(all)) {
+			panic(fmt.Sprint(s, len(all)))
+		}
+	}
+}
+
+func TestDeleteOneUnique(t *testing.T) {
+	directory := memory.New(1024)
+	tree := New(directory, nil, int64Keys)
+	for i := 0; i < 10; i++ {
+		*key = int64(i)
+		tree.InsertPointer(unsafe.Pointer(key), unsafe.Pointer(key), 8)
+	}
+	for i := 0; i < 10; i += 2 {
+		*key = int64(i)
+		*key2 = int64(i + 1)
+		// value 不同，不删除
+		if tree.DeleteOnePointer(unsafe.Pointer(key), unsafe.Pointer(key2), 8) {
+			panic(i)
+		}
+		if !tree.DeleteOnePointer(unsafe.Pointer(key), unsafe.Pointer(key), 8) {
+			panic(i)
+		}
+	}
+	if fmt.Sprint(allKeys(tree)) != "[1 3 5 7 9]" {
+		panic(fmt.Sprint(allKeys(tree)))
+	}
+	// 删除后再插入
+	for i := 0; i < 10; i++ {
+		*key = int64(i)
+		tree.InsertPointer(unsafe.Pointer(key), nil, 0)
+	}
+	if fmt.Sprint(allKeys(tree)) != "[0 1 2 3 4 5 6 7 8 9]" {
+		panic(fmt.Sprint(allKeys(tree)))
+	}
+}
@@ -0,0 +1,119 @@
+package bptree
+
+import (
+	"bytes"
+	"encoding/binary"
+	"github.com/madokast/bptree/memory"
+	"unsafe"
+)
+
+/**
+key 的保存
+定长 key 直接保存在 item.key 的 8 bytes 中。
+变长 key（WithVarKeys）的指针指向一条记录 [长度 uint32 小端][数据]，记录复制到 dir 中，item.key 保存记录的 memory.Location。
+中间节点的 item 和叶子节点共用同一份记录，记录写入后不再修改，分裂时不需要新的记录。
+item 的大小是固定的，变长 key 只以地址保存在其中，所以缩短中间节点的 key（后缀截断）或者提取叶子内的公共前缀都不能增加扇出、降低层数，
+反而要为缩短的 key 另外分配记录，因此都没有实现
+*/
+
+// varKeyHeaderSz 变长 key 记录的头部长度
+const varKeyHeaderSz = uint32(4)
+
+// pendingKey 插入中的 key。变长 key 第一次用到时才写入 dir，之后复用同一份，更新已有 key 时不写入
+type pendingKey struct {
+	key  unsafe.Pointer
+	done bool
+	null byte
+	slot [keySize]byte
+}
+
+// newItem 由插入中的 key 构造 item
+func (t *Tree) newItem(pk *pendingKey, valLoc memory.Location) item {
+	i := item{
+		valueLoc: valLoc,
+	}
+	t.setItemKey(&i, pk)
+	return i
+}
+
+// setItemKey 把 i 的 key 设置为 pk
+func (t *Tree) setItemKey(i *item, pk *pendingKey) {
+	if !pk.done {
+		if pk.key == nil {
+			pk.null = nullKeyFlag
+		} else {
+			pk.null = notNullKeyFlag
+			// pk 可能在栈上，不能转为 uintptr 后再写入
+			if t.opts.varKeys {
+				*(*memory.Location)(unsafe.Pointer(&pk.slot)) = t.newVarKey(pk.key)
+			} else {
+				pk.slot = *(*[keySize]byte)(pk.key)
+			}
+		}
+		pk.done = true
+	}
+	i.null = pk.null
+	i.key = pk.slot
+}
+
+// newVarKey 把变长 key 记录复制到 dir 中
+func (t *Tree) newVarKey(key unsafe.Pointer) memory.Location {
+	size := varKeyHeaderSz + varKeyLength(key)
+	diskPtr, pointer := t.allocate(size, 1, memory.TagKey)
+	memCopy(key, pointer, size)
+	return diskPtr
+}
+
+// newVarKeyBytes 把 data 作为变长 key 记录写入 dir
+func (t *Tree) newVarKeyBytes(data []byte) memory.Location {
+	diskPtr, _ := t.allocate(varKeyHeaderSz+uint32(len(data)), 1, memory.TagKey)
+	record := memory.Bytes(t.dir, diskPtr, varKeyHeaderSz+uint32(len(data)))
+	binary.LittleEndian.PutUint32(record, uint32(len(data)))
+	copy(record[varKeyHeaderSz:], data)
+	return diskPtr
+}
+
+// slotPointer 由 item.key 得到 key 指针，交给用户的 compareFunc 等使用
+func (t *Tree) slotPointer(slot *[keySize]byte) unsafe.Pointer {
+	if t.opts.varKeys {
+		return memory.Pointer(t.dir, *(*memory.Location)(unsafe.Pointer(slot)))
+	}
+	return unsafe.Pointer(slot)
+}
+
+// keyPointer item 的 key 指针，null 返回 nil
+func (t *Tree) keyPointer(i *item) unsafe.Pointer {
+	if i.isNullKey() {
+		return nil
+	}
+	return t.slotPointer(&i.key)
+}
+
+// ScanPrefix 遍历所有以 prefix 开头的变长 key，prefix 同样是 [长度 uint32 小端][数据] 记录
+// 要求 compareFunc 按字节序比较（例如 keys.Compare）且没有 WithDescending，这样相同前缀的 key 是连续的
+func (t *Tree) ScanPrefix(prefix uintptr) *Iterator {
+	return t.ScanPrefixPointer(memory.UintptrPointer(prefix))
+}
+
+// ScanPrefixPointer 与 ScanPrefix 相同，prefix 以 unsafe.Pointer 传递
+func (t *Tree) ScanPrefixPointer(prefix unsafe.Pointer) *Iterator {
+	t.enter()
+	defer t.exit()
+	if !t.opts.varKeys || t.opts.descending {
+		panic("prefix scan needs ascending var keys")
+	}
+	p := varKeyBytes(prefix)
+	return t.seek(prefix, func(it *item) bool {
+		return it.isNullKey() || !bytes.HasPrefix(varKeyBytes(t.keyPointer(it)), p)
+	})
+}
+
+// varKeyLength 变长 key 记录的数据长度
+func varKeyLength(key unsafe.Pointer) uint32 {
+	return binary.LittleEndian.Uint32((*[varKeyHeaderSz]byte)(key)[:])
+}
+
+// varKeyBytes 变长 key 记录的数据部分，不复制。先取整条记录再切片，数据为空时也不会得到记录之外的指针
+func varKeyBytes(key unsafe.Pointer) []byte {
+	return unsafe.Slice((*byte)(key), varKeyHeaderSz+varKeyLength(key))[varKeyHeaderSz:]
+}
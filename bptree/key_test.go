@@ -0,0 +1,127 @@
+package bptree
+
+import (
+	"fmt"
+	"github.com/madokast/bptree/bptree/keys"
+	"github.com/madokast/bptree/memory"
+	"math/rand"
+	"sort"
+	"testing"
+	"unsafe"
+)
+
+func tupleKey(tenant, createdAt, id int64) keys.Key {
+	return keys.New().Int64(tenant, keys.Asc).Int64(createdAt, keys.Desc).Int64(id, keys.Asc).Key()
+}
+
+func tupleString(p unsafe.Pointer) string {
+	values, err := keys.Decode(unsafe.Slice((*byte)(p), 4+varKeyLength(p)))
+	if err != nil {
+		panic(err)
+	}
+	return fmt.Sprint(values)
+}
+
+func TestVarKeys(t *testing.T) {
+	directory := memory.New(1024)
+	tree := New(directory, nil, WithCompare(keys.ComparePointer), WithVarKeys())
+	for i := int64(0); i < 10; i++ {
+		k := tupleKey(i%3, i, i)
+		*key = i
+		tree.InsertPointer(k.UnsafePointer(), unsafe.Pointer(key), 8)
+	}
+	keyStrings := fmt.Sprint(scanKeys(tree, func(p unsafe.Pointer) interface{} { return tupleString(p) }))
+	if keyStrings != "[[0 9 9] [0 6 6] [0 3 3] [0 0 0] [1 7 7] [1 4 4] [1 1 1] [2 8 8] [2 5 5] [2 2 2]]" {
+		panic(keyStrings)
+	}
+
+	for i := int64(0); i < 10; i++ {
+		exist, value := tree.FindPointer(tupleKey(i%3, i, i).UnsafePointer())
+		if !exist || *(*int64)(value) != i {
+			panic(i)
+		}
+	}
+	if exist, _ := tree.FindPointer(tupleKey(0, 1, 1).UnsafePointer()); exist {
+		panic(exist)
+	}
+
+	// 更新已有的 key
+	k := tupleKey(2, 8, 8)
+	*key = 100
+	tree.InsertPointer(k.UnsafePointer(), unsafe.Pointer(key), 8)
+	if exist, value := tree.FindPointer(k.UnsafePointer()); !exist || *(*int64)(value) != 100 {
+		panic(exist)
+	}
+}
+
+func TestScanPrefix(t *testing.T) {
+	for temp := 0; temp < 20; temp++ {
+		directory := memory.New(1024)
+		tree := New(directory, nil, WithCompare(keys.ComparePointer), WithVarKeys())
+		tree.InsertPointer(nil, nil, 0)
+		m := map[int64][]int64{} // tenant -> ids
+		for i := int64(0); i < 300; i++ {
+			tenant := int64(rand.Intn(10))
+			m[tenant] = append(m[tenant], i)
+			*key = i
+			tree.InsertPointer(tupleKey(tenant, -i, i).UnsafePointer(), unsafe.Pointer(key), 8)
+		}
+
+		for tenant := int64(-1); tenant <= 10; tenant++ {
+			ids := make([]int64, 0)
+			iter := tree.ScanPrefixPointer(keys.New().Int64(tenant, keys.Asc).Key().UnsafePointer())
+			for iter.Next() {
+				ids = append(ids, *(*int64)(iter.ValuePointer()))
+			}
+			want := append([]int64{}, m[tenant]...)
+			sort.Slice(want, func(i, j int) bool { return want[i] < want[j] })
+			if fmt.Sprint(ids) != fmt.Sprint(want) {
+				panic(fmt.Sprint(tenant, ids, want))
+			}
+		}
+
+		// 空前缀匹配所有非 null key
+		count := 0
+		iter := tree.ScanPrefixPointer(keys.New().Key().UnsafePointer())
+		for iter.Next() {
+			count++
+		}
+		if count != 300 {
+			panic(count)
+		}
+	}
+}
+
+func TestVarKeysNullsLastMultimap(t *testing.T) {
+	directory := memory.New(1024)
+	tree := New(directory, nil, WithCompare(keys.ComparePointer), WithVarKeys(), WithMultimap(), WithNullOrder(NullsLast))
+	for i := int64(0); i < 20; i++ {
+		*key = i
+		if i%5 == 0 {
+			tree.InsertPointer(nil, unsafe.Pointer(key), 8)
+		} else {
+			tree.InsertPointer(keys.New().String("k", keys.Asc).Int64(i%2, keys.Asc).Key().UnsafePointer(), unsafe.Pointer(key), 8)
+		}
+	}
+	ids := make([]int64, 0)
+	iter := tree.ScanPrefixPointer(keys.New().String("k", keys.Asc).Key().UnsafePointer())
+	for iter.Next() {
+		ids = append(ids, *(*int64)(iter.ValuePointer()))
+	}
+	if fmt.Sprint(ids) != "[2 4 6 8 12 14 16 18 1 3 7 9 11 13 17 19]" {
+		panic(fmt.Sprint(ids))
+	}
+
+	reopen, err := Open(directory, tree.MetaLocation(), nil, WithCompare(keys.ComparePointer), WithVarKeys(), WithMultimap(), WithNullOrder(NullsLast))
+	if err != nil {
+		panic(err)
+	}
+	nulls := make([]int64, 0)
+	iter = reopen.FindAllPointer(nil)
+	for iter.Next() {
+		nulls = append(nulls, *(*int64)(iter.ValuePointer()))
+	}
+	if fmt.Sprint(nulls) != "[0 5 10 15]" {
+		panic(fmt.Sprint(nulls))
+	}
+}
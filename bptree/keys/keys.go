@@ -0,0 +1,293 @@
+package keys
+
+import (
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"github.com/madokast/bptree/memory"
+	"math"
+	"unsafe"
+)
+
+/**
+保序的多列 key 编码
+编码后的字节按字典序比较，结果与按列依次比较相同，因此可以直接用于 bptree.WithVarKeys 的变长 key，
+并且前几列相同的 key 是连续的，可以用 Tree.ScanPrefix 做前缀查询。
+
+每一列由 1 byte 类型标记加数据组成：
+1. null 只有标记
+2. bool 1 byte
+3. int64 8 bytes 大端，符号位取反
+4. uint64 8 bytes 大端
+5. float64 8 bytes 大端，正数符号位取反，负数全部取反。-0 视为 0，所有 NaN 视为同一个值，排在 +Inf 之后
+6. string、bytes 中的 0x00 转义为 0x00 0xFF，以 0x00 0x01 结尾，所以每列的编码都不是另一列编码的前缀
+Desc 列把整列编码（包括类型标记）按位取反，顺序随之反转
+*/
+
+// Order 列的排序方向
+type Order byte
+
+const (
+	Asc Order = iota
+	Desc
+)
+
+// 类型标记。升序时小于 0x80，降序取反后大于 0x80
+const (
+	tagNull   = byte(0x05)
+	tagFalse  = byte(0x10)
+	tagTrue   = byte(0x11)
+	tagInt64  = byte(0x20)
+	tagUint64 = byte(0x21)
+	tagFloat  = byte(0x30)
+	tagBytes  = byte(0x40)
+	tagString = byte(0x41)
+
+	escape     = byte(0x00)
+	escaped00  = byte(0xFF)
+	terminator = byte(0x01)
+
+	// headerSz Key 头部长度
+	headerSz = 4
+)
+
+var ErrCorrupt = errors.New("keys: corrupt key")
+
+// Key 编码后的 key 记录：[长度 uint32 小端][编码数据]，可以直接作为变长 key 传给 bptree
+type Key []byte
+
+// Encoder 按列追加编码
+type Encoder struct {
+	buf []byte
+}
+
+// New 新建一个空的 Encoder
+func New() *Encoder {
+	return &Encoder{buf: make([]byte, headerSz, 32)}
+}
+
+// Null 追加 null 列
+func (e *Encoder) Null(order Order) *Encoder {
+	return e.column(order, tagNull, nil)
+}
+
+// Bool 追加 bool 列，false < true
+func (e *Encoder) Bool(v bool, order Order) *Encoder {
+	if v {
+		return e.column(order, tagTrue, nil)
+	}
+	return e.column(order, tagFalse, nil)
+}
+
+// Int64 追加 int64 列
+func (e *Encoder) Int64(v int64, order Order) *Encoder {
+	var b [8]byte
+	binary.BigEndian.PutUint64(b[:], uint64(v)^(1<<63))
+	return e.column(order, tagInt64, b[:])
+}
+
+// Uint64 追加 uint64 列
+func (e *Encoder) Uint64(v uint64, order Order) *Encoder {
+	var b [8]byte
+	binary.BigEndian.PutUint64(b[:], v)
+	return e.column(order, tagUint64, b[:])
+}
+
+// Float64 追加 float64 列
+func (e *Encoder) Float64(v float64, order Order) *Encoder {
+	var b [8]byte
+	binary.BigEndian.PutUint64(b[:], FloatBits(v))
+	return e.column(order, tagFloat, b[:])
+}
+
+// String 追加 string 列
+func (e *Encoder) String(v string, order Order) *Encoder {
+	return e.column(order, tagString, escapeBytes([]byte(v)))
+}
+
+// Bytes 追加 bytes 列
+func (e *Encoder) Bytes(v []byte, order Order) *Encoder {
+	return e.column(order, tagBytes, escapeBytes(v))
+}
+
+// Key 返回编码结果。返回的是副本，之后 Encoder 还可以继续追加
+func (e *Encoder) Key() Key {
+	binary.LittleEndian.PutUint32(e.buf, uint32(len(e.buf)-headerSz))
+	k := make(Key, len(e.buf))
+	copy(k, e.buf)
+	return k
+}
+
+func (e *Encoder) column(order Order, tag byte, data []byte) *Encoder {
+	start := len(e.buf)
+	e.buf = append(e.buf, tag)
+	e.buf = append(e.buf, data...)
+	if order == Desc {
+		for i := start; i < len(e.buf); i++ {
+			e.buf[i] = ^e.buf[i]
+		}
+	}
+	return e
+}
+
+// Pointer 传给 bptree 的 key 指针。调用者需要保证使用期间 k 不被回收
+func (k Key) Pointer() uintptr {
+	return uintptr(k.UnsafePointer())
+}
+
+// UnsafePointer 传给 bptree 的 unsafe.Pointer 版本接口的 key 指针，GC 可见
+func (k Key) UnsafePointer() unsafe.Pointer {
+	return unsafe.Pointer(&k[0])
+}
+
+// Data 编码数据，不含头部
+func (k Key) Data() []byte {
+	return k[headerSz:]
+}
+
+// Compare 比较两个 Key 记录的指针，可以作为 bptree 的 compareFunc
+func Compare(k1, k2 uintptr) int {
+	return ComparePointer(memory.UintptrPointer(k1), memory.UintptrPointer(k2))
+}
+
+// ComparePointer 与 Compare 相同，可以作为 bptree.WithCompare 的比较函数
+func ComparePointer(k1, k2 unsafe.Pointer) int {
+	return bytes.Compare(data(k1), data(k2))
+}
+
+// FloatBits float64 的保序编码，按无符号整数比较即为 float64 的全序
+func FloatBits(v float64) uint64 {
+	if v != v {
+		return math.MaxUint64 // NaN
+	}
+	if v == 0 {
+		v = 0 // -0
+	}
+	bits := math.Float64bits(v)
+	if bits&(1<<63) != 0 {
+		return ^bits
+	}
+	return bits | (1 << 63)
+}
+
+// Decode 解码 Key，返回各列的值，类型为 nil、bool、int64、uint64、float64、string、[]byte
+func Decode(k Key) ([]interface{}, error) {
+	if len(k) < headerSz || int(binary.LittleEndian.Uint32(k)) != len(k)-headerSz {
+		return nil, ErrCorrupt
+	}
+	r := reader{data: k.Data()}
+	values := make([]interface{}, 0)
+	for len(r.data) > 0 {
+		v, err := r.column()
+		if err != nil {
+			return nil, err
+		}
+		values = append(values, v)
+	}
+	return values, nil
+}
+
+// reader 逐列解码。mask 为 0xFF 表示当前列是 Desc
+type reader struct {
+	data []byte
+	mask byte
+}
+
+func (r *reader) column() (interface{}, error) {
+	r.mask = 0
+	if r.data[0] >= 0x80 {
+		r.mask = 0xFF
+	}
+	tag := r.byte()
+	switch tag {
+	case tagNull:
+		return nil, nil
+	case tagFalse:
+		return false, nil
+	case tagTrue:
+		return true, nil
+	case tagInt64, tagUint64, tagFloat:
+		if len(r.data) < 8 {
+			return nil, ErrCorrupt
+		}
+		var b [8]byte
+		for i := range b {
+			b[i] = r.byte()
+		}
+		bits := binary.BigEndian.Uint64(b[:])
+		switch tag {
+		case tagInt64:
+			return int64(bits ^ (1 << 63)), nil
+		case tagUint64:
+			return bits, nil
+		default:
+			return floatFromBits(bits), nil
+		}
+	case tagBytes, tagString:
+		b, err := r.escaped()
+		if err != nil {
+			return nil, err
+		}
+		if tag == tagString {
+			return string(b), nil
+		}
+		return b, nil
+	default:
+		return nil, ErrCorrupt
+	}
+}
+
+func (r *reader) byte() byte {
+	b := r.data[0] ^ r.mask
+	r.data = r.data[1:]
+	return b
+}
+
+func (r *reader) escaped() ([]byte, error) {
+	b := make([]byte, 0)
+	for {
+		if len(r.data) < 2 {
+			return nil, ErrCorrupt
+		}
+		c := r.byte()
+		if c != escape {
+			b = append(b, c)
+			continue
+		}
+		switch r.byte() {
+		case escaped00:
+			b = append(b, 0)
+		case terminator:
+			return b, nil
+		default:
+			return nil, ErrCorrupt
+		}
+	}
+}
+
+func escapeBytes(v []byte) []byte {
+	b := make([]byte, 0, len(v)+2)
+	for _, c := range v {
+		if c == escape {
+			b = append(b, escape, escaped00)
+		} else {
+			b = append(b, c)
+		}
+	}
+	return append(b, escape, terminator)
+}
+
+func floatFromBits(bits uint64) float64 {
+	if bits == math.MaxUint64 {
+		return math.NaN()
+	}
+	if bits&(1<<63) != 0 {
+		return math.Float64frombits(bits &^ (1 << 63))
+	}
+	return math.Float64frombits(^bits)
+}
+
+func data(k unsafe.Pointer) []byte {
+	length := binary.LittleEndian.Uint32((*[headerSz]byte)(k)[:])
+	return unsafe.Slice((*byte)(k), headerSz+length)[headerSz:]
+}
@@ -0,0 +1,146 @@
+package keys
+
+import (
+	"bytes"
+	"fmt"
+	"math"
+	"math/rand"
+	"reflect"
+	"sort"
+	"testing"
+)
+
+func TestInt64Order(t *testing.T) {
+	values := []int64{math.MinInt64, -100, -1, 0, 1, 100, math.MaxInt64}
+	for i := 1; i < len(values); i++ {
+		a := New().Int64(values[i-1], Asc).Key()
+		b := New().Int64(values[i], Asc).Key()
+		if bytes.Compare(a.Data(), b.Data()) >= 0 {
+			panic(fmt.Sprint(values[i-1], values[i]))
+		}
+		a = New().Int64(values[i-1], Desc).Key()
+		b = New().Int64(values[i], Desc).Key()
+		if bytes.Compare(a.Data(), b.Data()) <= 0 {
+			panic(fmt.Sprint(values[i-1], values[i]))
+		}
+	}
+}
+
+func TestFloat64Order(t *testing.T) {
+	values := []float64{math.Inf(-1), -math.MaxFloat64, -1.5, -math.SmallestNonzeroFloat64, 0,
+		math.SmallestNonzeroFloat64, 1, 2.5, math.MaxFloat64, math.Inf(1), math.NaN()}
+	for i := 1; i < len(values); i++ {
+		if FloatBits(values[i-1]) >= FloatBits(values[i]) {
+			panic(fmt.Sprint(values[i-1], values[i]))
+		}
+	}
+	if FloatBits(math.Copysign(0, -1)) != FloatBits(0) {
+		panic("-0")
+	}
+	if FloatBits(-math.NaN()) != FloatBits(math.NaN()) {
+		panic("nan")
+	}
+}
+
+func TestStringOrder(t *testing.T) {
+	values := []string{"", "\x00", "\x00\x00", "\x00\x01", "a", "a\x00", "a\x00b", "ab", "b", "\xff"}
+	for i := 1; i < len(values); i++ {
+		a := New().String(values[i-1], Asc).Int64(1, Asc).Key()
+		b := New().String(values[i], Asc).Int64(0, Asc).Key()
+		if bytes.Compare(a.Data(), b.Data()) >= 0 {
+			panic(fmt.Sprintf("%q %q", values[i-1], values[i]))
+		}
+		a = New().String(values[i-1], Desc).Int64(0, Asc).Key()
+		b = New().String(values[i], Desc).Int64(1, Asc).Key()
+		if bytes.Compare(a.Data(), b.Data()) <= 0 {
+			panic(fmt.Sprintf("%q %q", values[i-1], values[i]))
+		}
+	}
+}
+
+type tuple struct {
+	a    int64
+	b    string
+	c    float64
+	null bool
+}
+
+func (x tuple) encode() Key {
+	e := New().Int64(x.a, Asc).String(x.b, Desc)
+	if x.null {
+		e.Null(Asc)
+	} else {
+		e.Float64(x.c, Asc)
+	}
+	return e.Key()
+}
+
+// less 按列比较，第二列降序，null 最小
+func (x tuple) less(y tuple) bool {
+	if x.a != y.a {
+		return x.a < y.a
+	}
+	if x.b != y.b {
+		return x.b > y.b
+	}
+	if x.null != y.null {
+		return x.null
+	}
+	return !x.null && x.c < y.c
+}
+
+func TestTupleOrder(t *testing.T) {
+	strs := []string{"", "a", "ab", "a\x00", "b"}
+	tuples := make([]tuple, 0)
+	for i := 0; i < 500; i++ {
+		tuples = append(tuples, tuple{
+			a:    int64(rand.Intn(5)) - 2,
+			b:    strs[rand.Intn(len(strs))],
+			c:    float64(rand.Intn(5)) - 2.5,
+			null: rand.Intn(5) == 0,
+		})
+	}
+	sort.Slice(tuples, func(i, j int) bool { return tuples[i].less(tuples[j]) })
+	for i := 1; i < len(tuples); i++ {
+		a, b := tuples[i-1].encode(), tuples[i].encode()
+		c := ComparePointer(a.UnsafePointer(), b.UnsafePointer())
+		if tuples[i-1].less(tuples[i]) && c >= 0 || !tuples[i-1].less(tuples[i]) && c != 0 {
+			panic(fmt.Sprint(tuples[i-1], tuples[i], c))
+		}
+	}
+
+	// 空 key 小于任何非空 key，数据为空时也不能取到 key 之外的指针
+	empty := New().Key()
+	if ComparePointer(empty.UnsafePointer(), tuples[0].encode().UnsafePointer()) >= 0 || ComparePointer(empty.UnsafePointer(), New().Key().UnsafePointer()) != 0 {
+		panic(empty)
+	}
+}
+
+func TestDecode(t *testing.T) {
+	k := New().Null(Asc).Bool(true, Desc).Int64(-7, Asc).Uint64(7, Desc).
+		Float64(-2.5, Desc).String("a\x00b", Desc).Bytes([]byte{0, 1, 2}, Asc).Key()
+	values, err := Decode(k)
+	if err != nil {
+		panic(err)
+	}
+	want := []interface{}{nil, true, int64(-7), uint64(7), -2.5, "a\x00b", []byte{0, 1, 2}}
+	if !reflect.DeepEqual(values, want) {
+		panic(fmt.Sprint(values))
+	}
+
+	if _, err = Decode(k[:len(k)-1]); err != ErrCorrupt {
+		panic(err)
+	}
+}
+
+func TestEncoderReuse(t *testing.T) {
+	e := New().Int64(7, Asc)
+	prefix := e.Key()
+	full := e.Int64(8, Asc).Key()
+	if !bytes.HasPrefix(full.Data(), prefix.Data()) {
+		panic(fmt.Sprint(prefix, full))
+	}
+	if len(prefix.Data()) != 9 {
+		panic(len(prefix.Data()))
+	}
+}
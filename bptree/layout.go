@@ -0,0 +1,165 @@
+package bptree
+
+import (
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"github.com/madokast/bptree/memory"
+	"unsafe"
+)
+
+/**
+磁盘格式（formatVersion = 1）
+meta、node、item 直接以结构体覆盖在 dir 的内存上读写。结构体只由定长字段组成并且显式填充，init 时检查偏移与下面一致。
+meta 和 node 头的多字节字段是小端编码的字节数组（le16、le32、leLocation），通过 get、set 以 binary.LittleEndian 读写，与主机字节序无关。
+item 的定长 key 直接交给 compareFunc 比较，只能按主机字节序保存，item 中的 Location 与之相同，所以 item 只在小端主机上与下面的描述一致。
+因此只支持小端的机器（amd64、arm64 等），大端机器上 New 会 panic、Open 返回 ErrBigEndianHost，跨字节序迁移使用 Dump、Restore。
+
+Location（8 bytes）
+	0  blockId     uint32，0xFFFFFFFF 表示 null
+	4  blockOffset uint32
+	meta、node 头中为 leLocation，两个字段都是小端；item 中为 memory.Location，按主机字节序
+
+meta（32 bytes，多字节字段都是小端）
+	0  magic       uint32 = 0xB97EEE01
+	4  version     uint16 = formatVersion
+	6  degree      uint16
+	8  flags       uint32，见 options.flags
+	12 summarySize uint32
+	16 keyType     byte
+	17 padding     [7]byte
+	24 rootPoint   Location
+	升级不能改变 magic、version 和选项（degree、flags、summarySize、keyType）的位置，Open 在升级之前按当前格式检查选项
+
+node（32 + degree * 24 + summarySize + checksum bytes，头中的多字节字段都是小端）
+	0  magic       uint16 = nodeMagic
+	2  version     byte = formatVersion
+	3  mode        byte，modeLeaf / modeRoot / modeMid 的组合
+	4  itemNumber  uint32
+	8  selfPoint   Location
+	16 fatherPoint Location
+	24 nextPoint   Location
+	32 items       [degree]item
+	之后是 summarySize 大小的聚合值
+	WithChecksums 时最后是 4 bytes 的 CRC32C，见 checksum.go
+
+item（24 bytes，按主机字节序）
+	0  null     byte，nullKeyFlag / notNullKeyFlag
+	1  padding  [7]byte
+	8  key      [8]byte，定长 key，或者变长 key 记录的 Location
+	16 valueLoc Location，叶子指向 value 记录，中间节点指向子节点
+
+value 记录    [长度 uint32][保留 4 bytes，WithValueChecksums 时为数据的 CRC32C][数据]
+变长 key 记录 [长度 uint32][数据]
+
+对齐：meta、node 的地址按 8 bytes 对齐分配，value 记录按 8 bytes 对齐，变长 key 记录不对齐。
+对齐由 memory.AllocateAligned 保证，跳过的字节不属于任何记录。旧版本分配的树可能不对齐，不影响读取的正确性
+
+格式变化时增加 formatVersion，并在 migrations 中注册旧版本的升级，Open 时依次执行
+*/
+
+const (
+	formatVersion = uint16(1)
+	nodeMagic     = uint16(0xB7E1)
+)
+
+var (
+	ErrFormatVersion = errors.New("bptree: unsupported format version")
+	ErrBigEndianHost = errors.New("bptree: big endian host is not supported")
+)
+
+// le16、le32、leLocation 以小端存储的 meta、node 头字段，与主机字节序无关
+type le16 [2]byte
+type le32 [4]byte
+type leLocation [8]byte
+
+func (v *le16) get() uint16 {
+	return binary.LittleEndian.Uint16(v[:])
+}
+
+func (v *le16) set(x uint16) {
+	binary.LittleEndian.PutUint16(v[:], x)
+}
+
+func (v *le32) get() uint32 {
+	return binary.LittleEndian.Uint32(v[:])
+}
+
+func (v *le32) set(x uint32) {
+	binary.LittleEndian.PutUint32(v[:], x)
+}
+
+// get 解码为 memory.Location，[0:4] 为 BlockId，[4:8] 为 BlockOffset
+func (v *leLocation) get() memory.Location {
+	return memory.Location{BlockId: binary.LittleEndian.Uint32(v[:]), BlockOffset: binary.LittleEndian.Uint32(v[4:])}
+}
+
+func (v *leLocation) set(loc memory.Location) {
+	binary.LittleEndian.PutUint32(v[:], loc.BlockId)
+	binary.LittleEndian.PutUint32(v[4:], loc.BlockOffset)
+}
+
+// littleEndianHost 当前机器是否为小端
+var littleEndianHost = func() bool {
+	x := uint16(1)
+	return *(*byte)(unsafe.Pointer(&x)) == 1
+}()
+
+// migrations[v] 把 version 为 v 的树原地升级到 v + 1，meta 中的 version 由 migrate 更新
+// 修改过的 node、value 需要 memory.MarkDirty，否则 dir 为 memory.BufferPool 时不会写回
+var migrations = map[uint16]func(dir memory.MemManager, metaLoc memory.Location) error{}
+
+// migrate 把 version 为 from 的树依次升级到 formatVersion
+func migrate(dir memory.MemManager, metaLoc memory.Location, from uint16) error {
+	if from > formatVersion {
+		return fmt.Errorf("%w: %d is newer than %d", ErrFormatVersion, from, formatVersion)
+	}
+	for v := from; v < formatVersion; v++ {
+		m, ok := migrations[v]
+		if !ok {
+			return fmt.Errorf("%w: no migration from %d", ErrFormatVersion, v)
+		}
+		if err := m(dir, metaLoc); err != nil {
+			return fmt.Errorf("migrate from %d: %w", v, err)
+		}
+		(*meta)(memory.Pointer(dir, metaLoc)).version.set(v + 1)
+	}
+	return nil
+}
+
+func init() {
+	checkLayout()
+}
+
+// checkLayout 检查结构体的布局与文档一致
+func checkLayout() {
+	m, n, i, l := meta{}, node{}, item{}, memory.Location{}
+	for _, c := range []struct {
+		name      string
+		got, want uintptr
+	}{
+		{"Location.BlockOffset", unsafe.Offsetof(l.BlockOffset), 4},
+		{"Location", unsafe.Sizeof(l), 8},
+		{"meta.version", unsafe.Offsetof(m.version), 4},
+		{"meta.degree", unsafe.Offsetof(m.degree), 6},
+		{"meta.flags", unsafe.Offsetof(m.flags), 8},
+		{"meta.summarySize", unsafe.Offsetof(m.summarySize), 12},
+		{"meta.keyType", unsafe.Offsetof(m.keyType), 16},
+		{"meta.rootPoint", unsafe.Offsetof(m.rootPoint), 24},
+		{"meta", unsafe.Sizeof(m), 32},
+		{"node.version", unsafe.Offsetof(n.version), 2},
+		{"node.mode", unsafe.Offsetof(n.mode), 3},
+		{"node.itemNumber", unsafe.Offsetof(n.itemNumber), 4},
+		{"node.selfPoint", unsafe.Offsetof(n.selfPoint), 8},
+		{"node.fatherPoint", unsafe.Offsetof(n.fatherPoint), 16},
+		{"node.nextPoint", unsafe.Offsetof(n.nextPoint), 24},
+		{"node", unsafe.Sizeof(n), 32},
+		{"item.key", unsafe.Offsetof(i.key), 8},
+		{"item.valueLoc", unsafe.Offsetof(i.valueLoc), 16},
+		{"item", unsafe.Sizeof(i), 24},
+	} {
+		if c.got != c.want {
+			panic(fmt.Sprintf("bptree: layout of %s is %d, want %d", c.name, c.got, c.want))
+		}
+	}
+}
@@ -0,0 +1,184 @@
+package bptree
+
+import (
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"github.com/madokast/bptree/memory"
+	"strings"
+	"testing"
+	"unsafe"
+)
+
+func TestLayout(t *testing.T) {
+	checkLayout()
+	if !littleEndianHost {
+		t.Skip("big endian host")
+	}
+
+	dir := memory.New(1024)
+	tree := New(dir, nil, WithKeyType(KeyInt64), WithDegree(5))
+	insertKeys(tree, 3, 2)
+	*key, *key2 = 1, 1
+	tree.InsertPointer(unsafe.Pointer(key), unsafe.Pointer(key2), 8)
+
+	// 按文档中的偏移直接读取字节
+	metaBytes := dir.Bytes(tree.MetaLocation(), metaSz)
+	if binary.LittleEndian.Uint32(metaBytes[0:]) != metaMagic ||
+		binary.LittleEndian.Uint16(metaBytes[4:]) != formatVersion ||
+		binary.LittleEndian.Uint16(metaBytes[6:]) != 5 ||
+		KeyType(metaBytes[16]) != KeyInt64 {
+		panic(fmt.Sprintf("%x", metaBytes))
+	}
+	root := memory.Location{
+		BlockId:     binary.LittleEndian.Uint32(metaBytes[24:]),
+		BlockOffset: binary.LittleEndian.Uint32(metaBytes[28:]),
+	}
+	if root != tree.root.selfPoint.get() {
+		panic(root)
+	}
+
+	nodeBytes := dir.Bytes(root, tree.nodeSize())
+	if binary.LittleEndian.Uint16(nodeBytes[0:]) != nodeMagic || uint16(nodeBytes[2]) != formatVersion ||
+		nodeBytes[3] != modeRoot|modeLeaf || binary.LittleEndian.Uint32(nodeBytes[4:]) != 4 {
+		panic(fmt.Sprintf("%x", nodeBytes[:32]))
+	}
+	// 第 0 个 item 是 null key，第 1 个 item 的 key 为 1
+	item1 := nodeBytes[32+24:]
+	if item1[0] != notNullKeyFlag || int64(binary.LittleEndian.Uint64(item1[8:])) != 1 {
+		panic(fmt.Sprintf("%x", item1[:24]))
+	}
+	valueLoc := memory.Location{
+		BlockId:     binary.LittleEndian.Uint32(item1[16:]),
+		BlockOffset: binary.LittleEndian.Uint32(item1[20:]),
+	}
+	value := dir.Bytes(valueLoc, valueHeaderSz+8)
+	if binary.LittleEndian.Uint32(value) != 8 || int64(binary.LittleEndian.Uint64(value[valueHeaderSz:])) != 1 {
+		panic(fmt.Sprintf("%x", value))
+	}
+}
+
+// meta、node 头的字段与主机字节序无关，总是小端
+func TestLittleEndianFields(t *testing.T) {
+	var m meta
+	m.magic.set(metaMagic)
+	m.degree.set(0x0102)
+	m.rootPoint.set(memory.Location{BlockId: 0x01020304, BlockOffset: 0x05060708})
+	b := (*[32]byte)(unsafe.Pointer(&m))
+	if fmt.Sprintf("%x", b[:8]) != "01ee7eb900000201" || fmt.Sprintf("%x", b[24:]) != "0403020108070605" {
+		panic(fmt.Sprintf("%x", b[:]))
+	}
+	if m.magic.get() != metaMagic || m.degree.get() != 0x0102 || m.rootPoint.get() != (memory.Location{BlockId: 0x01020304, BlockOffset: 0x05060708}) {
+		panic(fmt.Sprintf("%x", b[:]))
+	}
+	var n node
+	n.itemNumber.set(3)
+	if (*[32]byte)(unsafe.Pointer(&n))[4] != 3 || n.itemNumber.get() != 3 {
+		panic(n.itemNumber)
+	}
+}
+
+func TestOpenFormatVersion(t *testing.T) {
+	dir := memory.New(1024)
+	tree := New(dir, nil, int64Keys)
+	insertKeys(tree, 1, 2, 3)
+	m := tree.meta()
+
+	// 更新的版本无法打开
+	m.version.set(formatVersion + 1)
+	if _, err := Open(dir, tree.MetaLocation(), nil, int64Keys); !errors.Is(err, ErrFormatVersion) {
+		panic(err)
+	}
+
+	// 没有注册升级的旧版本无法打开
+	m.version.set(formatVersion - 1)
+	if _, err := Open(dir, tree.MetaLocation(), nil, int64Keys); !errors.Is(err, ErrFormatVersion) {
+		panic(err)
+	}
+
+	// 注册升级后，打开时执行升级并更新版本
+	migrated := 0
+	migrations[formatVersion-1] = func(dir memory.MemManager, metaLoc memory.Location) error {
+		migrated++
+		return nil
+	}
+	defer delete(migrations, formatVersion-1)
+	// 选项不一致时不升级，dir 不变
+	if _, err := Open(dir, tree.MetaLocation(), nil, int64Keys, WithDegree(7)); !errors.Is(err, ErrOptionsMismatch) || migrated != 0 || m.version.get() != formatVersion-1 {
+		panic(fmt.Sprint(err, migrated, m.version.get()))
+	}
+	reopen, err := Open(dir, tree.MetaLocation(), nil, int64Keys)
+	if err != nil {
+		panic(err)
+	}
+	if migrated != 1 || m.version.get() != formatVersion {
+		panic(fmt.Sprint(migrated, m.version.get()))
+	}
+	if err := reopen.Verify(); err != nil {
+		panic(err)
+	}
+	if fmt.Sprint(allKeys(reopen)) != "[nil 1 2 3]" {
+		panic(fmt.Sprint(allKeys(reopen)))
+	}
+
+	// 升级失败
+	m.version.set(formatVersion - 1)
+	migrations[formatVersion-1] = func(dir memory.MemManager, metaLoc memory.Location) error {
+		return errors.New("boom")
+	}
+	if _, err := Open(dir, tree.MetaLocation(), nil, int64Keys); err == nil || !strings.Contains(err.Error(), "boom") {
+		panic(err)
+	}
+}
+
+func TestVerifyNodeMagic(t *testing.T) {
+	tree := New(memory.New(1024), nil, int64Keys)
+	insertKeys(tree, 9, 8, 7, 6, 5, 4, 3, 2, 1)
+	locs := nodeLocations(tree)
+	n := tree.nodeAt(locs[len(locs)-1])
+	n.magic[0] ^= 1
+	if err := tree.Verify(); !errors.Is(err, ErrCorrupt) {
+		panic(err)
+	}
+	n.magic[0] ^= 1
+	n.version++
+	if err := tree.Verify(); !errors.Is(err, ErrCorrupt) || !strings.Contains(err.Error(), "magic") {
+		panic(err)
+	}
+	n.version--
+	if err := tree.Verify(); err != nil {
+		panic(err)
+	}
+}
+
+func TestAlignment(t *testing.T) {
+	for _, dir := range []memory.MemManager{memory.New(1 << 12), memory.NewInstrumented(struct{ memory.MemManager }{memory.New(1 << 12)})} {
+		// node 大小 32 + 3 * 24 + 4 不是 8 的倍数，value 和变长 key 的长度也不是
+		tree := New(dir, nil, WithKeyType(KeyBytes), WithVarKeys(), WithChecksums(ChecksumAlways))
+		for i := 0; i < 300; i++ {
+			tree.InsertBytes([]byte(fmt.Sprint("k", i*7%300)), []byte(strings.Repeat("v", i%13)))
+		}
+		if uintptr(memory.Pointer(dir, tree.MetaLocation()))%uintptr(metaAlign) != 0 {
+			panic(tree.MetaLocation())
+		}
+		nodes := []*node{tree.root}
+		for len(nodes) > 0 {
+			n := nodes[0]
+			nodes = nodes[1:]
+			if uintptr(unsafe.Pointer(n))%uintptr(nodeAlign) != 0 {
+				panic(n.selfPoint.get())
+			}
+			for i := uint32(0); i < n.itemNumber.get(); i++ {
+				loc := n.item(i).valueLoc
+				if !n.isLeaf() {
+					nodes = append(nodes, tree.readNode(loc))
+				} else if uintptr(tree.valuePointer(loc))%8 != 0 {
+					panic(loc)
+				}
+			}
+		}
+		if err := tree.Verify(); err != nil {
+			panic(err)
+		}
+	}
+}
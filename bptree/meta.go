@@ -0,0 +1,130 @@
+package bptree
+
+import (
+	"errors"
+	"fmt"
+	"github.com/madokast/bptree/memory"
+	"unsafe"
+)
+
+/**
+元数据
+New 时分配在 dir 中，保存根节点地址和需要持久化的选项。
+Open 由元数据地址重新打开一棵树，选项必须与建树时一致，避免以不同的排序读取已有数据
+*/
+
+const metaMagic = uint32(0x_B9_7E_EE_01)
+
+var metaSz = uint32(unsafe.Sizeof(meta{}))
+
+var (
+	ErrNullKey         = errors.New("bptree: null key is forbidden")
+	ErrBadMeta         = errors.New("bptree: bad meta")
+	ErrOptionsMismatch = errors.New("bptree: options mismatch")
+)
+
+// meta 的磁盘格式见 layout.go
+type meta struct {
+	magic       le32
+	version     le16 // 磁盘格式版本，见 formatVersion
+	degree      le16
+	flags       le32 // 持久化的选项，见 options.flags
+	summarySize le32 // 聚合值大小，决定 node 的分配大小
+	keyType     KeyType
+	padding     [7]byte
+	rootPoint   leLocation // 根节点地址。blockId = nullBlockBidFlag 表示空树
+}
+
+// Open 由 New 返回的 MetaLocation 重新打开一棵树
+// opts 中需要持久化的选项（排序、null、multimap、key 类型、度、聚合值大小）必须和建树时一致，否则返回 ErrOptionsMismatch
+// compareFunc 与 key 类型不一致时返回 ErrComparatorMismatch
+func Open(dir memory.MemManager, metaLoc memory.Location, compareFunc func(k1, k2 uintptr) int, opts ...Option) (*Tree, error) {
+	return open(dir, metaLoc, compareFunc, false, opts)
+}
+
+// open 打开一棵树，readOnly 时不升级旧版本的格式，树上的任何修改都 panic(ErrReadOnly)
+func open(dir memory.MemManager, metaLoc memory.Location, compareFunc func(k1, k2 uintptr) int, readOnly bool, opts []Option) (*Tree, error) {
+	o := newOptions(opts)
+	compare, err := o.resolveCompare(compareFunc)
+	if err != nil {
+		return nil, err
+	}
+	t := &Tree{
+		root:      nil,
+		metaPoint: metaLoc,
+		dir:       dir,
+		opts:      o,
+		readOnly:  readOnly,
+	}
+	t.compare = o.wrapCompare(compare, t.slotPointer)
+	t.detectDir()
+	t.enter()
+	defer t.exit()
+
+	if !littleEndianHost {
+		return nil, ErrBigEndianHost
+	}
+	m := t.meta()
+	if m.magic.get() != metaMagic {
+		return nil, ErrBadMeta
+	}
+	// 先检查选项，不一致时不升级，dir 保持原样
+	if m.flags.get() != o.flags() {
+		return nil, fmt.Errorf("%w: flags %b, want %b", ErrOptionsMismatch, o.flags(), m.flags.get())
+	}
+	if m.keyType != o.keyType {
+		return nil, fmt.Errorf("%w: key type %v, want %v", ErrOptionsMismatch, o.keyType, m.keyType)
+	}
+	if uint32(m.degree.get()) != o.degree {
+		return nil, fmt.Errorf("%w: degree %d, want %d", ErrOptionsMismatch, o.degree, m.degree.get())
+	}
+	if m.summarySize.get() != t.summarySize() {
+		return nil, fmt.Errorf("%w: summary size %d, want %d", ErrOptionsMismatch, t.summarySize(), m.summarySize.get())
+	}
+	if m.version.get() != formatVersion && readOnly {
+		return nil, fmt.Errorf("%w: %d, a read-only tree cannot migrate to %d", ErrFormatVersion, m.version.get(), formatVersion)
+	}
+	if m.version.get() != formatVersion {
+		if err := migrate(dir, metaLoc, m.version.get()); err != nil {
+			return nil, err
+		}
+		memory.MarkDirty(dir, metaLoc)
+	}
+	if m.rootPoint.get().BlockId != nullBlockBidFlag {
+		t.root = t.readNode(m.rootPoint.get())
+		t.rootLoc = m.rootPoint.get()
+	}
+	return t, nil
+}
+
+// MetaLocation 元数据的地址，用于 Open
+func (t *Tree) MetaLocation() memory.Location {
+	return t.metaPoint
+}
+
+func (t *Tree) newMeta() {
+	if !littleEndianHost {
+		panic(ErrBigEndianHost)
+	}
+	loc, pointer := t.allocate(metaSz, metaAlign, memory.TagMeta)
+	m := (*meta)(pointer)
+	m.magic.set(metaMagic)
+	m.version.set(formatVersion)
+	m.flags.set(t.opts.flags())
+	m.summarySize.set(t.summarySize())
+	m.keyType = t.opts.keyType
+	m.degree.set(uint16(t.opts.degree))
+	m.rootPoint.set(memory.Location{BlockId: nullBlockBidFlag})
+	t.metaPoint = loc
+}
+
+func (t *Tree) meta() *meta {
+	return (*meta)(memory.Pointer(t.dir, t.metaPoint))
+}
+
+// setMetaRoot 修改元数据中的根节点地址
+func (t *Tree) setMetaRoot(loc memory.Location) {
+	t.checkWritable()
+	t.meta().rootPoint.set(loc)
+	memory.MarkDirty(t.dir, t.metaPoint)
+}
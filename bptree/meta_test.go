@@ -0,0 +1,68 @@
+package bptree
+
+import (
+	"errors"
+	"fmt"
+	"github.com/madokast/bptree/memory"
+	"testing"
+)
+
+func TestOpen(t *testing.T) {
+	directory := memory.New(1024)
+	tree := New(directory, nil, int64Keys, WithNullOrder(NullsLast))
+
+	// 空树
+	reopen, err := Open(directory, tree.MetaLocation(), nil, int64Keys, WithNullOrder(NullsLast))
+	if err != nil {
+		panic(err)
+	}
+	if len(allKeys(reopen)) != 0 {
+		panic(allKeys(reopen))
+	}
+
+	insertKeys(tree, 5, 4, 3, 2, 1)
+	reopen, err = Open(directory, tree.MetaLocation(), nil, int64Keys, WithNullOrder(NullsLast))
+	if err != nil {
+		panic(err)
+	}
+	if fmt.Sprint(allKeys(reopen)) != "[1 2 3 4 5 nil]" {
+		panic(fmt.Sprint(allKeys(reopen)))
+	}
+
+	// 重新打开后继续插入
+	insertKeys(reopen, 7, 6)
+	if fmt.Sprint(allKeys(reopen)) != "[1 2 3 4 5 6 7 nil]" {
+		panic(fmt.Sprint(allKeys(reopen)))
+	}
+}
+
+func TestOpenMismatch(t *testing.T) {
+	directory := memory.New(1024)
+	tree := New(directory, nil, int64Keys, WithDescending())
+	insertKeys(tree, 1, 2, 3)
+
+	for _, opts := range [][]Option{
+		{int64Keys},
+		{int64Keys, WithDescending(), WithNullOrder(NullsLast)},
+		{int64Keys, WithDescending(), WithNoNullKeys()},
+		{int64Keys, WithDescending(), WithMultimap()},
+		{int64Keys, WithDescending(), WithPointerAggregator(Int64StatsAggregator{})},
+		{int64Keys, WithDescending(), WithDegree(8)},
+	} {
+		_, err := Open(directory, tree.MetaLocation(), nil, opts...)
+		if !errors.Is(err, ErrOptionsMismatch) {
+			panic(err)
+		}
+		t.Log(err)
+	}
+}
+
+func TestOpenBadMeta(t *testing.T) {
+	directory := memory.New(1024)
+	loc, _ := directory.Allocate(metaSz)
+	*(*uint32)(directory.Pointer(loc)) = 123
+	_, err := Open(directory, loc, nil, int64Keys)
+	if !errors.Is(err, ErrBadMeta) {
+		panic(err)
+	}
+}
@@ -0,0 +1,198 @@
+package bptree
+
+import (
+	"fmt"
+	"unsafe"
+)
+
+// Option 树的可选配置
+type Option func(o *options)
+
+// NullOrder null key 的排序位置
+type NullOrder byte
+
+const (
+	NullsFirst NullOrder = iota // null 是最小的 key，默认
+	NullsLast                   // null 是最大的 key
+)
+
+type options struct {
+	aggregator PointerAggregator
+	compare    func(k1, k2 unsafe.Pointer) int // WithCompare
+	multimap   bool
+	nullOrder  NullOrder
+	descending bool
+	noNullKeys bool
+	varKeys    bool
+	keyType    KeyType
+	degree     uint32
+	// 校验和，见 checksum.go
+	checksums      bool
+	valueChecksums bool
+	checksumMode   ChecksumMode
+}
+
+// 持久化到元数据中的选项，重新打开时必须一致
+const (
+	flagMultimap = uint32(1 << iota)
+	flagNullsLast
+	flagDescending
+	flagNoNullKeys
+	flagVarKeys
+	flagChecksums
+	flagValueChecksums
+	allFlags = flagValueChecksums<<1 - 1
+)
+
+// WithAggregator 为树配置聚合器，之后可以使用 Aggregate。agg 同时实现了 PointerAggregator 时使用 unsafe.Pointer 版本
+func WithAggregator(agg Aggregator) Option {
+	return func(o *options) {
+		if pa, ok := agg.(PointerAggregator); ok {
+			o.aggregator = pa
+		} else {
+			o.aggregator = uintptrAggregator{agg}
+		}
+	}
+}
+
+// WithPointerAggregator 与 WithAggregator 相同，聚合器以 unsafe.Pointer 传递指针
+func WithPointerAggregator(agg PointerAggregator) Option {
+	return func(o *options) {
+		o.aggregator = agg
+	}
+}
+
+// WithCompare 以 unsafe.Pointer 传递 key 的比较函数，此时 New、Open 的 compareFunc 应当为 nil
+func WithCompare(compare func(k1, k2 unsafe.Pointer) int) Option {
+	return func(o *options) {
+		o.compare = compare
+	}
+}
+
+// WithMultimap 允许重复 key。相同的 key 作为不同的键值对保存，按插入顺序排列
+func WithMultimap() Option {
+	return func(o *options) {
+		o.multimap = true
+	}
+}
+
+// WithNullOrder 指定 null key 排在最前（NULLS FIRST）还是最后（NULLS LAST）
+func WithNullOrder(order NullOrder) Option {
+	return func(o *options) {
+		o.nullOrder = order
+	}
+}
+
+// WithDescending 非 null key 按 compareFunc 的逆序排列。null 的位置仍由 WithNullOrder 决定
+func WithDescending() Option {
+	return func(o *options) {
+		o.descending = true
+	}
+}
+
+// WithNoNullKeys 禁止 null key，插入 null key 会 panic(ErrNullKey)
+func WithNoNullKeys() Option {
+	return func(o *options) {
+		o.noNullKeys = true
+	}
+}
+
+// WithVarKeys 使用变长 key。此时 key 指针指向 [长度 uint32 小端][数据]，例如 keys.Key
+// 变长 key 另外保存在 dir 中，item 中只保存其地址
+func WithVarKeys() Option {
+	return func(o *options) {
+		o.varKeys = true
+	}
+}
+
+// WithKeyType 指定 key 类型，此时 compareFunc 可以为 nil，使用内置的比较函数
+func WithKeyType(kt KeyType) Option {
+	return func(o *options) {
+		o.keyType = kt
+	}
+}
+
+// WithDegree 指定节点的度，即每个节点最多保存的 item 数目，取值范围 [3, 4096]，默认为 3
+// 度越大树越矮，节点内使用二分查找。节点按度分配，dir 的 block 需要放得下一个节点
+func WithDegree(degree int) Option {
+	if degree < defaultDegree || degree > maxDegree {
+		panic(fmt.Sprintf("bptree: degree %d out of range [%d, %d]", degree, defaultDegree, maxDegree))
+	}
+	return func(o *options) {
+		o.degree = uint32(degree)
+	}
+}
+
+func newOptions(opts []Option) options {
+	o := options{degree: defaultDegree}
+	for _, opt := range opts {
+		opt(&o)
+	}
+	return o
+}
+
+// flags 需要持久化的选项
+func (o *options) flags() uint32 {
+	flags := uint32(0)
+	if o.multimap {
+		flags |= flagMultimap
+	}
+	if o.nullOrder == NullsLast {
+		flags |= flagNullsLast
+	}
+	if o.descending {
+		flags |= flagDescending
+	}
+	if o.noNullKeys {
+		flags |= flagNoNullKeys
+	}
+	if o.varKeys {
+		flags |= flagVarKeys
+	}
+	if o.checksums {
+		flags |= flagChecksums
+	}
+	if o.valueChecksums {
+		flags |= flagValueChecksums
+	}
+	return flags
+}
+
+// setFlags 由持久化的 flags 恢复选项
+func (o *options) setFlags(flags uint32) {
+	o.multimap = flags&flagMultimap != 0
+	o.nullOrder = NullsFirst
+	if flags&flagNullsLast != 0 {
+		o.nullOrder = NullsLast
+	}
+	o.descending = flags&flagDescending != 0
+	o.noNullKeys = flags&flagNoNullKeys != 0
+	o.varKeys = flags&flagVarKeys != 0
+	o.checksums = flags&flagChecksums != 0
+	o.valueChecksums = flags&flagValueChecksums != 0
+}
+
+// wrapCompare 在用户的 compareFunc 之上处理 null 和逆序。slotPointer 由 item 中保存的 key 得到 key 指针
+func (o *options) wrapCompare(compareFunc func(k1, k2 unsafe.Pointer) int, slotPointer func(slot *[keySize]byte) unsafe.Pointer) func(key1 unsafe.Pointer, key2 *[keySize]byte, key2Null byte) int {
+	nullCmp := -1 // null 与非 null 比较的结果
+	if o.nullOrder == NullsLast {
+		nullCmp = 1
+	}
+	descending := o.descending
+	return func(key1 unsafe.Pointer, key2 *[keySize]byte, key2Null byte) int {
+		if key1 == nil {
+			if key2Null == nullKeyFlag {
+				return 0
+			}
+			return nullCmp
+		}
+		if key2Null == nullKeyFlag {
+			return -nullCmp
+		}
+		c := compareFunc(key1, slotPointer(key2))
+		if descending {
+			return -c
+		}
+		return c
+	}
+}
@@ -0,0 +1,67 @@
+package bptree
+
+import (
+	"errors"
+	"fmt"
+	"github.com/madokast/bptree/memory"
+	"testing"
+	"unsafe"
+)
+
+func insertKeys(tree *Tree, keys ...int64) {
+	for _, k := range keys {
+		*key = k
+		tree.InsertPointer(unsafe.Pointer(key), nil, 0)
+	}
+	tree.InsertPointer(nil, nil, 0)
+}
+
+func TestNullsFirst(t *testing.T) {
+	tree := New(memory.New(1024), nil, int64Keys)
+	insertKeys(tree, 3, 1, 4, 1, 5, 9, 2, 6)
+	if fmt.Sprint(allKeys(tree)) != "[nil 1 2 3 4 5 6 9]" {
+		panic(fmt.Sprint(allKeys(tree)))
+	}
+}
+
+func TestNullsLast(t *testing.T) {
+	tree := New(memory.New(1024), nil, int64Keys, WithNullOrder(NullsLast))
+	insertKeys(tree, 3, 1, 4, 1, 5, 9, 2, 6)
+	if fmt.Sprint(allKeys(tree)) != "[1 2 3 4 5 6 9 nil]" {
+		panic(fmt.Sprint(allKeys(tree)))
+	}
+	if exist, _ := tree.FindPointer(nil); !exist {
+		panic(exist)
+	}
+}
+
+func TestDescending(t *testing.T) {
+	tree := New(memory.New(1024), nil, int64Keys, WithDescending())
+	insertKeys(tree, 3, 1, 4, 1, 5, 9, 2, 6)
+	if fmt.Sprint(allKeys(tree)) != "[nil 9 6 5 4 3 2 1]" {
+		panic(fmt.Sprint(allKeys(tree)))
+	}
+
+	tree = New(memory.New(1024), nil, int64Keys, WithDescending(), WithNullOrder(NullsLast))
+	insertKeys(tree, 3, 1, 4, 1, 5, 9, 2, 6)
+	if fmt.Sprint(allKeys(tree)) != "[9 6 5 4 3 2 1 nil]" {
+		panic(fmt.Sprint(allKeys(tree)))
+	}
+	*key = 4
+	if exist, _ := tree.FindPointer(unsafe.Pointer(key)); !exist {
+		panic(exist)
+	}
+}
+
+func TestNoNullKeys(t *testing.T) {
+	tree := New(memory.New(1024), nil, int64Keys, WithNoNullKeys())
+	*key = 1
+	tree.InsertPointer(unsafe.Pointer(key), nil, 0)
+	defer func() {
+		r := recover()
+		if err, ok := r.(error); !ok || !errors.Is(err, ErrNullKey) {
+			panic(r)
+		}
+	}()
+	tree.InsertPointer(nil, nil, 0)
+}
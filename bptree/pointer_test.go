@@ -0,0 +1,177 @@
+package bptree
+
+import (
+	"errors"
+	"fmt"
+	"github.com/madokast/bptree/bptree/keys"
+	"github.com/madokast/bptree/memory"
+	"math/rand"
+	"runtime"
+	"testing"
+	"unsafe"
+)
+
+// 只使用 unsafe.Pointer 版本的接口，可以在 checkptr 下运行。除了 bptree_test.go 中原有的 uintptr 测试，其它测试也都是这样
+// go test -race -skip '^Test(One|Two|Three|Four|10|Random|Find$|FindNull$|New$)' ./...
+
+// int64Keys 相当于 keyComp 的 unsafe.Pointer 版本。keyComp、keyFunc 等 uintptr 的辅助函数只用于原有的测试，
+// 之后加的测试使用 int64Keys 和 allKeys，go test -race ./... 时不会被 checkptr 拒绝
+var int64Keys = WithCompare(compareInt64)
+
+// int64String 相当于 keyString
+func int64String(p unsafe.Pointer) string {
+	return fmt.Sprint(*(*int64)(p))
+}
+
+// allKeys 相当于 AllKeys(keyFunc)，按顺序返回所有 int64 key，null 为 "nil"
+func allKeys(tree interface{ Scan() *Iterator }) []interface{} {
+	return scanKeys(tree, func(p unsafe.Pointer) interface{} { return *(*int64)(p) })
+}
+
+// scanKeys 相当于 AllKeys，keyFun 以 unsafe.Pointer 接收 key
+func scanKeys(tree interface{ Scan() *Iterator }, keyFun func(p unsafe.Pointer) interface{}) []interface{} {
+	keys := make([]interface{}, 0)
+	for iter := tree.Scan(); iter.Next(); {
+		if iter.KeyPointer() == nil {
+			keys = append(keys, nullStr)
+		} else {
+			keys = append(keys, keyFun(iter.KeyPointer()))
+		}
+	}
+	return keys
+}
+
+func TestPointerAPI(t *testing.T) {
+	tree := New(memory.New(1<<12), nil, WithKeyType(KeyInt64), WithDegree(5),
+		WithPointerAggregator(Int64StatsAggregator{}), WithChecksums(ChecksumAlways), WithValueChecksums())
+	m := map[int64]int64{}
+	for i := 0; i < 1000; i++ {
+		// 每次新分配，插入之后不再引用，GC 可以回收
+		key, value := new(int64), new(int64)
+		*key, *value = int64(rand.Intn(500)), rand.Int63n(1000)
+		m[*key] = *value
+		tree.InsertPointer(unsafe.Pointer(key), unsafe.Pointer(value), 8)
+		if i%100 == 0 {
+			runtime.GC()
+		}
+	}
+	tree.InsertPointer(nil, nil, 0)
+	if err := tree.Verify(); err != nil {
+		panic(err)
+	}
+
+	key := new(int64)
+	for k := int64(-10); k < 510; k++ {
+		*key = k
+		exist, value := tree.FindPointer(unsafe.Pointer(key))
+		want, ok := m[k]
+		if exist != ok || (exist && *(*int64)(value) != want) {
+			panic(fmt.Sprint(k, exist, want))
+		}
+	}
+	if exist, value := tree.FindPointer(nil); !exist || value != nil {
+		panic("null")
+	}
+
+	from, to, stats := new(int64), new(int64), new(Int64Stats)
+	*from, *to = 100, 199
+	tree.AggregatePointer(unsafe.Pointer(from), unsafe.Pointer(to), unsafe.Pointer(stats))
+	want := Int64Stats{}
+	for k, v := range m {
+		if k >= 100 && k <= 199 {
+			if want.NotNull == 0 || v < want.Min {
+				want.Min = v
+			}
+			if want.NotNull == 0 || v > want.Max {
+				want.Max = v
+			}
+			want.Count, want.NotNull, want.Sum = want.Count+1, want.NotNull+1, want.Sum+v
+		}
+	}
+	if *stats != want {
+		panic(fmt.Sprint(*stats, want))
+	}
+
+	prev := int64(-1)
+	iter := tree.Scan()
+	for iter.Next() {
+		if iter.KeyPointer() == nil {
+			continue
+		}
+		k := *(*int64)(iter.KeyPointer())
+		if k <= prev || *(*int64)(iter.ValuePointer()) != m[k] {
+			panic(k)
+		}
+		prev = k
+	}
+
+	for k, v := range m {
+		*key = k
+		value := new(int64)
+		*value = v
+		if !tree.DeleteOnePointer(unsafe.Pointer(key), unsafe.Pointer(value), 8) {
+			panic(k)
+		}
+		if exist, _ := tree.FindPointer(unsafe.Pointer(key)); exist {
+			panic(k)
+		}
+	}
+	if err := tree.Verify(); err != nil {
+		panic(err)
+	}
+}
+
+func TestPointerCompare(t *testing.T) {
+	tree := New(memory.New(1<<12), nil, WithVarKeys(), WithCompare(keys.ComparePointer), WithDegree(4))
+	for i := 0; i < 300; i++ {
+		k := keys.New().String(fmt.Sprintf("user-%03d", i%100), keys.Asc).Int64(int64(i), keys.Desc).Key()
+		value := []byte(fmt.Sprint(i))
+		tree.InsertPointer(k.UnsafePointer(), unsafe.Pointer(&value[0]), uint32(len(value)))
+	}
+	runtime.GC()
+	if err := tree.Verify(); err != nil {
+		panic(err)
+	}
+
+	prefix := keys.New().String("user-042", keys.Asc).Key()
+	got := []string{}
+	iter := tree.ScanPrefixPointer(prefix.UnsafePointer())
+	for iter.Next() {
+		got = append(got, string(iter.ValueBytes()))
+	}
+	if fmt.Sprint(got) != "[242 142 42]" {
+		panic(fmt.Sprint(got))
+	}
+
+	// compareFunc 和 WithCompare 只能指定一个
+	defer func() {
+		if err, ok := recover().(error); !ok || !errors.Is(err, ErrComparatorMismatch) {
+			panic(err)
+		}
+	}()
+	New(memory.New(1024), keys.Compare, WithVarKeys(), WithCompare(keys.ComparePointer))
+}
+
+func TestPointerStringMap(t *testing.T) {
+	mem := memory.New(1 << 12)
+	m := NewStringMap(mem, 7)
+	for i := 0; i < 500; i++ {
+		m.Put(fmt.Sprint("k", i), []byte(fmt.Sprint("v", i)))
+	}
+	runtime.GC()
+	for i := 0; i < 500; i += 2 {
+		if !m.Delete(fmt.Sprint("k", i)) {
+			panic(i)
+		}
+	}
+	m, err := OpenStringMap(mem, m.MetaLocation())
+	if err != nil {
+		panic(err)
+	}
+	for i := 0; i < 500; i++ {
+		value, ok := m.Get(fmt.Sprint("k", i))
+		if ok != (i%2 == 1) || (ok && string(value) != fmt.Sprint("v", i)) {
+			panic(i)
+		}
+	}
+}
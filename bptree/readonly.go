@@ -0,0 +1,98 @@
+package bptree
+
+import (
+	"errors"
+	"github.com/madokast/bptree/memory"
+	"unsafe"
+)
+
+/**
+只读打开
+OpenReadOnly 打开的树只有查询、遍历、聚合和统计，用于 dir 以 PROT_READ 映射的副本（例如 memory.OpenShared），写入会让进程直接崩溃。
+读路径保证不写 dir：findLeaf 只在插入时（pk 不为 nil）更新最大 key，校验和只读不写，聚合值、迭代器的状态都在 Go 堆上。
+即使通过内部函数修改，分配、插入、删除和修改根节点也会先 panic(ErrReadOnly)，不会写到一半。
+旧版本格式的树需要升级，只读时不能打开，返回 ErrFormatVersion
+*/
+
+var ErrReadOnly = errors.New("bptree: read-only tree")
+
+// ReadOnlyTree 只读的树，方法与 Tree 中的同名方法相同
+type ReadOnlyTree struct {
+	t *Tree
+}
+
+// OpenReadOnly 与 Open 相同，但打开的树只能读
+func OpenReadOnly(dir memory.MemManager, metaLoc memory.Location, compareFunc func(k1, k2 uintptr) int, opts ...Option) (*ReadOnlyTree, error) {
+	t, err := open(dir, metaLoc, compareFunc, true, opts)
+	if err != nil {
+		return nil, err
+	}
+	return &ReadOnlyTree{t: t}, nil
+}
+
+// checkWritable 只读的树上修改时 panic(ErrReadOnly)，在写 dir 之前调用
+func (t *Tree) checkWritable() {
+	if t.readOnly {
+		panic(ErrReadOnly)
+	}
+}
+
+func (r *ReadOnlyTree) Find(key uintptr) (exist bool, value uintptr) {
+	return r.t.Find(key)
+}
+
+func (r *ReadOnlyTree) FindPointer(key unsafe.Pointer) (exist bool, value unsafe.Pointer) {
+	return r.t.FindPointer(key)
+}
+
+func (r *ReadOnlyTree) TryFind(key uintptr) (exist bool, value uintptr, err error) {
+	return r.t.TryFind(key)
+}
+
+func (r *ReadOnlyTree) TryFindPointer(key unsafe.Pointer) (exist bool, value unsafe.Pointer, err error) {
+	return r.t.TryFindPointer(key)
+}
+
+func (r *ReadOnlyTree) GetBytes(key []byte) (value []byte, exist bool) {
+	return r.t.GetBytes(key)
+}
+
+func (r *ReadOnlyTree) FindAll(key uintptr) *Iterator {
+	return r.t.FindAll(key)
+}
+
+func (r *ReadOnlyTree) FindAllPointer(key unsafe.Pointer) *Iterator {
+	return r.t.FindAllPointer(key)
+}
+
+func (r *ReadOnlyTree) Scan() *Iterator {
+	return r.t.Scan()
+}
+
+func (r *ReadOnlyTree) ScanPrefix(prefix uintptr) *Iterator {
+	return r.t.ScanPrefix(prefix)
+}
+
+func (r *ReadOnlyTree) ScanPrefixPointer(prefix unsafe.Pointer) *Iterator {
+	return r.t.ScanPrefixPointer(prefix)
+}
+
+func (r *ReadOnlyTree) Aggregate(from, to uintptr, dst uintptr) {
+	r.t.Aggregate(from, to, dst)
+}
+
+func (r *ReadOnlyTree) AggregatePointer(from, to unsafe.Pointer, dst unsafe.Pointer) {
+	r.t.AggregatePointer(from, to, dst)
+}
+
+func (r *ReadOnlyTree) Stats() Stats {
+	return r.t.Stats()
+}
+
+func (r *ReadOnlyTree) Verify() error {
+	return r.t.Verify()
+}
+
+func (r *ReadOnlyTree) MetaLocation() memory.Location {
+	return r.t.MetaLocation()
+}
@@ -0,0 +1,60 @@
+package bptree
+
+import (
+	"errors"
+	"fmt"
+	"github.com/madokast/bptree/memory"
+	"testing"
+	"unsafe"
+)
+
+func TestOpenReadOnly(t *testing.T) {
+	dir := memory.New(1024)
+	tree := New(dir, nil, int64Keys, WithDegree(4))
+	insertKeys(tree, 3, 1, 4, 1, 5, 9, 2, 6)
+	r, err := OpenReadOnly(dir, tree.MetaLocation(), nil, int64Keys, WithDegree(4))
+	if err != nil {
+		panic(err)
+	}
+	if fmt.Sprint(allKeys(r.t)) != "[nil 1 2 3 4 5 6 9]" || r.Stats().Entries != 8 {
+		panic(fmt.Sprint(allKeys(r.t)))
+	}
+	*key = 4
+	if exist, _ := r.FindPointer(unsafe.Pointer(key)); !exist {
+		panic(exist)
+	}
+
+	// 任何修改都在写 dir 之前 panic
+	allocated := dir.AllocatedBytes()
+	for _, f := range []func(){
+		func() { r.t.InsertPointer(unsafe.Pointer(key), nil, 0) },
+		func() { r.t.InsertPointer(unsafe.Pointer(key), unsafe.Pointer(key), 8) },
+		func() { r.t.InsertBytes(make([]byte, 8), nil) },
+		func() { r.t.DeleteOnePointer(unsafe.Pointer(key), nil, 0) },
+	} {
+		func() {
+			defer func() {
+				if err, ok := recover().(error); !ok || !errors.Is(err, ErrReadOnly) {
+					panic(err)
+				}
+			}()
+			f()
+		}()
+	}
+	if dir.AllocatedBytes() != allocated {
+		panic(dir.AllocatedBytes())
+	}
+	if err := r.Verify(); err != nil {
+		panic(err)
+	}
+
+	// 只读时不升级旧版本
+	tree.meta().version.set(formatVersion - 1)
+	migrations[formatVersion-1] = func(dir memory.MemManager, metaLoc memory.Location) error {
+		panic("migrated")
+	}
+	defer delete(migrations, formatVersion-1)
+	if _, err := OpenReadOnly(dir, tree.MetaLocation(), nil, int64Keys, WithDegree(4)); !errors.Is(err, ErrFormatVersion) {
+		panic(err)
+	}
+}
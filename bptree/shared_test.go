@@ -0,0 +1,308 @@
+//go:build linux || darwin || freebsd
+
+package bptree
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/binary"
+	"fmt"
+	"github.com/madokast/bptree/bptree/keys"
+	"github.com/madokast/bptree/memory"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"runtime/debug"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+	"unsafe"
+)
+
+// 一个写者、多个读者，读者只读映射同一个文件，在 Read 中看到的总是某次操作结束时的树
+func TestSharedMemoryTree(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "shm")
+	writer, err := memory.CreateShared(path, 1<<22)
+	if err != nil {
+		panic(err)
+	}
+	defer writer.Close()
+	opts := []Option{WithKeyType(KeyInt64), WithDegree(5), WithChecksums(ChecksumAlways), WithPointerAggregator(Int64StatsAggregator{})}
+	tree := New(writer, nil, opts...)
+	writer.Publish(tree.MetaLocation())
+
+	key, value := new(int64), new(int64)
+	insert := func(i int64) {
+		*key, *value = i, 2*i
+		tree.InsertPointer(unsafe.Pointer(key), unsafe.Pointer(value), 8)
+	}
+	insert(0)
+
+	const n = 3000
+	done := atomic.Bool{}
+	wg := sync.WaitGroup{}
+	for r := 0; r < 3; r++ {
+		reader, err := memory.OpenShared(path)
+		if err != nil {
+			panic(err)
+		}
+		defer reader.Close()
+		var view *Tree
+		reader.Read(func() {
+			view, err = Open(reader, reader.Published(), nil, opts...)
+		})
+		if err != nil {
+			panic(err)
+		}
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			key, from, to := new(int64), new(int64), new(int64)
+			*to = n
+			for count := int64(0); count < n; {
+				// 写者结束之后再读一次，应当看到所有 key
+				finished := done.Load()
+				// 写者按顺序插入，任何时刻的树都是 0 到 count-1
+				var stats Int64Stats
+				var last, value int64
+				var exist bool
+				reader.Read(func() {
+					stats = Int64Stats{}
+					view.AggregatePointer(unsafe.Pointer(from), unsafe.Pointer(to), unsafe.Pointer(&stats))
+					*key = stats.Count - 1
+					exist, value, last = false, 0, -1
+					if ok, p := view.FindPointer(unsafe.Pointer(key)); ok {
+						exist, value = true, *(*int64)(p)
+					}
+					iter := view.Scan()
+					for iter.Next() {
+						last = *(*int64)(iter.KeyPointer())
+					}
+				})
+				if stats.Count < count || stats.Sum != stats.Count*(stats.Count-1) || last != stats.Count-1 ||
+					!exist || value != 2*last || (finished && stats.Count != n) {
+					panic(fmt.Sprint(stats, last, exist, value))
+				}
+				count = stats.Count
+			}
+			var err error
+			reader.Read(func() {
+				err = view.Verify()
+			})
+			if err != nil {
+				panic(err)
+			}
+		}()
+	}
+
+	for i := int64(1); i < n; i++ {
+		insert(i)
+	}
+	done.Store(true)
+	wg.Wait()
+	if err := tree.Verify(); err != nil {
+		panic(err)
+	}
+}
+
+// sharedReaderEnv 设置时 TestSharedMemoryProcess 作为读者进程运行，值为共享文件的路径
+const sharedReaderEnv = "BPTREE_SHARED_READER"
+
+// 写者进程插入时，其他进程只读映射同一个文件，只能看到发布过的、一致的树。读者进程由测试程序自己以 sharedReaderEnv 启动
+func TestSharedMemoryProcess(t *testing.T) {
+	opts := []Option{WithKeyType(KeyInt64), WithDegree(5), WithChecksums(ChecksumAlways), WithPointerAggregator(Int64StatsAggregator{})}
+	const n = 3000
+	if path := os.Getenv(sharedReaderEnv); path != "" {
+		sharedReader(path, n, opts)
+		return
+	}
+
+	path := filepath.Join(t.TempDir(), "shm")
+	writer, err := memory.CreateShared(path, 1<<22)
+	if err != nil {
+		panic(err)
+	}
+	defer writer.Close()
+	tree := New(writer, nil, opts...)
+	writer.Publish(tree.MetaLocation())
+	key, value := new(int64), new(int64)
+	insert := func(i int64) {
+		*key, *value = i, 2*i
+		tree.InsertPointer(unsafe.Pointer(key), unsafe.Pointer(value), 8)
+	}
+	insert(0)
+
+	readers := make([]*exec.Cmd, 3)
+	stderr := make([]bytes.Buffer, len(readers))
+	for r := range readers {
+		cmd := exec.Command(os.Args[0], "-test.run=^TestSharedMemoryProcess$", "-test.count=1")
+		cmd.Env = append(os.Environ(), sharedReaderEnv+"="+path)
+		cmd.Stderr = &stderr[r]
+		stdout, err := cmd.StdoutPipe()
+		if err != nil {
+			panic(err)
+		}
+		if err := cmd.Start(); err != nil {
+			panic(err)
+		}
+		// 读者映射并打开树之后输出 ready，之后再插入，保证读写同时进行
+		if line, err := bufio.NewReader(stdout).ReadString('\n'); err != nil || line != "ready\n" {
+			panic(fmt.Sprint(line, err, stderr[r].String()))
+		}
+		readers[r] = cmd
+	}
+
+	// 插入得太快时读者只能看到最终的树，每批之间停顿一下
+	for i := int64(1); i < n; i++ {
+		insert(i)
+		if i%50 == 0 {
+			time.Sleep(time.Millisecond)
+		}
+	}
+	for r, cmd := range readers {
+		if err := cmd.Wait(); err != nil {
+			panic(fmt.Sprint(err, "\n", stderr[r].String()))
+		}
+	}
+}
+
+// sharedReader 读者进程，反复读取直到看到写者插入的全部 n 个 key
+func sharedReader(path string, n int64, opts []Option) {
+	reader, err := memory.OpenShared(path)
+	if err != nil {
+		panic(err)
+	}
+	defer reader.Close()
+	var view *Tree
+	reader.Read(func() {
+		view, err = Open(reader, reader.Published(), nil, opts...)
+	})
+	if err != nil {
+		panic(err)
+	}
+	fmt.Println("ready")
+
+	deadline := time.Now().Add(time.Minute)
+	key, from, to := new(int64), new(int64), new(int64)
+	*to = n
+	for count := int64(0); count < n; {
+		if time.Now().After(deadline) {
+			panic(fmt.Sprint("saw ", count, " of ", n, " keys"))
+		}
+		// 写者按顺序插入，发布的树总是 0 到 count-1
+		var stats Int64Stats
+		var last, value int64
+		var exist bool
+		reader.Read(func() {
+			stats = Int64Stats{}
+			view.AggregatePointer(unsafe.Pointer(from), unsafe.Pointer(to), unsafe.Pointer(&stats))
+			*key = stats.Count - 1
+			exist, value, last = false, 0, -1
+			if ok, p := view.FindPointer(unsafe.Pointer(key)); ok {
+				exist, value = true, *(*int64)(p)
+			}
+			iter := view.Scan()
+			for iter.Next() {
+				last = *(*int64)(iter.KeyPointer())
+			}
+		})
+		if stats.Count < count || stats.Sum != stats.Count*(stats.Count-1) || last != stats.Count-1 || !exist || value != 2*last {
+			panic(fmt.Sprint(stats, last, exist, value))
+		}
+		count = stats.Count
+	}
+	reader.Read(func() {
+		err = view.Verify()
+	})
+	if err != nil {
+		panic(err)
+	}
+}
+
+// 只读映射上的读路径不能写任何内存，否则进程崩溃
+func TestReadOnlyMapping(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "shm")
+	writer, err := memory.CreateShared(path, 1<<22)
+	if err != nil {
+		panic(err)
+	}
+	defer writer.Close()
+	opts := []Option{WithKeyType(KeyInt64), WithDegree(4), WithChecksums(ChecksumAlways), WithValueChecksums(), WithPointerAggregator(Int64StatsAggregator{})}
+	ints := New(writer, nil, opts...)
+	strs := New(writer, nil, WithVarKeys(), WithCompare(keys.ComparePointer), WithDegree(4), WithChecksums(ChecksumAlways))
+	k, v := new(int64), new(int64)
+	for i := int64(0); i < 500; i++ {
+		*k, *v = i%250, i
+		ints.InsertPointer(unsafe.Pointer(k), unsafe.Pointer(v), 8)
+		strs.InsertBytes(keys.New().String(fmt.Sprintf("user-%03d", i%100), keys.Asc).Int64(i, keys.Asc).Key().Data(), []byte(fmt.Sprint(i)))
+	}
+	wantInts, wantStrs := ints.Stats(), strs.Stats()
+
+	reader, err := memory.OpenShared(path)
+	if err != nil {
+		panic(err)
+	}
+	defer reader.Close()
+	ri, err := OpenReadOnly(reader, ints.MetaLocation(), nil, opts...)
+	if err != nil {
+		panic(err)
+	}
+	rs, err := OpenReadOnly(reader, strs.MetaLocation(), nil, WithVarKeys(), WithCompare(keys.ComparePointer), WithDegree(4), WithChecksums(ChecksumAlways))
+	if err != nil {
+		panic(err)
+	}
+
+	for i := int64(-1); i <= 250; i++ {
+		*k = i
+		exist, value := ri.FindPointer(unsafe.Pointer(k))
+		if exist != (i >= 0 && i < 250) || (exist && *(*int64)(value) != i+250) {
+			panic(i)
+		}
+		if _, _, err := ri.TryFindPointer(unsafe.Pointer(k)); err != nil {
+			panic(err)
+		}
+		if value, exist := ri.GetBytes(binary.LittleEndian.AppendUint64(nil, uint64(i))); exist != (i >= 0 && i < 250) || (exist && binary.LittleEndian.Uint64(value) != uint64(i+250)) {
+			panic(i)
+		}
+	}
+	count := 0
+	for iter := ri.Scan(); iter.Next(); count++ {
+		if *(*int64)(iter.ValuePointer()) != *(*int64)(iter.KeyPointer())+250 {
+			panic(count)
+		}
+	}
+	from, to, stats := new(int64), new(int64), new(Int64Stats)
+	*to = 249
+	ri.AggregatePointer(unsafe.Pointer(from), unsafe.Pointer(to), unsafe.Pointer(stats))
+	if count != 250 || stats.Count != 250 || stats.Sum != (250+499)*250/2 {
+		panic(fmt.Sprint(count, *stats))
+	}
+	got := []string{}
+	for iter := rs.ScanPrefixPointer(keys.New().String("user-042", keys.Asc).Key().UnsafePointer()); iter.Next(); {
+		got = append(got, string(iter.ValueBytes()))
+	}
+	if fmt.Sprint(got) != "[42 142 242 342 442]" {
+		panic(fmt.Sprint(got))
+	}
+	if ri.Stats() != wantInts || rs.Stats() != wantStrs {
+		panic(fmt.Sprint(ri.Stats(), rs.Stats()))
+	}
+	if err := ri.Verify(); err != nil {
+		panic(err)
+	}
+	if err := rs.Verify(); err != nil {
+		panic(err)
+	}
+
+	// 映射确实是只读的：写入会出错（这里把错误转为 panic 检查）
+	func() {
+		defer debug.SetPanicOnFault(debug.SetPanicOnFault(true))
+		defer func() {
+			if recover() == nil {
+				panic("mapping is writable")
+			}
+		}()
+		*(*byte)(reader.Pointer(ints.MetaLocation())) = 0
+	}()
+}
@@ -0,0 +1,52 @@
+package bptree
+
+import (
+	"github.com/madokast/bptree/memory"
+)
+
+// Stats 树的统计信息
+type Stats struct {
+	Height    int    // 层数，空树为 0
+	Nodes     int    // node 数目
+	Leaves    int    // 叶子节点数目
+	Entries   int    // 键值对数目
+	NodeBytes uint64 // node 占用的字节数，包括聚合值
+	KeyBytes  uint64 // 变长 key 记录的字节数，中间节点与叶子共用记录，只计算叶子中的。定长 key 为 0
+}
+
+// Stats 遍历整棵树统计信息
+func (t *Tree) Stats() Stats {
+	t.enter()
+	defer t.exit()
+	s := Stats{}
+	if t.root == nil {
+		return s
+	}
+	// 按地址逐层遍历，每次只读取一个 node
+	level := []memory.Location{t.root.selfPoint.get()}
+	for len(level) > 0 {
+		s.Height++
+		next := make([]memory.Location, 0)
+		for _, loc := range level {
+			n := t.readNode(loc)
+			s.Nodes++
+			s.NodeBytes += uint64(t.nodeSize() + t.summarySize())
+			if n.isLeaf() {
+				s.Leaves++
+				s.Entries += int(n.itemNumber.get())
+			}
+			for i := uint32(0); i < n.itemNumber.get(); i++ {
+				it := n.item(i)
+				if t.opts.varKeys && !it.isNullKey() && n.isLeaf() {
+					s.KeyBytes += uint64(varKeyHeaderSz + varKeyLength(t.keyPointer(it)))
+				}
+				if !n.isLeaf() {
+					next = append(next, it.valueLoc)
+				}
+			}
+			t.releaseNode(n)
+		}
+		level = next
+	}
+	return s
+}
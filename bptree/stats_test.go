@@ -0,0 +1,134 @@
+package bptree
+
+import (
+	"encoding/binary"
+	"fmt"
+	"github.com/madokast/bptree/memory"
+	"math/rand"
+	"sort"
+	"strings"
+	"testing"
+	"unsafe"
+)
+
+// rawKey 按字节序比较的变长 key 记录 [长度][数据]
+func rawKey(s string) []byte {
+	k := make([]byte, int(varKeyHeaderSz)+len(s))
+	binary.LittleEndian.PutUint32(k, uint32(len(s)))
+	copy(k[varKeyHeaderSz:], s)
+	return k
+}
+
+func rawString(p unsafe.Pointer) string {
+	return string(varKeyBytes(p))
+}
+
+func urlKey(r *rand.Rand) string {
+	hosts := []string{"https://www.example.com", "https://blog.example.com", "https://static.example.org"}
+	return fmt.Sprintf("%s/articles/%04d/%02d/post-%06d.html", hosts[r.Intn(len(hosts))], 2000+r.Intn(20), 1+r.Intn(12), r.Intn(1000000))
+}
+
+func TestURLKeys(t *testing.T) {
+	for temp := 0; temp < 20; temp++ {
+		r := rand.New(rand.NewSource(int64(temp)))
+		in := memory.NewInstrumented(memory.New(1 << 16))
+		tree := New(in, nil, WithKeyType(KeyBytes), WithVarKeys(), WithDegree(8))
+		m := map[string]int64{}
+		for i := int64(0); i < 300; i++ {
+			s := urlKey(r)
+			if _, ok := m[s]; !ok {
+				m[s] = i
+			}
+			value := new(int64)
+			*value = m[s]
+			tree.InsertPointer(unsafe.Pointer(&rawKey(s)[0]), unsafe.Pointer(value), 8)
+		}
+		// 中间节点与叶子共用 key 记录，分裂不分配新的 key
+		if k := in.Stats(memory.TagKey); k.Calls != uint64(len(m)) {
+			panic(fmt.Sprint(k, len(m)))
+		}
+
+		for s, v := range m {
+			exist, value := tree.FindPointer(unsafe.Pointer(&rawKey(s)[0]))
+			if !exist || *(*int64)(value) != v {
+				panic(s)
+			}
+		}
+		if exist, _ := tree.FindPointer(unsafe.Pointer(&rawKey("https://www.example.com/")[0])); exist {
+			panic(exist)
+		}
+
+		want := make([]string, 0, len(m))
+		for s := range m {
+			want = append(want, s)
+		}
+		sort.Strings(want)
+		got := make([]string, 0, len(m))
+		for iter := tree.Scan(); iter.Next(); {
+			got = append(got, string(varKeyBytes(iter.KeyPointer())))
+		}
+		if fmt.Sprint(got) != fmt.Sprint(want) {
+			panic(fmt.Sprint(got))
+		}
+
+		prefix := "https://blog.example.com/articles/2005/"
+		count := 0
+		for iter := tree.ScanPrefixPointer(unsafe.Pointer(&rawKey(prefix)[0])); iter.Next(); count++ {
+			if !strings.HasPrefix(string(varKeyBytes(iter.KeyPointer())), prefix) {
+				panic(string(varKeyBytes(iter.KeyPointer())))
+			}
+		}
+		for _, s := range want {
+			if strings.HasPrefix(s, prefix) {
+				count--
+			}
+		}
+		if count != 0 || tree.Stats().Entries != len(m) {
+			panic(count)
+		}
+		if err := tree.Verify(); err != nil {
+			panic(err)
+		}
+	}
+}
+
+func TestStats(t *testing.T) {
+	directory := memory.New(1024)
+	tree := New(directory, nil, int64Keys)
+	if s := tree.Stats(); s != (Stats{}) {
+		panic(fmt.Sprint(s))
+	}
+	for i := int64(0); i < 10; i++ {
+		*key = i
+		tree.InsertPointer(unsafe.Pointer(key), nil, 0)
+	}
+	s := tree.Stats()
+	if s.Entries != 10 || s.Leaves != 5 || s.Height != 3 || s.Nodes != 8 || s.KeyBytes != 0 || s.NodeBytes != uint64(s.Nodes)*uint64(tree.nodeSize()) {
+		panic(fmt.Sprint(s))
+	}
+}
+
+func TestInstrumentedTags(t *testing.T) {
+	in := memory.NewInstrumented(memory.New(1 << 12))
+	tree := New(in, nil, WithKeyType(KeyBytes), WithVarKeys())
+	for i := int64(0); i < 200; i++ {
+		*key = i
+		tree.InsertPointer(varKeyOf(i), unsafe.Pointer(key), 8)
+	}
+	t.Log(in)
+
+	s := tree.Stats()
+	if node := in.Stats(memory.TagNode); node.Calls != uint64(s.Nodes) || node.Bytes != s.NodeBytes {
+		panic(fmt.Sprint(node, s))
+	}
+	if value := in.Stats(memory.TagValue); value.Calls != 200 || value.Bytes != 200*(8+uint64(valueHeaderSz)) {
+		panic(fmt.Sprint(value))
+	}
+	// 只有叶子中的 key，中间节点共用同一份记录
+	if k := in.Stats(memory.TagKey); k.Calls != 200 || k.Bytes != s.KeyBytes {
+		panic(fmt.Sprint(k, s))
+	}
+	if meta := in.Stats(memory.TagMeta); meta.Calls != 1 || in.Stats(memory.TagUnknown).Calls != 0 {
+		panic(in.String())
+	}
+}
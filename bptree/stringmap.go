@@ -0,0 +1,190 @@
+package bptree
+
+import (
+	"encoding/binary"
+	"errors"
+	"github.com/madokast/bptree/memory"
+	"unsafe"
+)
+
+/**
+StringMap
+string key 先 hash 到 uint64 作为 Tree 的 key，hash 相同的键值对保存在同一个桶中，桶就是 Tree 的 value：
+[key 长度 uint32][value 长度 uint32][key][value] [key 长度 uint32][value 长度 uint32][key][value] ...
+桶不可修改，Put、Delete 时写入新的桶覆盖旧的（内存只分配，不释放）。
+hash 的 seed 保存在 null key 对应的 value 中，重新打开时读出
+*/
+
+const (
+	stringMapMagic    = uint32(0x_57_12_1A_90)
+	stringMapEntrySz  = 8 // 桶中每个键值对的头部长度
+	stringMapHeaderSz = 16
+)
+
+var ErrNotStringMap = errors.New("bptree: not a string map")
+
+// StringMap string 到 []byte 的 map，按 key 精确匹配
+type StringMap struct {
+	tree *Tree
+	seed uint64
+	hash *uint64 // 当前 key 的 hash，放在堆上传给 tree
+	// hashFunc 默认为 stringHash，测试时替换以制造冲突
+	hashFunc func(s string, seed uint64) uint64
+}
+
+// NewStringMap 在 dir 中新建一个 StringMap，seed 决定 hash 函数
+func NewStringMap(dir memory.MemManager, seed uint64) *StringMap {
+	m := &StringMap{
+		tree:     New(dir, nil, WithKeyType(KeyUint64)),
+		seed:     seed,
+		hash:     new(uint64),
+		hashFunc: stringHash,
+	}
+	header := make([]byte, stringMapHeaderSz)
+	binary.LittleEndian.PutUint32(header, stringMapMagic)
+	binary.LittleEndian.PutUint64(header[8:], seed)
+	m.tree.InsertPointer(nil, unsafe.Pointer(&header[0]), stringMapHeaderSz)
+	return m
+}
+
+// OpenStringMap 由 MetaLocation 重新打开 StringMap
+func OpenStringMap(dir memory.MemManager, metaLoc memory.Location) (*StringMap, error) {
+	tree, err := Open(dir, metaLoc, nil, WithKeyType(KeyUint64))
+	if err != nil {
+		return nil, err
+	}
+	iter := tree.FindAllPointer(nil)
+	if !iter.Next() || iter.ValueLength() != stringMapHeaderSz {
+		return nil, ErrNotStringMap
+	}
+	header := iter.ValueBytes()
+	if binary.LittleEndian.Uint32(header) != stringMapMagic {
+		return nil, ErrNotStringMap
+	}
+	return &StringMap{
+		tree:     tree,
+		seed:     binary.LittleEndian.Uint64(header[8:]),
+		hash:     new(uint64),
+		hashFunc: stringHash,
+	}, nil
+}
+
+// MetaLocation 底层 Tree 的元数据地址，用于 OpenStringMap
+func (m *StringMap) MetaLocation() memory.Location {
+	return m.tree.MetaLocation()
+}
+
+// Put 插入或者更新 key
+func (m *StringMap) Put(key string, value []byte) {
+	bucket := m.bucket(key)
+	newBucket := make([]byte, 0, len(bucket)+stringMapEntrySz+len(key)+len(value))
+	forEachEntry(bucket, func(k, v []byte) bool {
+		if string(k) != key {
+			newBucket = appendEntry(newBucket, k, v)
+		}
+		return true
+	})
+	newBucket = appendEntry(newBucket, []byte(key), value)
+	m.tree.InsertPointer(unsafe.Pointer(m.hash), unsafe.Pointer(&newBucket[0]), uint32(len(newBucket)))
+}
+
+// Get 查找 key，返回 value 的副本
+func (m *StringMap) Get(key string) (value []byte, ok bool) {
+	forEachEntry(m.bucket(key), func(k, v []byte) bool {
+		if string(k) == key {
+			value, ok = append(make([]byte, 0, len(v)), v...), true
+			return false
+		}
+		return true
+	})
+	return value, ok
+}
+
+// Delete 删除 key，返回 key 是否存在
+func (m *StringMap) Delete(key string) bool {
+	bucket := m.bucket(key)
+	newBucket := make([]byte, 0, len(bucket))
+	found := false
+	forEachEntry(bucket, func(k, v []byte) bool {
+		if string(k) == key {
+			found = true
+		} else {
+			newBucket = appendEntry(newBucket, k, v)
+		}
+		return true
+	})
+	if !found {
+		return false
+	}
+
+	hash := unsafe.Pointer(m.hash)
+	if len(newBucket) == 0 {
+		m.tree.DeleteOnePointer(hash, unsafe.Pointer(&bucket[0]), uint32(len(bucket)))
+	} else {
+		m.tree.InsertPointer(hash, unsafe.Pointer(&newBucket[0]), uint32(len(newBucket)))
+	}
+	return true
+}
+
+// Range 遍历所有键值对，顺序由 hash 决定。f 返回 false 时停止。遍历期间不能修改
+// f 中的 value 直接指向内存，不能修改，需要保留时自行复制
+func (m *StringMap) Range(f func(key string, value []byte) bool) {
+	iter := m.tree.Scan()
+	for iter.Next() {
+		if iter.KeyPointer() == nil { // seed
+			continue
+		}
+		goon := true
+		forEachEntry(iter.ValueBytes(), func(k, v []byte) bool {
+			goon = f(string(k), v)
+			return goon
+		})
+		if !goon {
+			return
+		}
+	}
+}
+
+// bucket 计算 key 的 hash 写入 m.hash，返回 hash 对应的桶，不存在返回 nil
+func (m *StringMap) bucket(key string) []byte {
+	*m.hash = m.hashFunc(key, m.seed)
+	iter := m.tree.FindAllPointer(unsafe.Pointer(m.hash))
+	if !iter.Next() {
+		return nil
+	}
+	return iter.ValueBytes()
+}
+
+func forEachEntry(bucket []byte, f func(k, v []byte) bool) {
+	for len(bucket) > 0 {
+		kl := binary.LittleEndian.Uint32(bucket)
+		vl := binary.LittleEndian.Uint32(bucket[4:])
+		bucket = bucket[stringMapEntrySz:]
+		if !f(bucket[:kl], bucket[kl:kl+vl]) {
+			return
+		}
+		bucket = bucket[kl+vl:]
+	}
+}
+
+func appendEntry(bucket []byte, k, v []byte) []byte {
+	bucket = binary.LittleEndian.AppendUint32(bucket, uint32(len(k)))
+	bucket = binary.LittleEndian.AppendUint32(bucket, uint32(len(v)))
+	bucket = append(bucket, k...)
+	return append(bucket, v...)
+}
+
+// stringHash 带 seed 的 FNV-1a，最后用 splitmix64 打散
+func stringHash(s string, seed uint64) uint64 {
+	h := uint64(14695981039346656037) ^ seed
+	for i := 0; i < len(s); i++ {
+		h ^= uint64(s[i])
+		h *= 1099511628211
+	}
+	h ^= h >> 30
+	h *= 0xbf58476d1ce4e5b9
+	h ^= h >> 27
+	h *= 0x94d049bb133111eb
+	h ^= h >> 31
+	return h
+}
@@ -0,0 +1,113 @@
+package bptree
+
+import (
+	"fmt"
+	"github.com/madokast/bptree/memory"
+	"math/rand"
+	"sort"
+	"strconv"
+	"testing"
+)
+
+func checkStringMap(m *StringMap, want map[string]string) {
+	for k, v := range want {
+		got, ok := m.Get(k)
+		if !ok || string(got) != v {
+			panic(fmt.Sprintf("%q: %q %v, want %q", k, got, ok, v))
+		}
+	}
+	got := map[string]string{}
+	m.Range(func(key string, value []byte) bool {
+		if _, ok := got[key]; ok {
+			panic("duplicate " + key)
+		}
+		got[key] = string(value)
+		return true
+	})
+	if fmt.Sprint(got) != fmt.Sprint(want) {
+		panic(fmt.Sprint(got, want))
+	}
+}
+
+func TestStringMap(t *testing.T) {
+	directory := memory.New(1024)
+	m := NewStringMap(directory, 42)
+	want := map[string]string{}
+	for i := 0; i < 1000; i++ {
+		k := strconv.Itoa(rand.Intn(200))
+		switch rand.Intn(3) {
+		case 0:
+			_, ok := want[k]
+			if m.Delete(k) != ok {
+				panic(k)
+			}
+			delete(want, k)
+		default:
+			v := strconv.Itoa(i)
+			m.Put(k, []byte(v))
+			want[k] = v
+		}
+	}
+	checkStringMap(m, want)
+
+	if _, ok := m.Get("not exist"); ok {
+		panic("not exist")
+	}
+	m.Put("", nil)
+	want[""] = ""
+	checkStringMap(m, want)
+
+	reopen, err := OpenStringMap(directory, m.MetaLocation())
+	if err != nil {
+		panic(err)
+	}
+	if reopen.seed != 42 {
+		panic(reopen.seed)
+	}
+	checkStringMap(reopen, want)
+}
+
+func TestStringMapCollision(t *testing.T) {
+	directory := memory.New(1 << 16) // 桶比较大
+	m := NewStringMap(directory, 0)
+	// 长度相同的 key 全部冲突
+	m.hashFunc = func(s string, seed uint64) uint64 { return uint64(len(s)) }
+	want := map[string]string{}
+	for i := 0; i < 300; i++ {
+		k := strconv.Itoa(rand.Intn(100))
+		v := strconv.Itoa(i)
+		m.Put(k, []byte(v))
+		want[k] = v
+	}
+	checkStringMap(m, want)
+
+	keys := make([]string, 0)
+	for k := range want {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+	for _, k := range keys[:len(keys)/2] {
+		if !m.Delete(k) {
+			panic(k)
+		}
+		delete(want, k)
+	}
+	checkStringMap(m, want)
+	for _, k := range keys[len(keys)/2:] {
+		if !m.Delete(k) {
+			panic(k)
+		}
+	}
+	checkStringMap(m, map[string]string{})
+	if exist, _ := m.tree.Find(0); !exist {
+		panic("seed deleted")
+	}
+}
+
+func TestOpenStringMapOnTree(t *testing.T) {
+	directory := memory.New(1024)
+	tree := New(directory, nil, WithKeyType(KeyUint64))
+	if _, err := OpenStringMap(directory, tree.MetaLocation()); err != ErrNotStringMap {
+		panic(err)
+	}
+}
@@ -0,0 +1,235 @@
+package bptree
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"github.com/madokast/bptree/memory"
+	"unsafe"
+)
+
+/**
+一致性检查
+Verify 遍历整棵树，检查 B+树的不变量，供测试和排查问题使用：
+1. 元数据中的根节点地址与 root 一致
+2. node 的 magic、版本、模式、item 数目、父指针正确，叶子都在同一层
+3. 每层 node 的兄弟指针按顺序串联
+4. 节点内 key 有序（非 multimap 的叶子严格递增），子树中的 key 都落在父节点 item 划定的区间内
+5. 配置了聚合器时，聚合值与重新计算的结果一致
+6. 开启了校验和时，每个 node 和 value 的校验和正确，不论 ChecksumMode，失败时返回 *ChecksumError
+dir 实现了 memory.Bounded 时，读取 node、变长 key 和 value 之前先检查地址，损坏的数据不会导致读到分配之外的内存
+*/
+
+var ErrCorrupt = errors.New("bptree: corrupt tree")
+
+// Verify 检查树的不变量，发现问题返回包装了 ErrCorrupt 的错误
+func (t *Tree) Verify() (err error) {
+	t.enter()
+	defer t.exit()
+	defer func() {
+		if r := recover(); r != nil {
+			if e, ok := r.(*ChecksumError); ok {
+				err = e
+				return
+			}
+			err = fmt.Errorf("%w: %v", ErrCorrupt, r)
+		}
+	}()
+	if !contains(t.dir, t.metaPoint, metaSz) {
+		return fmt.Errorf("%w: bad meta location %v", ErrCorrupt, t.metaPoint)
+	}
+	m := t.meta()
+	if m.magic.get() != metaMagic {
+		return fmt.Errorf("%w: bad meta magic %x", ErrCorrupt, m.magic.get())
+	}
+	if m.version.get() != formatVersion {
+		return fmt.Errorf("%w: meta version %d, want %d", ErrCorrupt, m.version.get(), formatVersion)
+	}
+	if t.root == nil {
+		if m.rootPoint.get().BlockId != nullBlockBidFlag {
+			return fmt.Errorf("%w: meta root %v, tree is empty", ErrCorrupt, m.rootPoint.get())
+		}
+		return nil
+	}
+	if !contains(t.dir, m.rootPoint.get(), t.nodeSize()+t.summarySize()+t.checksumSize()) {
+		return fmt.Errorf("%w: bad root location %v", ErrCorrupt, m.rootPoint.get())
+	}
+	if t.opts.checksums {
+		if err := t.checkNode(m.rootPoint.get(), t.nodeAt(m.rootPoint.get())); err != nil {
+			return err
+		}
+	}
+	if m.rootPoint.get() != t.root.selfPoint.get() {
+		return fmt.Errorf("%w: meta root %v, root %v", ErrCorrupt, m.rootPoint.get(), t.root.selfPoint.get())
+	}
+	if t.root.fatherPoint.get().BlockId != nullBlockBidFlag || t.root.mode&modeRoot == 0 {
+		return fmt.Errorf("%w: root %v has father or is not root", ErrCorrupt, t.root.selfPoint.get())
+	}
+
+	v := verifier{t: t, visited: map[memory.Location]bool{}}
+	if err := v.node(t.root, 0, nil, nil); err != nil {
+		return err
+	}
+	for depth, level := range v.levels {
+		for i, n := range level {
+			if n.leaf != (depth == len(v.levels)-1) {
+				return fmt.Errorf("%w: node %v at depth %d, leaves at depth %d", ErrCorrupt, n.self, depth, len(v.levels)-1)
+			}
+			if i+1 < len(level) {
+				if n.next != level[i+1].self {
+					return fmt.Errorf("%w: node %v next %v, want %v", ErrCorrupt, n.self, n.next, level[i+1].self)
+				}
+			} else if n.next.BlockId != nullBlockBidFlag {
+				return fmt.Errorf("%w: last node %v at depth %d has next %v", ErrCorrupt, n.self, depth, n.next)
+			}
+		}
+	}
+	return nil
+}
+
+type verifier struct {
+	t       *Tree
+	levels  [][]levelNode // 每层的 node，从左到右
+	visited map[memory.Location]bool
+	// 重算聚合值的临时空间
+	summary, tmp []byte
+}
+
+// levelNode 层间检查需要的 node 信息。检查完子树之后 node 已经释放，不能保留指针
+type levelNode struct {
+	self, next memory.Location
+	leaf       bool
+}
+
+// node 检查以 n 为根的子树。子树中的 key 都应当不大于 high，且大于 low（multimap 时不小于 low）。nil 表示无界
+func (v *verifier) node(n *node, depth int, low, high *item) error {
+	t := v.t
+	if v.visited[n.selfPoint.get()] {
+		return fmt.Errorf("%w: node %v is referenced twice", ErrCorrupt, n.selfPoint.get())
+	}
+	v.visited[n.selfPoint.get()] = true
+
+	if n.magic.get() != nodeMagic || uint16(n.version) != formatVersion {
+		return fmt.Errorf("%w: node %v bad magic %x version %d", ErrCorrupt, n.selfPoint.get(), n.magic.get(), n.version)
+	}
+	leafMode, midMode := modeLeaf, modeMid
+	if n.selfPoint.get() == t.root.selfPoint.get() {
+		leafMode, midMode = modeRoot|modeLeaf, modeRoot
+	}
+	if n.mode != leafMode && n.mode != midMode {
+		return fmt.Errorf("%w: node %v bad mode %b", ErrCorrupt, n.selfPoint.get(), n.mode)
+	}
+	if depth == len(v.levels) {
+		v.levels = append(v.levels, nil)
+	}
+	v.levels[depth] = append(v.levels[depth], levelNode{self: n.selfPoint.get(), next: n.nextPoint.get(), leaf: n.isLeaf()})
+	if n.itemNumber.get() > t.opts.degree {
+		return fmt.Errorf("%w: node %v has %d items, degree %d", ErrCorrupt, n.selfPoint.get(), n.itemNumber.get(), t.opts.degree)
+	}
+	if !n.isLeaf() && n.itemNumber.get() == 0 {
+		return fmt.Errorf("%w: inner node %v has no item", ErrCorrupt, n.selfPoint.get())
+	}
+
+	for i := uint32(0); i < n.itemNumber.get(); i++ {
+		it := n.item(i)
+		if it.null != nullKeyFlag && it.null != notNullKeyFlag {
+			return fmt.Errorf("%w: node %v item %d bad null flag %d", ErrCorrupt, n.selfPoint.get(), i, it.null)
+		}
+		if t.opts.varKeys && !it.isNullKey() {
+			loc := *(*memory.Location)(unsafe.Pointer(&it.key))
+			if !contains(t.dir, loc, varKeyHeaderSz) || !contains(t.dir, loc, varKeyHeaderSz+varKeyLength(memory.Pointer(t.dir, loc))) {
+				return fmt.Errorf("%w: node %v item %d bad key location %v", ErrCorrupt, n.selfPoint.get(), i, loc)
+			}
+		}
+		if n.isLeaf() && !it.isNullValue() {
+			loc := it.valueLoc
+			if !contains(t.dir, loc, valueHeaderSz) {
+				return fmt.Errorf("%w: node %v item %d bad value location %v", ErrCorrupt, n.selfPoint.get(), i, loc)
+			}
+			if err := v.value(n, i, loc); err != nil {
+				return err
+			}
+		}
+		k := t.keyPointer(it)
+		if low != nil {
+			c := t.compare(k, &low.key, low.null)
+			if c < 0 || (c == 0 && !t.opts.multimap) {
+				return fmt.Errorf("%w: node %v item %d is not greater than the lower separator", ErrCorrupt, n.selfPoint.get(), i)
+			}
+		}
+		if high != nil && t.compare(k, &high.key, high.null) > 0 {
+			return fmt.Errorf("%w: node %v item %d is greater than the upper separator", ErrCorrupt, n.selfPoint.get(), i)
+		}
+		if i > 0 {
+			prev := n.item(i - 1)
+			c := t.compare(k, &prev.key, prev.null)
+			if c < 0 || (c == 0 && n.isLeaf() && !t.opts.multimap) {
+				return fmt.Errorf("%w: node %v items %d and %d out of order", ErrCorrupt, n.selfPoint.get(), i-1, i)
+			}
+		}
+	}
+
+	if !n.isLeaf() {
+		for i := uint32(0); i < n.itemNumber.get(); i++ {
+			loc := n.item(i).valueLoc
+			if loc.BlockId == nullBlockBidFlag || !contains(t.dir, loc, t.nodeSize()+t.summarySize()+t.checksumSize()) {
+				return fmt.Errorf("%w: node %v item %d bad child location %v", ErrCorrupt, n.selfPoint.get(), i, loc)
+			}
+			// 自己校验，校验失败时返回错误而不是像 readNode 那样 panic
+			child := t.pinNode(loc)
+			if t.opts.checksums {
+				if err := t.checkNode(loc, child); err != nil {
+					return err
+				}
+			}
+			if child.selfPoint.get() != n.item(i).valueLoc {
+				return fmt.Errorf("%w: node %v item %d points to %v, whose self is %v", ErrCorrupt, n.selfPoint.get(), i, n.item(i).valueLoc, child.selfPoint.get())
+			}
+			if child.fatherPoint.get() != n.selfPoint.get() {
+				return fmt.Errorf("%w: node %v father %v, want %v", ErrCorrupt, child.selfPoint.get(), child.fatherPoint.get(), n.selfPoint.get())
+			}
+			childLow := low
+			if i > 0 {
+				childLow = n.item(i - 1)
+			}
+			// 出错时不释放，留给 exit
+			if err := v.node(child, depth+1, childLow, n.item(i)); err != nil {
+				return err
+			}
+			t.releaseNode(child)
+		}
+	}
+
+	if t.opts.aggregator != nil {
+		if v.summary == nil {
+			v.summary, v.tmp = make([]byte, t.summarySize()), make([]byte, t.summarySize())
+		}
+		if len(v.summary) > 0 {
+			t.computeSummary(n, unsafe.Pointer(&v.summary[0]), unsafe.Pointer(&v.tmp[0]))
+			if !bytes.Equal(v.summary, unsafe.Slice((*byte)(unsafe.Pointer(t.summaryOf(n))), len(v.summary))) {
+				return fmt.Errorf("%w: node %v stale summary", ErrCorrupt, n.selfPoint.get())
+			}
+		}
+	}
+	return nil
+}
+
+// value 检查 n 的第 i 个 item 在 loc 处的 value 记录，见 pinValue
+func (v *verifier) value(n *node, i uint32, loc memory.Location) error {
+	t := v.t
+	record := t.pinValue(loc)
+	defer t.releaseValue(loc)
+	if !contains(t.dir, loc, valueHeaderSz+recordLength(record)) {
+		return fmt.Errorf("%w: node %v item %d bad value location %v", ErrCorrupt, n.selfPoint.get(), i, loc)
+	}
+	if t.opts.valueChecksums {
+		return t.checkValue(loc, record)
+	}
+	return nil
+}
+
+// contains loc 开始的 size 大小的内存是否已经分配。dir 没有实现 memory.Bounded 时无法判断，认为已分配
+func contains(dir memory.MemManager, loc memory.Location, size uint32) bool {
+	b, ok := dir.(memory.Bounded)
+	return !ok || b.Contains(loc, size)
+}
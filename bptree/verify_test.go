@@ -0,0 +1,347 @@
+package bptree
+
+import (
+	"errors"
+	"fmt"
+	"github.com/madokast/bptree/memory"
+	"math/rand"
+	"sort"
+	"testing"
+	"unsafe"
+)
+
+/*
+基于模型的随机测试
+随机的操作序列同时作用于树和参考模型（map + 排序后的 key），每一步之后对比结果并调用 Verify。
+失败时删除不影响失败的操作，把序列缩小后再报告。FuzzTree 把字节串解码为操作序列，用于 go test -fuzz
+*/
+
+type opKind byte
+
+const (
+	opInsert opKind = iota
+	opFind
+	opScan
+	opDelete
+	opKinds
+)
+
+type op struct {
+	kind      opKind
+	key       int64
+	nullKey   bool
+	value     int64
+	nullValue bool
+}
+
+func (o op) String() string {
+	k, v := fmt.Sprint(o.key), fmt.Sprint(o.value)
+	if o.nullKey {
+		k = nullStr
+	}
+	if o.nullValue {
+		v = nullStr
+	}
+	switch o.kind {
+	case opInsert:
+		return "insert(" + k + "," + v + ")"
+	case opFind:
+		return "find(" + k + ")"
+	case opScan:
+		return "scan"
+	default:
+		return "delete(" + k + "," + v + ")"
+	}
+}
+
+type harnessConfig struct {
+	name string
+	opts []Option
+}
+
+var harnessConfigs = []harnessConfig{
+	{"default", nil},
+	{"multimap", []Option{WithMultimap(), WithDegree(4)}},
+	{"aggregate", []Option{WithPointerAggregator(Int64StatsAggregator{}), WithDegree(5)}},
+	{"nullsLast", []Option{WithNullOrder(NullsLast), WithDescending(), WithMultimap()}},
+	{"checksums", []Option{WithChecksums(ChecksumAlways), WithValueChecksums(), WithPointerAggregator(Int64StatsAggregator{}), WithDegree(4)}},
+}
+
+type modelKey struct {
+	null bool
+	k    int64
+}
+
+// model 参考实现。每个 key 的 value 按插入顺序保存，nil 表示 null value
+type model struct {
+	opts options
+	m    map[modelKey][]*int64
+}
+
+// sortedKeys 按树的排序规则排好的 key
+func (m *model) sortedKeys() []modelKey {
+	ks := make([]modelKey, 0, len(m.m))
+	for k := range m.m {
+		ks = append(ks, k)
+	}
+	sort.Slice(ks, func(i, j int) bool {
+		a, b := ks[i], ks[j]
+		if a.null || b.null {
+			if m.opts.nullOrder == NullsLast {
+				return b.null && !a.null
+			}
+			return a.null && !b.null
+		}
+		if m.opts.descending {
+			return a.k > b.k
+		}
+		return a.k < b.k
+	})
+	return ks
+}
+
+func sameValue(p unsafe.Pointer, v *int64) bool {
+	if p == nil || v == nil {
+		return p == nil && v == nil
+	}
+	return *(*int64)(p) == *v
+}
+
+func valueString(v *int64) string {
+	if v == nil {
+		return nullStr
+	}
+	return fmt.Sprint(*v)
+}
+
+// runOps 在新树上执行 ops，返回第一个与模型不一致或者 Verify 失败的错误
+func runOps(opts []Option, ops []op) (err error) {
+	step := -1
+	defer func() {
+		if r := recover(); r != nil {
+			err = fmt.Errorf("step %d %v: panic: %v", step, ops[step], r)
+		}
+	}()
+
+	tree := New(memory.New(1<<12), nil, append([]Option{WithKeyType(KeyInt64)}, opts...)...)
+	m := &model{opts: tree.opts, m: map[modelKey][]*int64{}}
+	for i, o := range ops {
+		step = i
+		if err := applyOp(tree, m, o); err != nil {
+			return fmt.Errorf("step %d %v: %w", i, o, err)
+		}
+		if err := tree.Verify(); err != nil {
+			return fmt.Errorf("step %d %v: %w", i, o, err)
+		}
+	}
+	return nil
+}
+
+func applyOp(tree *Tree, m *model, o op) error {
+	k := unsafe.Pointer(nil)
+	if !o.nullKey {
+		*key = o.key
+		k = unsafe.Pointer(key)
+	}
+	v, vLen, want := unsafe.Pointer(nil), uint32(0), (*int64)(nil)
+	if !o.nullValue {
+		*key2 = o.value
+		v, vLen, want = unsafe.Pointer(key2), 8, &o.value
+	}
+	mk := modelKey{null: o.nullKey, k: o.key}
+	if o.nullKey {
+		mk.k = 0
+	}
+
+	switch o.kind {
+	case opInsert:
+		tree.InsertPointer(k, v, vLen)
+		if want != nil {
+			w := *want
+			want = &w
+		}
+		if tree.opts.multimap {
+			m.m[mk] = append(m.m[mk], want)
+		} else {
+			m.m[mk] = []*int64{want}
+		}
+	case opFind:
+		exist, value := tree.FindPointer(k)
+		vs := m.m[mk]
+		if exist != (len(vs) > 0) || (exist && !sameValue(value, vs[0])) {
+			return fmt.Errorf("find got %v, want %v", exist, len(vs) > 0)
+		}
+	case opScan:
+		iter := tree.Scan()
+		for _, mk := range m.sortedKeys() {
+			for _, want := range m.m[mk] {
+				if !iter.Next() {
+					return fmt.Errorf("scan ends before %v", mk)
+				}
+				if (iter.KeyPointer() == nil) != mk.null || (!mk.null && *(*int64)(iter.KeyPointer()) != mk.k) || !sameValue(iter.ValuePointer(), want) {
+					return fmt.Errorf("scan got a different pair, want %v:%s", mk, valueString(want))
+				}
+			}
+		}
+		if iter.Next() {
+			return errors.New("scan has extra pairs")
+		}
+	case opDelete:
+		deleted := tree.DeleteOnePointer(k, v, vLen)
+		vs := m.m[mk]
+		found := false
+		for i := range vs {
+			if sameValue(v, vs[i]) {
+				m.m[mk] = append(vs[:i:i], vs[i+1:]...)
+				if len(m.m[mk]) == 0 {
+					delete(m.m, mk)
+				}
+				found = true
+				break
+			}
+		}
+		if deleted != found {
+			return fmt.Errorf("delete got %v, want %v", deleted, found)
+		}
+	}
+	return nil
+}
+
+// randomOps 随机的操作序列。key 的范围很小，保证有足够多的更新和删除
+func randomOps(r *rand.Rand, n int) []op {
+	ops := make([]op, n)
+	for i := range ops {
+		o := op{key: int64(r.Intn(40)) - 20, value: int64(r.Intn(5))}
+		switch x := r.Intn(10); {
+		case x < 5:
+			o.kind = opInsert
+		case x < 7:
+			o.kind = opFind
+		case x < 9:
+			o.kind = opDelete
+		default:
+			o.kind = opScan
+		}
+		o.nullKey = r.Intn(20) == 0
+		o.nullValue = r.Intn(10) == 0
+		ops[i] = o
+	}
+	return ops
+}
+
+// shrink 逐段删除操作，只要 fails 仍然返回 true 就保留删除，得到更短的失败序列
+func shrink(ops []op, fails func([]op) bool) []op {
+	for chunk := len(ops) / 2; chunk >= 1; chunk /= 2 {
+		for i := 0; i+chunk <= len(ops); {
+			candidate := append(append([]op{}, ops[:i]...), ops[i+chunk:]...)
+			if fails(candidate) {
+				ops = candidate
+			} else {
+				i += chunk
+			}
+		}
+	}
+	return ops
+}
+
+// checkOps 执行 ops，失败时缩小序列后 panic
+func checkOps(cfg harnessConfig, ops []op) {
+	err := runOps(cfg.opts, ops)
+	if err == nil {
+		return
+	}
+	shrunk := shrink(ops, func(ops []op) bool { return runOps(cfg.opts, ops) != nil })
+	panic(fmt.Sprintf("%s: %v\nshrunk to %d ops: %v\n%v", cfg.name, err, len(shrunk), shrunk, runOps(cfg.opts, shrunk)))
+}
+
+func TestModelRandom(t *testing.T) {
+	for _, cfg := range harnessConfigs {
+		for seed := int64(0); seed < 100; seed++ {
+			checkOps(cfg, randomOps(rand.New(rand.NewSource(seed)), 300))
+		}
+	}
+}
+
+func TestShrink(t *testing.T) {
+	ops := randomOps(rand.New(rand.NewSource(1)), 200)
+	ops[50] = op{kind: opInsert, key: 100}
+	ops[150] = op{kind: opDelete, key: 100}
+	// 同时包含 insert(100) 和之后的 delete(100) 才失败
+	fails := func(ops []op) bool {
+		inserted := false
+		for _, o := range ops {
+			inserted = inserted || (o.kind == opInsert && o.key == 100)
+			if inserted && o.kind == opDelete && o.key == 100 {
+				return true
+			}
+		}
+		return false
+	}
+	shrunk := shrink(ops, fails)
+	if fmt.Sprint(shrunk) != "[insert(100,0) delete(100,0)]" {
+		panic(fmt.Sprint(shrunk))
+	}
+}
+
+func TestVerifyCorrupt(t *testing.T) {
+	tree := New(memory.New(1024), nil, int64Keys)
+	insertKeys(tree, 1, 2, 3, 4, 5, 6, 7)
+	if err := tree.Verify(); err != nil {
+		panic(err)
+	}
+
+	// 交换叶子中的两个 key
+	leaf := tree.firstLeaf()
+	*leaf.item(0), *leaf.item(1) = *leaf.item(1), *leaf.item(0)
+	if err := tree.Verify(); !errors.Is(err, ErrCorrupt) {
+		panic(err)
+	}
+	*leaf.item(0), *leaf.item(1) = *leaf.item(1), *leaf.item(0)
+
+	// 破坏兄弟指针
+	next := leaf.nextPoint.get()
+	leaf.nextPoint.set(memory.Location{BlockId: nullBlockBidFlag})
+	if err := tree.Verify(); !errors.Is(err, ErrCorrupt) {
+		panic(err)
+	}
+	leaf.nextPoint.set(next)
+
+	// 超过度
+	leaf.itemNumber.set(4)
+	if err := tree.Verify(); !errors.Is(err, ErrCorrupt) {
+		panic(err)
+	}
+}
+
+// decodeOps 把字节串解码为配置和操作序列，每 4 个字节一个操作
+func decodeOps(data []byte) (harnessConfig, []op) {
+	if len(data) == 0 {
+		return harnessConfigs[0], nil
+	}
+	cfg := harnessConfigs[int(data[0])%len(harnessConfigs)]
+	data = data[1:]
+	ops := make([]op, 0, len(data)/4)
+	for ; len(data) >= 4; data = data[4:] {
+		ops = append(ops, op{
+			kind:      opKind(data[0]) % opKinds,
+			key:       int64(data[1]%40) - 20,
+			nullKey:   data[2]&0x0F == 0,
+			nullValue: data[2]&0xF0 == 0,
+			value:     int64(data[3] % 5),
+		})
+	}
+	return cfg, ops
+}
+
+func FuzzTree(f *testing.F) {
+	for seed := int64(0); seed < 8; seed++ {
+		r := rand.New(rand.NewSource(seed))
+		data := make([]byte, 1+4*50)
+		r.Read(data)
+		f.Add(data)
+	}
+	f.Fuzz(func(t *testing.T, data []byte) {
+		cfg, ops := decodeOps(data)
+		checkOps(cfg, ops)
+	})
+}
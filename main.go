@@ -1,16 +1,19 @@
 package main
 
 import (
+	"encoding/binary"
 	"fmt"
 	"github.com/madokast/bptree/bptree"
 	"github.com/madokast/bptree/memory"
-	"reflect"
+	"math"
 	"unsafe"
 )
 
 func main() {
 	mem := memory.New(1024)
-	tree := bptree.New(mem, keyComp)
+	// key 为 int64 和 float64 的两棵树，使用内置的比较函数
+	tree := bptree.New(mem, nil, bptree.WithKeyType(bptree.KeyInt64))
+	floatTree := bptree.New(mem, nil, bptree.WithKeyType(bptree.KeyFloat64))
 
 	// 插入 123 -> 321
 	{
@@ -19,58 +22,35 @@ func main() {
 		*key = 123
 		*val = 321
 
-		tree.Insert(uintptr(unsafe.Pointer(key)), uintptr(unsafe.Pointer(val)), uint32(unsafe.Sizeof(*val)))
+		tree.InsertPointer(unsafe.Pointer(key), unsafe.Pointer(val), uint32(unsafe.Sizeof(*val)))
 	}
 
-	// 插入 3.14 -> "hello, world"
+	// 插入 3.14 -> "hello, world"，使用 []byte 接口，定长 key 为 8 bytes 的小端表示
 	{
-		key := new(float64)
-		val := []byte("hello, world")
-		*key = 3.14
-
-		valPointer := ((*reflect.SliceHeader)(unsafe.Pointer(&val))).Data
-
-		tree.Insert(uintptr(unsafe.Pointer(key)), valPointer, uint32(len(val)))
+		key := binary.LittleEndian.AppendUint64(nil, math.Float64bits(3.14))
+		floatTree.InsertBytes(key, []byte("hello, world"))
 	}
 
 	// 查找 123
 	{
 		key := new(int64)
 		*key = 123
-		exist, valuePointer := tree.Find(uintptr(unsafe.Pointer(key)))
+		exist, valuePointer := tree.FindPointer(unsafe.Pointer(key))
 		if exist {
-			value := *((*int64)(unsafe.Pointer(valuePointer)))
+			value := *((*int64)(valuePointer))
 			fmt.Println(*key, "->", value)
 		} else {
 			fmt.Println("不存在", *key)
 		}
 	}
 
-	// 查找 3.14，需要知道 value 的长度 12
+	// 查找 3.14，返回的 value 直接指向 mem 中的内存
 	{
-		key := new(float64)
-		*key = 3.14
-		exist, valuePointer := tree.Find(uintptr(unsafe.Pointer(key)))
-		if exist {
-			value := *((*string)(unsafe.Pointer(&reflect.StringHeader{
-				Data: valuePointer,
-				Len:  12,
-			})))
-			fmt.Println(*key, "->", value)
+		key := binary.LittleEndian.AppendUint64(nil, math.Float64bits(3.14))
+		if value, exist := floatTree.GetBytes(key); exist {
+			fmt.Println(3.14, "->", string(value))
 		} else {
-			fmt.Println("不存在", *key)
+			fmt.Println("不存在", 3.14)
 		}
 	}
 }
-
-func keyComp(k1, k2 uintptr) int {
-	n1 := *((*int64)(unsafe.Pointer(k1)))
-	n2 := *((*int64)(unsafe.Pointer(k2)))
-	if n1 > n2 {
-		return 1
-	} else if n1 < n2 {
-		return -1
-	} else {
-		return 0
-	}
-}
@@ -0,0 +1,482 @@
+package memory
+
+import (
+	"bytes"
+	"container/list"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"hash/crc32"
+	"io"
+	"math"
+	"sync"
+	"unsafe"
+)
+
+/*
+页缓存
+BufferPool 不使用 mmap，内存都在文件中，以 pageSize 为单位通过 ReadAt、WriteAt 读写，只有固定数目的页（frame）缓存在 Go 堆上。
+Location.BlockId 是页号，页 i 在文件中的偏移为 i * pageSize。一次分配不跨页；超过 pageSize 的分配使用若干连续的新页（span），
+span 作为一个整体读写和缓存，占一个 frame，Location 指向它的第一页。
+1. pin：Pin 之后到 Unpin 之前，页不会被换出。Pointer、Bytes 用到的页在 Exit 之前也不会被换出，相当于到最外层 Exit 为止都 pin 住。
+   与 Tiered 一样，最外层 Exit 之后这些页在下一次 Exit 之前仍然有效。Pin 不把页留在作用域中，Unpin 之后页可以被换出，
+   因此长时间的遍历（bptree 读取 node 时）用 Pin、Unpin，经过的页不会都留在缓存中
+2. dirty：分配时页被标记为脏，之后的修改需要调用 MarkDirty（bptree 会标记修改过的 node 和元数据）。换出或者 Flush 时只写回脏页
+3. 换出：需要新的页而 frame 都在使用时，换出最久没有使用的、没有 pin 的页。所有 frame 都被 pin 住时临时增加 frame，最外层 Exit 时再减少到 frames 个
+4. Flush 写回所有脏页和分配信息，文件实现了 Sync 时再 Sync。换出时的读写错误以 ErrPageIO panic，Flush 的错误直接返回
+5. 持久化：页 0 是头页，不用于分配，保存 [magic 8 bytes][pageSize][页数][当前页][分配表所在的页][分配表的 CRC32]，都是小端 uint32。
+   分配表是每一页已分配的字节数，Flush 时写在最后一页之后，之后分配的页会覆盖它，它只在 OpenBufferPool 时读取。
+   span 的第一页已分配的字节数大于 pageSize，由此可以得到 span 的页数，不需要另外保存。
+   Flush 之后的文件可以由 OpenBufferPool 重新打开。换出时脏页就地写回，两次 Flush 之间崩溃时文件不一定一致
+6. 失效的指针：换出的页的 frame 直接给新读入的页使用，失效之后继续使用的指针指向的是另一页的数据，不会报错。
+   以 bptreedebug 构建时换出的页被填充为 poisonByte，并且不再复用，失效指针读到的都是 poisonByte
+*/
+
+var (
+	ErrPageIO = errors.New("memory: page I/O failed")
+	// ErrPoolFormat OpenBufferPool 打开的文件不是 Flush 过的 BufferPool 文件，或者头页、分配表损坏
+	ErrPoolFormat = errors.New("memory: not a buffer pool file")
+)
+
+// poolMagic 头页开头的魔数
+var poolMagic = [8]byte{'b', 'p', 't', 'p', 'o', 'o', 'l', '1'}
+
+const (
+	headerPage   = uint32(0)
+	poolHeaderSz = 28
+)
+
+// PageFile BufferPool 使用的文件，*os.File 即可
+type PageFile interface {
+	io.ReaderAt
+	io.WriterAt
+}
+
+type BufferPool struct {
+	mu       sync.Mutex
+	file     PageFile
+	pageSize uint32
+	frames   int                  // 缓存的页数
+	pages    map[uint32]*poolPage // 在缓存中的页
+	lru      list.List            // 在缓存中的页，最近使用的在前面
+	used     []uint32             // 每一页已分配的字节数，span 的第一页为整个 span 已分配的字节数，其余页为 0
+	spans    map[uint32]uint32    // span 的第一页 -> 页数
+	current  uint32               // 从这一页分配
+	depth    int                  // Enter 的嵌套层数
+	scope    uint64               // 当前作用域的编号，最外层 Enter 时增加
+	stats    PoolStats
+}
+
+type poolPage struct {
+	id        uint32
+	data      []byte
+	pins      int
+	dirty     bool
+	lastScope uint64
+	elem      *list.Element
+}
+
+// PoolStats BufferPool 的统计
+type PoolStats struct {
+	Hits, Misses uint64 // 访问时页在缓存中、不在缓存中的次数
+	Reads        uint64 // 从文件读入页的次数，新分配的页不需要读
+	Writes       uint64 // 写回脏页的次数
+	Evictions    uint64
+	Overflows    uint64 // frame 都被 pin 住而临时增加 frame 的次数
+}
+
+// NewBufferPool 以 file 为存储，缓存 frames 个 pageSize 大小的页。file 应当是空的，已有的文件用 OpenBufferPool 打开
+// pageSize 不能小于头页的大小
+func NewBufferPool(file PageFile, pageSize uint32, frames int) *BufferPool {
+	if pageSize < poolHeaderSz {
+		panic(fmt.Sprintf("memory: page size %d is smaller than %d", pageSize, poolHeaderSz))
+	}
+	p := newBufferPool(file, pageSize, frames)
+	// 头页占满，从页 1 开始分配
+	p.used = []uint32{pageSize, 0}
+	p.current = 1
+	return p
+}
+
+// OpenBufferPool 打开 Flush 过的 BufferPool 文件，页大小和分配信息从头页读取，缓存 frames 页
+func OpenBufferPool(file PageFile, frames int) (*BufferPool, error) {
+	header := make([]byte, poolHeaderSz)
+	if _, err := file.ReadAt(header, 0); errors.Is(err, io.EOF) {
+		return nil, fmt.Errorf("%w: short header", ErrPoolFormat)
+	} else if err != nil {
+		return nil, fmt.Errorf("%w: read header: %v", ErrPageIO, err)
+	}
+	if !bytes.Equal(header[:8], poolMagic[:]) {
+		return nil, fmt.Errorf("%w: bad magic %x", ErrPoolFormat, header[:8])
+	}
+	pageSize := binary.LittleEndian.Uint32(header[8:])
+	pages := binary.LittleEndian.Uint32(header[12:])
+	current := binary.LittleEndian.Uint32(header[16:])
+	tableAt := binary.LittleEndian.Uint32(header[20:])
+	if pageSize < poolHeaderSz || pages < 2 || current == headerPage || current >= pages {
+		return nil, fmt.Errorf("%w: page size %d, %d pages, current page %d", ErrPoolFormat, pageSize, pages, current)
+	}
+	table := make([]byte, 4*uint64(pages))
+	if _, err := file.ReadAt(table, int64(tableAt)*int64(pageSize)); errors.Is(err, io.EOF) {
+		return nil, fmt.Errorf("%w: short allocation table", ErrPoolFormat)
+	} else if err != nil {
+		return nil, fmt.Errorf("%w: read allocation table: %v", ErrPageIO, err)
+	}
+	if crc32.ChecksumIEEE(table) != binary.LittleEndian.Uint32(header[24:]) {
+		return nil, fmt.Errorf("%w: allocation table checksum mismatch", ErrPoolFormat)
+	}
+
+	p := newBufferPool(file, pageSize, frames)
+	p.used = make([]uint32, pages)
+	for id := range p.used {
+		p.used[id] = binary.LittleEndian.Uint32(table[4*id:])
+		if p.used[id] > pageSize {
+			p.spans[uint32(id)] = (p.used[id] + pageSize - 1) / pageSize
+		}
+	}
+	p.current = current
+	return p, nil
+}
+
+func newBufferPool(file PageFile, pageSize uint32, frames int) *BufferPool {
+	if frames < 1 {
+		frames = 1
+	}
+	return &BufferPool{file: file, pageSize: pageSize, frames: frames, pages: map[uint32]*poolPage{}, spans: map[uint32]uint32{}}
+}
+
+func (p *BufferPool) Allocate(size uint32) (loc Location, pointer uintptr) {
+	return p.AllocateAligned(size, 1)
+}
+
+// AllocateAligned 在当前页分配，放不下时使用新的一页。超过 pageSize 时分配一个 span，当前页不变。分配的页被标记为脏
+func (p *BufferPool) AllocateAligned(size, align uint32) (loc Location, pointer uintptr) {
+	checkMovableAlign(align)
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	defer p.access()()
+	if size > p.pageSize {
+		return p.allocateSpan(size)
+	}
+	offset := p.used[p.current] + padding(uintptr(p.used[p.current]), align)
+	var pg *poolPage
+	if uint64(offset)+uint64(size) > uint64(p.pageSize) {
+		if uint64(len(p.used)) >= math.MaxUint32 {
+			panic(fmt.Errorf("%w: %d pages", ErrOutOfSpace, len(p.used)))
+		}
+		p.current = uint32(len(p.used))
+		p.used = append(p.used, 0)
+		offset = 0
+		pg = p.freshPage(p.current)
+	} else {
+		pg = p.page(p.current, true)
+	}
+	p.used[p.current] = offset + size
+	pg.dirty = true
+	loc = Location{BlockId: p.current, BlockOffset: offset}
+	return loc, uintptr(unsafe.Add(unsafe.Pointer(&pg.data[0]), offset))
+}
+
+// allocateSpan 在文件末尾分配 size 大小的 span。调用者持有 p.mu
+func (p *BufferPool) allocateSpan(size uint32) (loc Location, pointer uintptr) {
+	n := (uint64(size) + uint64(p.pageSize) - 1) / uint64(p.pageSize)
+	if n*uint64(p.pageSize) > math.MaxUint32 || uint64(len(p.used))+n > math.MaxUint32 {
+		panic(fmt.Errorf("%w: span of %d bytes", ErrOutOfSpace, size))
+	}
+	id := uint32(len(p.used))
+	p.spans[id] = uint32(n)
+	p.used = append(p.used, size)
+	p.used = append(p.used, make([]uint32, n-1)...)
+	pg := p.freshPage(id)
+	pg.dirty = true
+	return Location{BlockId: id}, uintptr(unsafe.Pointer(&pg.data[0]))
+}
+
+func (p *BufferPool) PointerAt(loc Location) uintptr {
+	return uintptr(p.Pointer(loc))
+}
+
+// Pointer 页不在缓存中时先读入。返回的指针在 Exit、Unpin 之前有效，见 BufferPool
+// 失效之后页可能被换出，frame 给其他页使用，指针指向其他页的数据而不会报错
+func (p *BufferPool) Pointer(loc Location) unsafe.Pointer {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	defer p.access()()
+	return unsafe.Add(unsafe.Pointer(&p.page(loc.BlockId, true).data[0]), loc.BlockOffset)
+}
+
+// Bytes 与 Pointer 相同，返回页数据的切片
+func (p *BufferPool) Bytes(loc Location, n uint32) []byte {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	defer p.access()()
+	end := loc.BlockOffset + n
+	return p.page(loc.BlockId, true).data[loc.BlockOffset:end:end]
+}
+
+// Contains loc 开始的 size 大小的内存是否在已分配的范围内，不需要读入页
+func (p *BufferPool) Contains(loc Location, size uint32) bool {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	if loc.BlockId == headerPage || loc.BlockId >= uint32(len(p.used)) {
+		return false
+	}
+	return uint64(loc.BlockOffset)+uint64(size) <= uint64(p.used[loc.BlockId])
+}
+
+// Pin 读入 loc 所在的页，到 Unpin 之前都不会被换出，返回的指针一直有效。Pin、Unpin 需要成对调用
+// 页不计入当前作用域，Unpin 之后即使还在作用域中也可以被换出，之后指针可能指向其他页的数据，与 Pointer 相同
+func (p *BufferPool) Pin(loc Location) unsafe.Pointer {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	defer p.access()()
+	pg := p.page(loc.BlockId, false)
+	pg.pins++
+	return unsafe.Add(unsafe.Pointer(&pg.data[0]), loc.BlockOffset)
+}
+
+// Unpin 取消一次 Pin
+func (p *BufferPool) Unpin(loc Location) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	pg, ok := p.pages[loc.BlockId]
+	if !ok || pg.pins == 0 {
+		panic(fmt.Sprintf("memory: unpin page %d that is not pinned", loc.BlockId))
+	}
+	pg.pins--
+}
+
+// MarkDirty loc 所在的页被修改过，换出或者 Flush 时需要写回。页必须在缓存中，即在作用域中或者被 Pin 住
+func (p *BufferPool) MarkDirty(loc Location) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	pg, ok := p.pages[loc.BlockId]
+	if !ok {
+		panic(fmt.Sprintf("memory: mark dirty page %d that is not cached", loc.BlockId))
+	}
+	pg.dirty = true
+}
+
+// Flush 写回所有脏页，再写分配表和头页，之后可以由 OpenBufferPool 重新打开。文件实现了 Sync() error 时，写头页之前和之后都 Sync
+func (p *BufferPool) Flush() error {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	for _, pg := range p.pages {
+		if err := p.writeBack(pg); err != nil {
+			return err
+		}
+	}
+	table := make([]byte, 4*len(p.used))
+	for id, used := range p.used {
+		binary.LittleEndian.PutUint32(table[4*id:], used)
+	}
+	tableAt := uint32(len(p.used))
+	if _, err := p.file.WriteAt(table, int64(tableAt)*int64(p.pageSize)); err != nil {
+		return fmt.Errorf("%w: write allocation table: %v", ErrPageIO, err)
+	}
+	// 分配表写入之后再写头页，头页不会指向没有写完的分配表
+	if err := p.sync(); err != nil {
+		return err
+	}
+	header := make([]byte, poolHeaderSz)
+	copy(header, poolMagic[:])
+	binary.LittleEndian.PutUint32(header[8:], p.pageSize)
+	binary.LittleEndian.PutUint32(header[12:], uint32(len(p.used)))
+	binary.LittleEndian.PutUint32(header[16:], p.current)
+	binary.LittleEndian.PutUint32(header[20:], tableAt)
+	binary.LittleEndian.PutUint32(header[24:], crc32.ChecksumIEEE(table))
+	if _, err := p.file.WriteAt(header, 0); err != nil {
+		return fmt.Errorf("%w: write header: %v", ErrPageIO, err)
+	}
+	return p.sync()
+}
+
+// sync 文件实现了 Sync() error 时 Sync
+func (p *BufferPool) sync() error {
+	if s, ok := p.file.(interface{ Sync() error }); ok {
+		if err := s.Sync(); err != nil {
+			return fmt.Errorf("%w: sync: %v", ErrPageIO, err)
+		}
+	}
+	return nil
+}
+
+// Enter 开始一个作用域，到对应的 Exit 为止用到的页都不会被换出
+func (p *BufferPool) Enter() {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	p.enter()
+}
+
+// Exit 结束 Enter 开始的作用域。最外层的 Exit 把临时增加的 frame 换出
+func (p *BufferPool) Exit() {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	p.exit()
+}
+
+// Stats 统计信息
+func (p *BufferPool) Stats() PoolStats {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	return p.stats
+}
+
+// DirtyPages 缓存中的脏页数
+func (p *BufferPool) DirtyPages() int {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	n := 0
+	for _, pg := range p.pages {
+		if pg.dirty {
+			n++
+		}
+	}
+	return n
+}
+
+func (p *BufferPool) enter() {
+	if p.depth == 0 {
+		p.scope++
+	}
+	p.depth++
+}
+
+func (p *BufferPool) exit() {
+	p.depth--
+	if p.depth > 0 {
+		return
+	}
+	// 刚结束的作用域用到的页在下一次 Exit 之前仍然有效，不换出
+	for len(p.pages) > p.frames {
+		if p.evict(func(pg *poolPage) bool { return pg.lastScope != p.scope }) == nil {
+			return
+		}
+	}
+}
+
+// access 一次访问。不在作用域中时相当于单独的一次 Enter、Exit，返回的函数结束该作用域
+func (p *BufferPool) access() func() {
+	p.enter()
+	return p.exit
+}
+
+// page 使用页 id，scoped 时记入当前作用域。不在缓存中时读入，需要时换出其他页。调用者持有 p.mu
+func (p *BufferPool) page(id uint32, scoped bool) *poolPage {
+	if pg, ok := p.pages[id]; ok {
+		p.stats.Hits++
+		if scoped {
+			pg.lastScope = p.scope
+		}
+		p.lru.MoveToFront(pg.elem)
+		return pg
+	}
+	p.stats.Misses++
+	pg := p.frame(id, scoped)
+	if err := p.read(pg); err != nil {
+		panic(err)
+	}
+	return pg
+}
+
+// freshPage 使用新分配的页 id。文件中这个位置的内容没有意义（可能是上次 Flush 的分配表），不读入，清零。调用者持有 p.mu
+func (p *BufferPool) freshPage(id uint32) *poolPage {
+	pg := p.frame(id, true)
+	for i := range pg.data {
+		pg.data[i] = 0
+	}
+	return pg
+}
+
+// frame 为页 id 准备一个 frame 并放入缓存，内容由调用者填充。需要时换出其他页。调用者持有 p.mu
+func (p *BufferPool) frame(id uint32, scoped bool) *poolPage {
+	var data []byte
+	if len(p.pages) >= p.frames {
+		// 没有 pin、也没有在当前和上一个作用域中使用的页才能换出，上一个作用域得到的指针在这次 Exit 之前仍然有效
+		victim := p.evict(func(pg *poolPage) bool { return pg.lastScope+1 < p.scope })
+		if victim != nil {
+			// 以 bptreedebug 构建时 victim.data 已经被填充并丢弃，不会复用
+			if len(victim.data) == int(p.pageBytes(id)) {
+				data = victim.data
+			}
+		} else {
+			p.stats.Overflows++
+		}
+	}
+	if data == nil {
+		data = movableBuffer(p.pageBytes(id))
+	}
+	pg := &poolPage{id: id, data: data}
+	if scoped {
+		pg.lastScope = p.scope
+	}
+	p.pages[id] = pg
+	pg.elem = p.lru.PushFront(pg)
+	return pg
+}
+
+// pageBytes 页 id 的大小，span 为整个 span 的大小
+func (p *BufferPool) pageBytes(id uint32) uint32 {
+	if n, ok := p.spans[id]; ok {
+		return n * p.pageSize
+	}
+	return p.pageSize
+}
+
+// evict 从最久没有使用的开始，换出一个没有 pin 且满足 ok 的页，脏页先写回。没有可以换出的页返回 nil
+func (p *BufferPool) evict(ok func(pg *poolPage) bool) *poolPage {
+	for e := p.lru.Back(); e != nil; e = e.Prev() {
+		pg := e.Value.(*poolPage)
+		if pg.pins > 0 || !ok(pg) {
+			continue
+		}
+		if err := p.writeBack(pg); err != nil {
+			panic(err)
+		}
+		p.lru.Remove(e)
+		delete(p.pages, pg.id)
+		p.stats.Evictions++
+		if poisonEvicted {
+			for i := range pg.data {
+				pg.data[i] = poisonByte
+			}
+			pg.data = nil
+		}
+		return pg
+	}
+	return nil
+}
+
+// read 从文件读入 pg。超出文件末尾的部分（新分配的页）为 0
+func (p *BufferPool) read(pg *poolPage) error {
+	n, err := p.file.ReadAt(pg.data, int64(pg.id)*int64(p.pageSize))
+	if err != nil && !errors.Is(err, io.EOF) {
+		return fmt.Errorf("%w: read page %d: %v", ErrPageIO, pg.id, err)
+	}
+	for i := n; i < len(pg.data); i++ {
+		pg.data[i] = 0
+	}
+	if n > 0 {
+		p.stats.Reads++
+	}
+	return nil
+}
+
+// writeBack pg 是脏页时写回文件
+func (p *BufferPool) writeBack(pg *poolPage) error {
+	if !pg.dirty {
+		return nil
+	}
+	if _, err := p.file.WriteAt(pg.data, int64(pg.id)*int64(p.pageSize)); err != nil {
+		return fmt.Errorf("%w: write page %d: %v", ErrPageIO, pg.id, err)
+	}
+	pg.dirty = false
+	p.stats.Writes++
+	return nil
+}
+
+func (p *BufferPool) String() string {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	return fmt.Sprintf("pageSize=%d, frames=%d, pages=%d, cached=%d, %+v", p.pageSize, p.frames, len(p.used), len(p.pages), p.stats)
+}
@@ -0,0 +1,256 @@
+package memory
+
+import (
+	"encoding/binary"
+	"errors"
+	"math"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func TestBufferPool(t *testing.T) {
+	file, err := os.Create(filepath.Join(t.TempDir(), "pages"))
+	if err != nil {
+		panic(err)
+	}
+	defer file.Close()
+	pool := NewBufferPool(file, 256, 2)
+
+	locs := make([]Location, 0)
+	for i := 0; i < 200; i++ {
+		loc, _ := pool.AllocateAligned(8+uint32(i%5), 8)
+		binary.LittleEndian.PutUint64(pool.Bytes(loc, 8), uint64(i))
+		locs = append(locs, loc)
+	}
+	if s := pool.Stats(); s.Evictions == 0 || s.Writes == 0 || len(pool.pages) > 2 {
+		panic(pool.String())
+	}
+	for i, loc := range locs {
+		if binary.LittleEndian.Uint64(pool.Bytes(loc, 8)) != uint64(i) || !pool.Contains(loc, 8) || loc.BlockOffset%8 != 0 {
+			panic(i)
+		}
+	}
+	if pool.Stats().Reads == 0 || len(pool.pages) > 2 {
+		panic(pool.String())
+	}
+
+	// Flush 之后文件中是最新的数据
+	if err := pool.Flush(); err != nil {
+		panic(err)
+	}
+	if pool.DirtyPages() != 0 {
+		panic(pool.String())
+	}
+	last := locs[len(locs)-1]
+	buf := make([]byte, 8)
+	if _, err := file.ReadAt(buf, int64(last.BlockId)*256+int64(last.BlockOffset)); err != nil || binary.LittleEndian.Uint64(buf) != uint64(len(locs)-1) {
+		panic(err)
+	}
+
+	// 没有 MarkDirty 的修改在换出之后丢失
+	evictAll := func() {
+		for _, loc := range locs[len(locs)/2:] {
+			pool.Pointer(loc)
+		}
+	}
+	binary.LittleEndian.PutUint64(pool.Bytes(locs[0], 8), 1000)
+	evictAll()
+	if binary.LittleEndian.Uint64(pool.Bytes(locs[0], 8)) != 0 {
+		panic(pool.String())
+	}
+	pool.Enter()
+	binary.LittleEndian.PutUint64(pool.Bytes(locs[0], 8), 1000)
+	pool.MarkDirty(locs[0])
+	pool.Exit()
+	evictAll()
+	if binary.LittleEndian.Uint64(pool.Bytes(locs[0], 8)) != 1000 {
+		panic(pool.String())
+	}
+
+	// Pin 住的页不换出，地址不变
+	pinned := pool.Pin(locs[0])
+	evictAll()
+	if pool.Pointer(locs[0]) != pinned {
+		panic(pool.String())
+	}
+	pool.Unpin(locs[0])
+
+	// 作用域中用到的页超过 frames 时临时增加 frame，Exit 之后再换出
+	overflows := pool.Stats().Overflows
+	pool.Enter()
+	first := pool.Pointer(locs[0])
+	evictAll()
+	if pool.Pointer(locs[0]) != first || pool.Stats().Overflows == overflows || len(pool.pages) <= 2 {
+		panic(pool.String())
+	}
+	pool.Exit()
+	pool.Pointer(locs[0])
+	if len(pool.pages) > 2 {
+		panic(pool.String())
+	}
+
+	// Pin 的页不留在作用域中，Unpin 之后在同一个作用域中就可以换出
+	pool.Enter()
+	overflows = pool.Stats().Overflows
+	for _, loc := range locs[len(locs)/2:] {
+		pool.Pin(loc)
+		pool.Unpin(loc)
+	}
+	if pool.Stats().Overflows != overflows || len(pool.pages) > 2 {
+		panic(pool.String())
+	}
+	pool.Exit()
+
+	// 超过 pageSize 的分配使用连续的新页，之后的小分配仍然在当前页
+	current := pool.current
+	span, _ := pool.Allocate(600)
+	if span.BlockOffset != 0 || pool.spans[span.BlockId] != 3 || !pool.Contains(span, 600) || pool.Contains(span, 601) {
+		panic(pool.String())
+	}
+	for i := uint32(0); i < 600; i += 8 {
+		binary.LittleEndian.PutUint64(pool.Bytes(Location{BlockId: span.BlockId, BlockOffset: i}, 8), uint64(i))
+	}
+	if small, _ := pool.Allocate(8); small.BlockId != current {
+		panic(small)
+	}
+	evictAll()
+	if _, ok := pool.pages[span.BlockId]; ok {
+		panic(pool.String())
+	}
+	data := pool.Bytes(span, 600)
+	for i := uint32(0); i < 600; i += 8 {
+		if binary.LittleEndian.Uint64(data[i:]) != uint64(i) {
+			panic(i)
+		}
+	}
+	if next, _ := pool.Allocate(256); next.BlockId != span.BlockId+3 {
+		panic(next)
+	}
+
+	func() {
+		defer func() {
+			if err, ok := recover().(error); !ok || !errors.Is(err, ErrOutOfSpace) {
+				panic(err)
+			}
+		}()
+		pool.Allocate(math.MaxUint32)
+	}()
+}
+
+// Flush 之后由新的 BufferPool 打开，数据、分配信息和 span 都保留
+func TestBufferPoolReopen(t *testing.T) {
+	file, err := os.Create(filepath.Join(t.TempDir(), "pages"))
+	if err != nil {
+		panic(err)
+	}
+	defer file.Close()
+	if _, err := OpenBufferPool(file, 2); !errors.Is(err, ErrPoolFormat) {
+		panic(err)
+	}
+
+	pool := NewBufferPool(file, 256, 2)
+	locs := make([]Location, 0)
+	for i := 0; i < 100; i++ {
+		loc, _ := pool.AllocateAligned(8, 8)
+		binary.LittleEndian.PutUint64(pool.Bytes(loc, 8), uint64(i))
+		pool.MarkDirty(loc)
+		locs = append(locs, loc)
+	}
+	span, _ := pool.Allocate(600)
+	pool.Bytes(span, 600)[599] = 0xff
+	pool.MarkDirty(span)
+	last, _ := pool.Allocate(8)
+	if err := pool.Flush(); err != nil {
+		panic(err)
+	}
+
+	for round := 0; round < 2; round++ {
+		reopened, err := OpenBufferPool(file, 2)
+		if err != nil {
+			panic(err)
+		}
+		if reopened.pageSize != 256 || reopened.current != pool.current || len(reopened.used) != len(pool.used) || reopened.spans[span.BlockId] != 3 {
+			panic(reopened.String())
+		}
+		for i, loc := range locs {
+			if !reopened.Contains(loc, 8) || binary.LittleEndian.Uint64(reopened.Bytes(loc, 8)) != uint64(i) {
+				panic(i)
+			}
+		}
+		if !reopened.Contains(span, 600) || reopened.Contains(span, 601) || reopened.Bytes(span, 600)[599] != 0xff {
+			panic(reopened.String())
+		}
+		if reopened.Contains(Location{BlockId: headerPage}, 1) {
+			panic(reopened.String())
+		}
+		// 新的分配接着上次的位置，新页覆盖上次的分配表时读到的是 0
+		if loc, _ := reopened.Allocate(8); loc.BlockId != last.BlockId || loc.BlockOffset != last.BlockOffset+8 {
+			panic(loc)
+		}
+		fresh, _ := reopened.Allocate(256)
+		for _, b := range reopened.Bytes(fresh, 256) {
+			if b != 0 {
+				panic(fresh)
+			}
+		}
+		last, _ = reopened.Allocate(8)
+		if err := reopened.Flush(); err != nil {
+			panic(err)
+		}
+		pool = reopened
+	}
+
+	// 分配表损坏
+	if _, err := file.WriteAt([]byte{0xff}, int64(len(pool.used))*256); err != nil {
+		panic(err)
+	}
+	if _, err := OpenBufferPool(file, 2); !errors.Is(err, ErrPoolFormat) {
+		panic(err)
+	}
+	// 头页损坏
+	if _, err := file.WriteAt([]byte{0}, 0); err != nil {
+		panic(err)
+	}
+	if _, err := OpenBufferPool(file, 2); !errors.Is(err, ErrPoolFormat) {
+		panic(err)
+	}
+}
+
+// 换出之后，旧的指针指向复用 frame 的另一页；以 bptreedebug 构建时读到的是 poisonByte
+func TestBufferPoolStalePointer(t *testing.T) {
+	file, err := os.Create(filepath.Join(t.TempDir(), "pages"))
+	if err != nil {
+		panic(err)
+	}
+	defer file.Close()
+	pool := NewBufferPool(file, 256, 1)
+	a, _ := pool.Allocate(256)
+	b, _ := pool.Allocate(256)
+	pool.Bytes(a, 256)[0] = 1
+	pool.MarkDirty(a)
+	pool.Bytes(b, 256)[0] = 2
+	pool.MarkDirty(b)
+
+	stale := pool.Bytes(a, 256)
+	pool.Enter()
+	pool.Exit()
+	pool.Enter()
+	pool.Exit()
+	if pool.Bytes(b, 1)[0] != 2 {
+		panic(pool.String())
+	}
+	if _, ok := pool.pages[a.BlockId]; ok {
+		panic(pool.String())
+	}
+	want := byte(2)
+	if poisonEvicted {
+		want = poisonByte
+	}
+	if stale[0] != want {
+		panic(stale[0])
+	}
+	if pool.Bytes(a, 1)[0] != 1 {
+		panic(pool.String())
+	}
+}
@@ -0,0 +1,211 @@
+package memory
+
+import "unsafe"
+
+/*
+故障注入，用于测试
+FaultyManager 包装任意的 MemManager，可以设定 Allocate 在若干次之后失败、限制分配的总字节数，或者直接改写某个位置的数据。
+Allocate 失败时 panic(ErrOutOfSpace)，与 Directory 分配过大时的行为一致。
+inner 实现了 Scoped、Pinner、Dirtier、Volatile 时 NewFaulty 返回的值才实现对应的接口，见 wrap.go
+*/
+
+// FaultyManager 注入故障的 MemManager，由 NewFaulty 创建
+type FaultyManager interface {
+	MemManager
+	TaggedManager
+	AlignedManager
+	AlignedTaggedManager
+	PointerManager
+	BytesManager
+	Bounded
+	// FailAfter 再成功 n 次之后，Allocate 都失败
+	FailAfter(n int)
+	// Limit 分配的总字节数超过 bytes 时 Allocate 失败，模拟空间不足
+	Limit(bytes uint64)
+	// Heal 取消 FailAfter 和 Limit
+	Heal()
+	// Allocations 成功的 Allocate 次数
+	Allocations() int
+	// Corrupt 把 data 写到 loc 之后 offset 处，模拟数据损坏
+	Corrupt(loc Location, offset uint32, data []byte)
+}
+
+type faultyManager struct {
+	inner     MemManager
+	allocs    int    // 成功的 Allocate 次数
+	failAfter int    // allocs 达到 failAfter 后 Allocate 失败，-1 表示不失败
+	limit     uint64 // 分配的总字节数上限，0 表示不限
+	allocated uint64 // 已分配的总字节数
+}
+
+// NewFaulty 包装 inner，初始时不注入故障。返回的值只实现 inner 实现了的 Scoped、Pinner、Dirtier、Volatile
+func NewFaulty(inner MemManager) FaultyManager {
+	f := &faultyManager{inner: inner, failAfter: -1}
+	s, p, d, v := forwardScoped{inner}, forwardPinner{inner: inner}, forwardDirtier{inner}, forwardVolatile{inner}
+	switch optionalOf(inner) {
+	case optScoped:
+		return struct {
+			FaultyManager
+			forwardScoped
+		}{f, s}
+	case optPinner:
+		return struct {
+			FaultyManager
+			forwardPinner
+		}{f, p}
+	case optScoped | optPinner:
+		return struct {
+			FaultyManager
+			forwardScoped
+			forwardPinner
+		}{f, s, p}
+	case optDirtier:
+		return struct {
+			FaultyManager
+			forwardDirtier
+		}{f, d}
+	case optScoped | optDirtier:
+		return struct {
+			FaultyManager
+			forwardScoped
+			forwardDirtier
+		}{f, s, d}
+	case optPinner | optDirtier:
+		return struct {
+			FaultyManager
+			forwardPinner
+			forwardDirtier
+		}{f, p, d}
+	case optScoped | optPinner | optDirtier:
+		return struct {
+			FaultyManager
+			forwardScoped
+			forwardPinner
+			forwardDirtier
+		}{f, s, p, d}
+	case optVolatile:
+		return struct {
+			FaultyManager
+			forwardVolatile
+		}{f, v}
+	case optScoped | optVolatile:
+		return struct {
+			FaultyManager
+			forwardScoped
+			forwardVolatile
+		}{f, s, v}
+	case optPinner | optVolatile:
+		return struct {
+			FaultyManager
+			forwardPinner
+			forwardVolatile
+		}{f, p, v}
+	case optScoped | optPinner | optVolatile:
+		return struct {
+			FaultyManager
+			forwardScoped
+			forwardPinner
+			forwardVolatile
+		}{f, s, p, v}
+	case optDirtier | optVolatile:
+		return struct {
+			FaultyManager
+			forwardDirtier
+			forwardVolatile
+		}{f, d, v}
+	case optScoped | optDirtier | optVolatile:
+		return struct {
+			FaultyManager
+			forwardScoped
+			forwardDirtier
+			forwardVolatile
+		}{f, s, d, v}
+	case optPinner | optDirtier | optVolatile:
+		return struct {
+			FaultyManager
+			forwardPinner
+			forwardDirtier
+			forwardVolatile
+		}{f, p, d, v}
+	case optScoped | optPinner | optDirtier | optVolatile:
+		return struct {
+			FaultyManager
+			forwardScoped
+			forwardPinner
+			forwardDirtier
+			forwardVolatile
+		}{f, s, p, d, v}
+	}
+	return f
+}
+
+func (f *faultyManager) FailAfter(n int) {
+	f.failAfter = f.allocs + n
+}
+
+func (f *faultyManager) Limit(bytes uint64) {
+	f.limit = bytes
+}
+
+func (f *faultyManager) Heal() {
+	f.failAfter = -1
+	f.limit = 0
+}
+
+func (f *faultyManager) Allocations() int {
+	return f.allocs
+}
+
+func (f *faultyManager) Allocate(size uint32) (loc Location, pointer uintptr) {
+	return f.AllocateTagged(size, TagUnknown)
+}
+
+func (f *faultyManager) AllocateTagged(size uint32, tag Tag) (loc Location, pointer uintptr) {
+	return f.AllocateAlignedTagged(size, 1, tag)
+}
+
+func (f *faultyManager) AllocateAligned(size, align uint32) (loc Location, pointer uintptr) {
+	return f.AllocateAlignedTagged(size, align, TagUnknown)
+}
+
+// AllocateAlignedTagged 注入故障后转发给 inner，保留对齐和用途
+func (f *faultyManager) AllocateAlignedTagged(size, align uint32, tag Tag) (loc Location, pointer uintptr) {
+	if f.failAfter >= 0 && f.allocs >= f.failAfter {
+		panic(ErrOutOfSpace)
+	}
+	if f.limit > 0 && f.allocated+uint64(size) > f.limit {
+		panic(ErrOutOfSpace)
+	}
+	loc, pointer = AllocateAligned(f.inner, size, align, tag)
+	f.allocs++
+	f.allocated += uint64(size)
+	return loc, pointer
+}
+
+func (f *faultyManager) PointerAt(loc Location) uintptr {
+	return f.inner.PointerAt(loc)
+}
+
+func (f *faultyManager) Pointer(loc Location) unsafe.Pointer {
+	return Pointer(f.inner, loc)
+}
+
+func (f *faultyManager) Bytes(loc Location, n uint32) []byte {
+	return Bytes(f.inner, loc, n)
+}
+
+// Contains inner 实现了 Bounded 时由 inner 判断，否则认为都已分配
+func (f *faultyManager) Contains(loc Location, size uint32) bool {
+	if b, ok := f.inner.(Bounded); ok {
+		return b.Contains(loc, size)
+	}
+	return true
+}
+
+func (f *faultyManager) Corrupt(loc Location, offset uint32, data []byte) {
+	loc.BlockOffset += offset
+	Enter(f.inner)
+	defer Exit(f.inner)
+	copy(Bytes(f.inner, loc, uint32(len(data))), data)
+	MarkDirty(f.inner, loc)
+}
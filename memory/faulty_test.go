@@ -0,0 +1,98 @@
+package memory
+
+import (
+	"errors"
+	"math"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func allocateErr(f FaultyManager, size uint32) (err error) {
+	defer func() {
+		if r := recover(); r != nil {
+			err = r.(error)
+		}
+	}()
+	f.Allocate(size)
+	return nil
+}
+
+func TestFailAfter(t *testing.T) {
+	f := NewFaulty(New(1024))
+	f.FailAfter(2)
+	for i := 0; i < 2; i++ {
+		if err := allocateErr(f, 8); err != nil {
+			panic(err)
+		}
+	}
+	if err := allocateErr(f, 8); !errors.Is(err, ErrOutOfSpace) {
+		panic(err)
+	}
+	f.Heal()
+	if err := allocateErr(f, 8); err != nil || f.Allocations() != 3 {
+		panic(err)
+	}
+}
+
+func TestLimit(t *testing.T) {
+	f := NewFaulty(New(1024))
+	f.Limit(100)
+	if err := allocateErr(f, 60); err != nil {
+		panic(err)
+	}
+	if err := allocateErr(f, 60); !errors.Is(err, ErrOutOfSpace) {
+		panic(err)
+	}
+	if err := allocateErr(f, 40); err != nil {
+		panic(err)
+	}
+	// Directory 分配超过 block 大小时使用 huge block，超过 uint32 的偏移范围时失败
+	if err := allocateErr(NewFaulty(New(16)), 17); err != nil {
+		panic(err)
+	}
+	defer func() {
+		if err, ok := recover().(error); !ok || !errors.Is(err, ErrOutOfSpace) {
+			panic(err)
+		}
+	}()
+	NewFaulty(New(16)).AllocateAligned(math.MaxUint32, 2)
+}
+
+func TestCorruptAndContains(t *testing.T) {
+	f := NewFaulty(New(1024))
+	loc, _ := f.Allocate(8)
+	f.Corrupt(loc, 2, []byte{7, 8})
+	if *(*[4]byte)(f.Pointer(loc)) != [4]byte{0, 0, 7, 8} {
+		panic(*(*[4]byte)(f.Pointer(loc)))
+	}
+	if !f.Contains(loc, 8) || f.Contains(loc, 9) || f.Contains(Location{BlockId: 1}, 1) {
+		panic(loc)
+	}
+}
+
+// 只实现 inner 实现了的可选接口
+func TestFaultyOptional(t *testing.T) {
+	file, err := os.Create(filepath.Join(t.TempDir(), "pages"))
+	if err != nil {
+		panic(err)
+	}
+	defer file.Close()
+	pool := NewBufferPool(file, 256, 2)
+	if o := optionalOf(NewFaulty(New(1024))); o != 0 {
+		panic(o)
+	}
+	if o := optionalOf(NewFaulty(pool)); o != optScoped|optPinner|optDirtier {
+		panic(o)
+	}
+	f := NewFaulty(pool)
+	loc, _ := f.Allocate(8)
+	Enter(f)
+	f.Corrupt(loc, 0, []byte{1})
+	Exit(f)
+	if Pin(f, loc) != pool.Pin(loc) || *(*byte)(f.Pointer(loc)) != 1 {
+		panic(pool.String())
+	}
+	Unpin(f, loc)
+	pool.Unpin(loc)
+}
@@ -0,0 +1,296 @@
+package memory
+
+import (
+	"fmt"
+	"math/bits"
+	"sort"
+	"strings"
+	"sync"
+	"unsafe"
+)
+
+/*
+统计内存的使用情况
+Instrumented 包装任意的 MemManager，按用途（Tag）统计 Allocate 的次数、字节数和大小分布，并统计每个 block 的 PointerAt（包括 Pointer、Bytes）次数。
+用途由 AllocateTagged 标注，bptree 会标注 node、value、变长 key 和元数据。用于调整 block 大小和 node 的度。
+inner 实现了 Scoped、Pinner、Dirtier、Volatile 时 NewInstrumented 返回的值才实现对应的接口，见 wrap.go。统计由互斥锁保护，可以并发使用
+*/
+
+// Instrumented 统计内存使用的 MemManager，由 NewInstrumented 创建
+type Instrumented interface {
+	MemManager
+	TaggedManager
+	AlignedManager
+	AlignedTaggedManager
+	PointerManager
+	BytesManager
+	Bounded
+	// Stats 一种用途的分配统计
+	Stats(tag Tag) AllocStats
+	// Total 所有用途合计的分配统计
+	Total() AllocStats
+	// PointerAtCounts 每个 block 的 PointerAt 次数，返回副本
+	PointerAtCounts() map[uint32]uint64
+	// Reset 清空统计
+	Reset()
+	String() string
+}
+
+type instrumented struct {
+	inner     MemManager
+	mu        sync.Mutex // 保护 allocs 和 pointerAt
+	allocs    [tagCount]AllocStats
+	pointerAt map[uint32]uint64 // blockId -> PointerAt 次数
+}
+
+// AllocStats 一种用途的分配统计
+type AllocStats struct {
+	Calls uint64
+	Bytes uint64
+	Sizes Histogram
+}
+
+// Histogram 分配大小的分布。Histogram[0] 为大小 0 的次数，Histogram[i] 为大小在 [2^(i-1), 2^i) 的次数
+type Histogram [33]uint64
+
+// NewInstrumented 包装 inner，返回的值只实现 inner 实现了的 Scoped、Pinner、Dirtier、Volatile
+func NewInstrumented(inner MemManager) Instrumented {
+	in := &instrumented{inner: inner, pointerAt: map[uint32]uint64{}}
+	s, p, d, v := forwardScoped{inner}, forwardPinner{inner, in.count}, forwardDirtier{inner}, forwardVolatile{inner}
+	switch optionalOf(inner) {
+	case optScoped:
+		return struct {
+			Instrumented
+			forwardScoped
+		}{in, s}
+	case optPinner:
+		return struct {
+			Instrumented
+			forwardPinner
+		}{in, p}
+	case optScoped | optPinner:
+		return struct {
+			Instrumented
+			forwardScoped
+			forwardPinner
+		}{in, s, p}
+	case optDirtier:
+		return struct {
+			Instrumented
+			forwardDirtier
+		}{in, d}
+	case optScoped | optDirtier:
+		return struct {
+			Instrumented
+			forwardScoped
+			forwardDirtier
+		}{in, s, d}
+	case optPinner | optDirtier:
+		return struct {
+			Instrumented
+			forwardPinner
+			forwardDirtier
+		}{in, p, d}
+	case optScoped | optPinner | optDirtier:
+		return struct {
+			Instrumented
+			forwardScoped
+			forwardPinner
+			forwardDirtier
+		}{in, s, p, d}
+	case optVolatile:
+		return struct {
+			Instrumented
+			forwardVolatile
+		}{in, v}
+	case optScoped | optVolatile:
+		return struct {
+			Instrumented
+			forwardScoped
+			forwardVolatile
+		}{in, s, v}
+	case optPinner | optVolatile:
+		return struct {
+			Instrumented
+			forwardPinner
+			forwardVolatile
+		}{in, p, v}
+	case optScoped | optPinner | optVolatile:
+		return struct {
+			Instrumented
+			forwardScoped
+			forwardPinner
+			forwardVolatile
+		}{in, s, p, v}
+	case optDirtier | optVolatile:
+		return struct {
+			Instrumented
+			forwardDirtier
+			forwardVolatile
+		}{in, d, v}
+	case optScoped | optDirtier | optVolatile:
+		return struct {
+			Instrumented
+			forwardScoped
+			forwardDirtier
+			forwardVolatile
+		}{in, s, d, v}
+	case optPinner | optDirtier | optVolatile:
+		return struct {
+			Instrumented
+			forwardPinner
+			forwardDirtier
+			forwardVolatile
+		}{in, p, d, v}
+	case optScoped | optPinner | optDirtier | optVolatile:
+		return struct {
+			Instrumented
+			forwardScoped
+			forwardPinner
+			forwardDirtier
+			forwardVolatile
+		}{in, s, p, d, v}
+	}
+	return in
+}
+
+func (in *instrumented) Allocate(size uint32) (loc Location, pointer uintptr) {
+	return in.AllocateTagged(size, TagUnknown)
+}
+
+func (in *instrumented) AllocateTagged(size uint32, tag Tag) (loc Location, pointer uintptr) {
+	return in.AllocateAlignedTagged(size, 1, tag)
+}
+
+func (in *instrumented) AllocateAligned(size, align uint32) (loc Location, pointer uintptr) {
+	return in.AllocateAlignedTagged(size, align, TagUnknown)
+}
+
+// AllocateAlignedTagged 转发给 inner，统计的是请求的大小，不包括对齐跳过的部分
+func (in *instrumented) AllocateAlignedTagged(size, align uint32, tag Tag) (loc Location, pointer uintptr) {
+	loc, pointer = AllocateAligned(in.inner, size, align, tag)
+	if tag >= tagCount {
+		tag = TagUnknown
+	}
+	in.mu.Lock()
+	defer in.mu.Unlock()
+	s := &in.allocs[tag]
+	s.Calls++
+	s.Bytes += uint64(size)
+	s.Sizes.add(size)
+	return loc, pointer
+}
+
+func (in *instrumented) PointerAt(loc Location) uintptr {
+	in.count(loc)
+	return in.inner.PointerAt(loc)
+}
+
+// Pointer 与 PointerAt 一样计数
+func (in *instrumented) Pointer(loc Location) unsafe.Pointer {
+	in.count(loc)
+	return Pointer(in.inner, loc)
+}
+
+// Bytes 与 PointerAt 一样计数
+func (in *instrumented) Bytes(loc Location, n uint32) []byte {
+	in.count(loc)
+	return Bytes(in.inner, loc, n)
+}
+
+// count 计一次 loc 所在 block 的 PointerAt，Pin 也计数
+func (in *instrumented) count(loc Location) {
+	in.mu.Lock()
+	defer in.mu.Unlock()
+	in.pointerAt[loc.BlockId]++
+}
+
+// Contains inner 实现了 Bounded 时由 inner 判断，否则认为都已分配
+func (in *instrumented) Contains(loc Location, size uint32) bool {
+	if b, ok := in.inner.(Bounded); ok {
+		return b.Contains(loc, size)
+	}
+	return true
+}
+
+func (in *instrumented) Stats(tag Tag) AllocStats {
+	if tag >= tagCount {
+		return AllocStats{}
+	}
+	in.mu.Lock()
+	defer in.mu.Unlock()
+	return in.allocs[tag]
+}
+
+func (in *instrumented) Total() AllocStats {
+	in.mu.Lock()
+	defer in.mu.Unlock()
+	total := AllocStats{}
+	for _, s := range in.allocs {
+		total.Calls += s.Calls
+		total.Bytes += s.Bytes
+		for i := range total.Sizes {
+			total.Sizes[i] += s.Sizes[i]
+		}
+	}
+	return total
+}
+
+func (in *instrumented) PointerAtCounts() map[uint32]uint64 {
+	in.mu.Lock()
+	defer in.mu.Unlock()
+	counts := make(map[uint32]uint64, len(in.pointerAt))
+	for id, c := range in.pointerAt {
+		counts[id] = c
+	}
+	return counts
+}
+
+func (in *instrumented) Reset() {
+	in.mu.Lock()
+	defer in.mu.Unlock()
+	in.allocs = [tagCount]AllocStats{}
+	in.pointerAt = map[uint32]uint64{}
+}
+
+func (in *instrumented) String() string {
+	in.mu.Lock()
+	defer in.mu.Unlock()
+	sb := strings.Builder{}
+	for tag, s := range in.allocs {
+		if s.Calls == 0 {
+			continue
+		}
+		sb.WriteString(fmt.Sprintf("%s: calls=%d, bytes=%d, sizes=%v\n", Tag(tag), s.Calls, s.Bytes, s.Sizes))
+	}
+	ids := make([]uint32, 0, len(in.pointerAt))
+	for id := range in.pointerAt {
+		ids = append(ids, id)
+	}
+	sort.Slice(ids, func(i, j int) bool { return ids[i] < ids[j] })
+	sb.WriteString("pointerAt:")
+	for _, id := range ids {
+		sb.WriteString(fmt.Sprintf(" %d=%d", id, in.pointerAt[id]))
+	}
+	return sb.String()
+}
+
+func (h *Histogram) add(size uint32) {
+	h[bits.Len32(size)]++
+}
+
+// String 只输出非空的区间，例如 [16,32)=3
+func (h Histogram) String() string {
+	parts := make([]string, 0)
+	for i, c := range h {
+		if c == 0 {
+			continue
+		}
+		if i == 0 {
+			parts = append(parts, fmt.Sprintf("0=%d", c))
+		} else {
+			parts = append(parts, fmt.Sprintf("[%d,%d)=%d", uint64(1)<<(i-1), uint64(1)<<i, c))
+		}
+	}
+	return "{" + strings.Join(parts, " ") + "}"
+}
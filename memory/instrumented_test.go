@@ -0,0 +1,98 @@
+package memory
+
+import (
+	"fmt"
+	"os"
+	"path/filepath"
+	"sync"
+	"testing"
+)
+
+func TestInstrumented(t *testing.T) {
+	in := NewInstrumented(NewFaulty(New(1024)))
+	in.Allocate(0)
+	in.AllocateTagged(16, TagNode)
+	loc, _ := in.AllocateTagged(17, TagNode)
+	AllocateTagged(in, 100, TagValue)
+	in.PointerAt(loc)
+	in.PointerAt(loc)
+	t.Log(in)
+
+	node := in.Stats(TagNode)
+	if node.Calls != 2 || node.Bytes != 33 || node.Sizes[5] != 2 {
+		panic(node)
+	}
+	if node.Sizes.String() != "{[16,32)=2}" {
+		panic(node.Sizes.String())
+	}
+	if s := in.Stats(TagValue); s.Calls != 1 || s.Bytes != 100 {
+		panic(s)
+	}
+	if s := in.Stats(TagUnknown); s.Calls != 1 || s.Sizes[0] != 1 {
+		panic(s)
+	}
+	if s := in.Total(); s.Calls != 4 || s.Bytes != 133 {
+		panic(s)
+	}
+	if counts := in.PointerAtCounts(); counts[loc.BlockId] != 2 {
+		panic(counts)
+	}
+	if !in.Contains(loc, 17) || in.Contains(loc, 1000) {
+		panic(loc)
+	}
+
+	in.Reset()
+	if in.Total().Calls != 0 || len(in.PointerAtCounts()) != 0 {
+		panic(in.String())
+	}
+}
+
+// 只实现 inner 实现了的可选接口，Pin 与 PointerAt 一样计数
+func TestInstrumentedOptional(t *testing.T) {
+	file, err := os.Create(filepath.Join(t.TempDir(), "pages"))
+	if err != nil {
+		panic(err)
+	}
+	defer file.Close()
+	pool := NewBufferPool(file, 256, 2)
+	for _, c := range []struct {
+		inner MemManager
+		want  optional
+	}{
+		{New(1024), 0},
+		{pool, optScoped | optPinner | optDirtier},
+		{NewFaulty(pool), optScoped | optPinner | optDirtier},
+	} {
+		in := NewInstrumented(c.inner)
+		if got := optionalOf(in); got != c.want {
+			panic(fmt.Sprint(got, " ", c.want))
+		}
+	}
+
+	in := NewInstrumented(pool)
+	loc, _ := in.Allocate(8)
+	Enter(in)
+	Pin(in, loc)
+	Unpin(in, loc)
+	Exit(in)
+	if in.PointerAtCounts()[loc.BlockId] != 1 {
+		panic(in.String())
+	}
+
+	// 统计可以并发更新
+	wg := sync.WaitGroup{}
+	for g := 0; g < 4; g++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for i := 0; i < 100; i++ {
+				in.PointerAt(loc)
+				_ = in.String()
+			}
+		}()
+	}
+	wg.Wait()
+	if in.PointerAtCounts()[loc.BlockId] != 401 {
+		panic(in.String())
+	}
+}
@@ -2,82 +2,277 @@ package memory
 
 import (
 	"fmt"
-	"reflect"
-	"strconv"
+	"math"
+	"runtime"
 	"strings"
+	"sync"
+	"sync/atomic"
 	"unsafe"
 )
 
 /*
 内存控制，模拟 mmap
-内存由一个一个定长的 block 组成，典型大小为 128M
+内存由一个一个的 block 组成，典型大小为 128M
 一组 block 称为 Directory 目录
 注意：内存只分配，不释放
+
+block 的大小：
+1. 默认所有 block 都是 New 指定的大小
+2. WithGrowth(max) 时第一个 block 为 New 指定的大小，之后每个新 block 翻倍，直到 max
+3. 超过 max（没有 WithGrowth 时为 New 指定的大小）的分配单独使用一个刚好放得下的 huge block，不影响当前 block
+不论大小，block 都在同一个 block 表中，Location.BlockId 是表中的下标
+
+Directory 可以被多个 goroutine（多棵树）同时使用：
+1. block 内 bump 分配，freeOffset 以 CAS 推进，不加锁
+2. block 表只追加，新增 block 时复制出新表再以 atomic.Pointer 替换（copy-on-grow），PointerAt 等读取不加锁
+3. 只有新增 block 时加锁，避免多个 goroutine 同时开新 block
+4. WithArenas 准备 GOMAXPROCS 个 arena，各自从不同的 block 分配，避免争用同一个 freeOffset。
+   arena 固定在 Directory 中，sync.Pool 只缓存 arena 的下标，使同一个 P 上的分配尽量落在同一个 arena。
+   GC 清空 sync.Pool 时只丢弃下标，之后重新轮流分配下标，arena 和它的 block 剩余空间不受影响
 */
 
 type Directory struct {
-	blocks    []*block
-	blockSize uint32 // 一个 block 的大小，注意不是 len(blocks)
+	blockSize    uint32                   // 第一个 block 的大小，注意不是 len(blocks)
+	maxBlockSize uint32                   // 普通 block 的最大大小，更大的分配使用 huge block
+	nextSize     uint32                   // 下一个普通 block 的大小，由 grow 保护
+	table        atomic.Pointer[[]*block] // 所有 block，只追加，替换时整体复制
+	current      atomic.Pointer[block]    // 共享的当前 block，不使用 arena 时从这里分配
+	arenas       []arena                  // 固定数目的 arena，nil 表示不使用 arena
+	arenaIds     sync.Pool                // *uint32，arenas 的下标
+	nextArena    atomic.Uint32            // 下一个新下标
+	grow         sync.Mutex               // 新增 block 时持有
 }
 
 type block struct {
-	data       []byte  // 物理数据，引用防止 gc，无意义
-	header     uintptr // 头指针
-	freeOffset uint32  // 未分配位置
-	remaining  uint32  // 剩余空间。blockSize = freeOffset + remaining
+	data       []byte         // 物理数据
+	base       unsafe.Pointer // &data[0]，以 unsafe.Pointer 保存，GC 可见
+	id         uint32         // 在 block 表中的下标
+	huge       bool           // 单独为一次分配创建的 block
+	freeOffset atomic.Uint32  // 未分配位置，剩余空间为 len(data) - freeOffset
+}
+
+// arena 一组分配共用的当前 block，填充到 64 bytes 避免与相邻的 arena 伪共享
+type arena struct {
+	current atomic.Pointer[block]
+	_       [56]byte
+}
+
+// Option Directory 的配置
+type Option func(d *Directory)
+
+// WithGrowth 新 block 的大小翻倍增长，直到 maxBlockSize。maxBlockSize 小于 New 指定的大小时不增长
+func WithGrowth(maxBlockSize uint32) Option {
+	return func(d *Directory) {
+		if maxBlockSize > d.maxBlockSize {
+			d.maxBlockSize = maxBlockSize
+		}
+	}
+}
+
+// WithArenas 不同的 P 尽量从不同的 block 分配，适合多个 goroutine 同时分配
+// arena 的数目为创建时的 GOMAXPROCS，每个 arena 的第一个 block 在第一次分配时才创建
+func WithArenas() Option {
+	return func(d *Directory) {
+		d.arenas = make([]arena, runtime.GOMAXPROCS(0))
+		d.arenaIds.New = func() any {
+			id := (d.nextArena.Add(1) - 1) % uint32(len(d.arenas))
+			return &id
+		}
+	}
 }
 
-func New(blockSize uint32) *Directory {
-	return &Directory{
-		blocks:    []*block{newBlock(blockSize)},
-		blockSize: blockSize,
+// New 第一个 block 大小为 blockSize 的 Directory
+func New(blockSize uint32, opts ...Option) *Directory {
+	d := &Directory{blockSize: blockSize, maxBlockSize: blockSize, nextSize: blockSize}
+	for _, opt := range opts {
+		opt(d)
 	}
+	d.table.Store(&[]*block{})
+	if d.arenas == nil {
+		d.current.Store(d.appendBlock(1))
+	}
+	return d
+}
+
+// NewWithArenas 即 New(blockSize, WithArenas())
+func NewWithArenas(blockSize uint32) *Directory {
+	return New(blockSize, WithArenas())
 }
 
+// Allocate 不要求对齐，紧接着上一次分配
 func (d *Directory) Allocate(size uint32) (ptr Location, pointer uintptr) {
-	ptr.BlockId = uint32(len(d.blocks) - 1)
-	last := d.blocks[ptr.BlockId]
-	if last.remaining >= size {
-		ptr.BlockOffset = last.freeOffset
-		last.freeOffset += size
-		last.remaining -= size
-		return ptr, d.PointerAt(ptr)
-	} else if size <= d.blockSize {
-		d.blocks = append(d.blocks, newBlock(d.blockSize))
-		return d.Allocate(size)
-	} else {
-		panic(strconv.Itoa(int(size)) + " is too large")
+	return d.AllocateAligned(size, 1)
+}
+
+// AllocateAligned 分配 size 大小的内存，起始地址是 align 的倍数。align 必须是 2 的幂
+func (d *Directory) AllocateAligned(size, align uint32) (ptr Location, pointer uintptr) {
+	checkAlign(align)
+	need := uint64(size) + uint64(align) - 1 // 最坏情况下对齐跳过 align - 1 bytes
+	if need > uint64(d.maxBlockSize) {
+		return d.allocateHuge(need, size, align)
+	}
+	if d.arenas == nil {
+		return d.allocateFrom(&d.current, size, align)
+	}
+	id := d.arenaIds.Get().(*uint32)
+	ptr, pointer = d.allocateFrom(&d.arenas[*id].current, size, align)
+	d.arenaIds.Put(id)
+	return ptr, pointer
+}
+
+// allocateFrom 从 current 指向的 block 分配，空间不足时换上新的 block
+func (d *Directory) allocateFrom(current *atomic.Pointer[block], size, align uint32) (ptr Location, pointer uintptr) {
+	for {
+		b := current.Load()
+		if b != nil {
+			if offset, ok := b.bump(size, align); ok {
+				ptr = Location{BlockId: b.id, BlockOffset: offset}
+				return ptr, uintptr(unsafe.Add(b.base, offset))
+			}
+		}
+		d.grow.Lock()
+		// 其他 goroutine 可能已经换过了
+		if current.Load() == b {
+			current.Store(d.appendBlock(size + align - 1))
+		}
+		d.grow.Unlock()
+	}
+}
+
+// allocateHuge 为超过普通 block 最大大小的分配单独创建 need bytes 的 block
+func (d *Directory) allocateHuge(need uint64, size, align uint32) (ptr Location, pointer uintptr) {
+	if need > math.MaxUint32 {
+		panic(fmt.Errorf("%w: %d aligned to %d is too large", ErrOutOfSpace, size, align))
+	}
+	d.grow.Lock()
+	b := d.appendHugeBlock(uint32(need))
+	d.grow.Unlock()
+	offset, _ := b.bump(size, align)
+	ptr = Location{BlockId: b.id, BlockOffset: offset}
+	return ptr, uintptr(unsafe.Add(b.base, offset))
+}
+
+// appendBlock 新建一个至少 need bytes 的普通 block 加入 block 表，大小按增长策略确定
+// 调用者需要持有 d.grow，或者 d 还没有被共享
+func (d *Directory) appendBlock(need uint32) *block {
+	size := d.nextSize
+	for size < need && size < d.maxBlockSize {
+		size = d.grownSize(size)
+	}
+	d.nextSize = d.grownSize(size)
+	return d.appendToTable(newBlock(size))
+}
+
+// grownSize size 的下一个 block 大小，翻倍但不超过 maxBlockSize
+func (d *Directory) grownSize(size uint32) uint32 {
+	if uint64(size)*2 >= uint64(d.maxBlockSize) {
+		return d.maxBlockSize
 	}
+	return size * 2
+}
+
+// appendHugeBlock 新建 size bytes 的 huge block 加入 block 表。调用者需要持有 d.grow
+func (d *Directory) appendHugeBlock(size uint32) *block {
+	b := newBlock(size)
+	b.huge = true
+	return d.appendToTable(b)
+}
+
+// appendToTable 复制出加入了 b 的 block 表，替换旧表
+func (d *Directory) appendToTable(b *block) *block {
+	old := *d.table.Load()
+	b.id = uint32(len(old))
+	table := make([]*block, len(old)+1)
+	copy(table, old)
+	table[b.id] = b
+	d.table.Store(&table)
+	return b
+}
+
+// blocks 当前的 block 表，不能修改
+func (d *Directory) blocks() []*block {
+	return *d.table.Load()
 }
 
 func (d *Directory) PointerAt(ptr Location) uintptr {
-	// 头指针 + 偏移
-	return d.blocks[ptr.BlockId].header + uintptr(ptr.BlockOffset)
+	return uintptr(d.Pointer(ptr))
+}
+
+// Pointer 头指针 + 偏移
+func (d *Directory) Pointer(ptr Location) unsafe.Pointer {
+	return unsafe.Add(d.blocks()[ptr.BlockId].base, ptr.BlockOffset)
+}
+
+// Bytes loc 开始的 n bytes，是 block 数据的切片，不复制，cap 也限制在 n 以内
+func (d *Directory) Bytes(loc Location, n uint32) []byte {
+	end := loc.BlockOffset + n
+	return d.blocks()[loc.BlockId].data[loc.BlockOffset:end:end]
+}
+
+// Contains loc 开始的 size 大小的内存是否在已分配的范围内
+func (d *Directory) Contains(loc Location, size uint32) bool {
+	blocks := d.blocks()
+	if loc.BlockId >= uint32(len(blocks)) {
+		return false
+	}
+	return uint64(loc.BlockOffset)+uint64(size) <= uint64(blocks[loc.BlockId].freeOffset.Load())
+}
+
+// AllocatedBytes 已经分配出去的字节数
+func (d *Directory) AllocatedBytes() uint64 {
+	sum := uint64(0)
+	for _, b := range d.blocks() {
+		sum += uint64(b.freeOffset.Load())
+	}
+	return sum
+}
+
+// ReservedBytes 所有 block 占用的字节数，包括 block 尾部未分配的部分
+func (d *Directory) ReservedBytes() uint64 {
+	sum := uint64(0)
+	for _, b := range d.blocks() {
+		sum += uint64(len(b.data))
+	}
+	return sum
 }
 
 func newBlock(blockSize uint32) *block {
 	data := make([]byte, blockSize, blockSize)
 	return &block{
-		data:       data,
-		header:     sliceHeader(data).Data,
-		freeOffset: 0,
-		remaining:  blockSize,
+		data: data,
+		base: unsafe.Pointer(&data[0]),
+	}
+}
+
+// bump 在 b 中分配 size 大小、地址按 align 对齐的内存，返回偏移。对齐跳过的部分不再使用。空间不足返回 false
+func (b *block) bump(size, align uint32) (offset uint32, ok bool) {
+	for {
+		free := b.freeOffset.Load()
+		offset = free + padding(uintptr(b.base)+uintptr(free), align)
+		if uint64(offset)+uint64(size) > uint64(len(b.data)) {
+			return 0, false
+		}
+		if b.freeOffset.CompareAndSwap(free, offset+size) {
+			return offset, true
+		}
 	}
 }
 
 func (d *Directory) String() string {
 	sb := strings.Builder{}
-	sb.WriteString(fmt.Sprintf("blockSize=%d, len(blocks)=%d\n", d.blockSize, len(d.blocks)))
-	for _, b := range d.blocks {
+	blocks := d.blocks()
+	sb.WriteString(fmt.Sprintf("blockSize=%d, maxBlockSize=%d, len(blocks)=%d\n", d.blockSize, d.maxBlockSize, len(blocks)))
+	for _, b := range blocks {
 		sb.WriteString(b.String() + "\n")
 	}
 	return sb.String()
 }
 
 func (b *block) String() string {
-	return fmt.Sprintf("header=%d, freeOffset=%d, remaining=%d", b.header, b.freeOffset, b.remaining)
-}
-
-func sliceHeader(bytes []byte) reflect.SliceHeader {
-	return *((*reflect.SliceHeader)(unsafe.Pointer(&bytes)))
+	free := b.freeOffset.Load()
+	huge := ""
+	if b.huge {
+		huge = ", huge"
+	}
+	return fmt.Sprintf("base=%p, size=%d, freeOffset=%d, remaining=%d%s", b.base, len(b.data), free, uint32(len(b.data))-free, huge)
 }
@@ -1,5 +1,11 @@
 package memory
 
+import (
+	"errors"
+	"fmt"
+	"unsafe"
+)
+
 /*
 bptree 工作需要用到内存管理工具，便于 mmap
 */
@@ -18,3 +24,198 @@ type MemManager interface {
 	// PointerAt 由内存定位器获取指针
 	PointerAt(loc Location) (pointer uintptr)
 }
+
+// ErrOutOfSpace 内存不足，Allocate 无法分配时以此 panic
+var ErrOutOfSpace = errors.New("memory: out of space")
+
+// Bounded 可选接口，判断 loc 开始的 size 大小的内存是否已经分配。用于检查数据损坏时避免读到分配之外的内存
+type Bounded interface {
+	Contains(loc Location, size uint32) bool
+}
+
+// Tag 分配的用途，由使用者标注，用于统计
+type Tag byte
+
+const (
+	TagUnknown Tag = iota // 未标注，即普通的 Allocate
+	TagNode               // bptree 的 node
+	TagValue              // bptree 的 value
+	TagKey                // bptree 的变长 key
+	TagMeta               // bptree 的元数据
+	tagCount
+)
+
+func (t Tag) String() string {
+	switch t {
+	case TagNode:
+		return "node"
+	case TagValue:
+		return "value"
+	case TagKey:
+		return "key"
+	case TagMeta:
+		return "meta"
+	default:
+		return "unknown"
+	}
+}
+
+// PointerManager 可选接口，以 unsafe.Pointer 返回指针
+// 内存在 Go 堆上时（例如 Directory），uintptr 转回 unsafe.Pointer 不被 checkptr 和 GC 认可，需要实现该接口
+type PointerManager interface {
+	Pointer(loc Location) unsafe.Pointer
+}
+
+// Pointer 由内存定位器获取指针。m 实现了 PointerManager 时由 m 返回，实现了 BytesManager 时取 Bytes 的起始地址，
+// 都没有实现时才转换 PointerAt 的结果，这要求内存不在 Go 堆上（例如 mmap），否则 checkptr 报错
+func Pointer(m MemManager, loc Location) unsafe.Pointer {
+	if pm, ok := m.(PointerManager); ok {
+		return pm.Pointer(loc)
+	}
+	if bm, ok := m.(BytesManager); ok {
+		return unsafe.Pointer(&bm.Bytes(loc, 1)[0])
+	}
+	return UintptrPointer(m.PointerAt(loc))
+}
+
+// UintptrPointer 把 uintptr 形式的地址转换回 unsafe.Pointer，以 uintptr 传递地址的旧 API（PointerAt、Allocate、bptree 的 Insert 等）都经过这里。
+// 这种转换只在地址指向 Go 堆之外的内存（例如 mmap），或者调用者在转换前后一直引用着对象时才是安全的，由旧 API 的调用者保证，
+// vet 和 checkptr 无法检查，因此集中在这一处。新代码直接传递 unsafe.Pointer，不需要它
+func UintptrPointer(p uintptr) unsafe.Pointer {
+	return *(*unsafe.Pointer)(unsafe.Pointer(&p))
+}
+
+// BytesManager 可选接口，直接返回 loc 开始的 n bytes 内存，不经过 uintptr
+type BytesManager interface {
+	Bytes(loc Location, n uint32) []byte
+}
+
+// Bytes loc 开始的 n bytes 内存，不复制。m 实现了 BytesManager 时由 m 返回，否则由 Pointer 构造
+func Bytes(m MemManager, loc Location, n uint32) []byte {
+	if bm, ok := m.(BytesManager); ok {
+		return bm.Bytes(loc, n)
+	}
+	if n == 0 {
+		return []byte{}
+	}
+	return unsafe.Slice((*byte)(Pointer(m, loc)), n)
+}
+
+// AlignedManager 可选接口，分配的内存起始地址是 align 的倍数，align 为 2 的幂
+// 没有实现该接口的 MemManager 由 AllocateAligned 多分配 align - 1 bytes 再跳过开头实现对齐
+type AlignedManager interface {
+	AllocateAligned(size, align uint32) (loc Location, pointer uintptr)
+}
+
+// AlignedTaggedManager 可选接口，分配时既要求对齐又附带用途，包装其他 MemManager 的统计、故障注入等需要实现
+type AlignedTaggedManager interface {
+	AllocateAlignedTagged(size, align uint32, tag Tag) (loc Location, pointer uintptr)
+}
+
+// AllocateAligned 附带用途分配 size 大小、起始地址按 align 对齐的内存。align 必须是 2 的幂
+func AllocateAligned(m MemManager, size, align uint32, tag Tag) (loc Location, pointer uintptr) {
+	checkAlign(align)
+	switch am := m.(type) {
+	case AlignedTaggedManager:
+		return am.AllocateAlignedTagged(size, align, tag)
+	case AlignedManager:
+		return am.AllocateAligned(size, align)
+	}
+	if align == 1 {
+		return AllocateTagged(m, size, tag)
+	}
+	loc, _ = AllocateTagged(m, size+align-1, tag)
+	loc.BlockOffset += padding(uintptr(Pointer(m, loc)), align)
+	return loc, uintptr(Pointer(m, loc))
+}
+
+// padding 地址 p 距离下一个 align 的倍数的字节数
+func padding(p uintptr, align uint32) uint32 {
+	return uint32(-p & uintptr(align-1))
+}
+
+func checkAlign(align uint32) {
+	if align == 0 || align&(align-1) != 0 {
+		panic(fmt.Sprintf("memory: align %d is not a power of 2", align))
+	}
+}
+
+// Scoped 可选接口，内存可能被移动（例如 Tiered 换出后读回）时实现
+// Enter 和 Exit 之间由 Pointer、PointerAt、Bytes 得到的指针一直有效，可以嵌套。没有实现该接口的 MemManager 指针总是有效
+type Scoped interface {
+	Enter()
+	Exit()
+}
+
+// Enter m 实现了 Scoped 时开始一个作用域
+func Enter(m MemManager) {
+	if s, ok := m.(Scoped); ok {
+		s.Enter()
+	}
+}
+
+// Exit m 实现了 Scoped 时结束 Enter 开始的作用域
+func Exit(m MemManager) {
+	if s, ok := m.(Scoped); ok {
+		s.Exit()
+	}
+}
+
+// Dirtier 可选接口，只写回修改过的内存时实现（例如 BufferPool）。修改了 Pointer 等得到的内存之后调用 MarkDirty
+type Dirtier interface {
+	MarkDirty(loc Location)
+}
+
+// MarkDirty m 实现了 Dirtier 时标记 loc 所在的内存被修改过
+func MarkDirty(m MemManager, loc Location) {
+	if d, ok := m.(Dirtier); ok {
+		d.MarkDirty(loc)
+	}
+}
+
+// Pinner 可选接口，内存可能被换出时实现（例如 BufferPool）。Pin 得到的指针到对应的 Unpin 之前一直有效，与作用域无关
+// 长时间的遍历逐个 Pin、Unpin 经过的内存，而不是让它们都留在作用域中
+type Pinner interface {
+	Pin(loc Location) unsafe.Pointer
+	Unpin(loc Location)
+}
+
+// Pin m 实现了 Pinner 时 Pin 住 loc，否则与 Pointer 相同
+func Pin(m MemManager, loc Location) unsafe.Pointer {
+	if p, ok := m.(Pinner); ok {
+		return p.Pin(loc)
+	}
+	return Pointer(m, loc)
+}
+
+// Unpin m 实现了 Pinner 时取消一次 Pin
+func Unpin(m MemManager, loc Location) {
+	if p, ok := m.(Pinner); ok {
+		p.Unpin(loc)
+	}
+}
+
+// Volatile 可选接口，内存同时被其他进程修改时 Volatile() 返回 true（例如 OpenShared 得到的读者）
+// 使用者不能保留从内存中读到的数据，bptree 在每个操作开始时从元数据重新读取根节点
+type Volatile interface {
+	Volatile() bool
+}
+
+// IsVolatile m 实现了 Volatile 并且 Volatile() 返回 true
+func IsVolatile(m MemManager) bool {
+	v, ok := m.(Volatile)
+	return ok && v.Volatile()
+}
+
+// TaggedManager 可选接口，分配时附带用途
+type TaggedManager interface {
+	AllocateTagged(size uint32, tag Tag) (loc Location, pointer uintptr)
+}
+
+// AllocateTagged m 实现了 TaggedManager 时附带用途分配，否则直接 Allocate
+func AllocateTagged(m MemManager, size uint32, tag Tag) (loc Location, pointer uintptr) {
+	if tm, ok := m.(TaggedManager); ok {
+		return tm.AllocateTagged(size, tag)
+	}
+	return m.Allocate(size)
+}
@@ -1,6 +1,9 @@
 package memory
 
 import (
+	"fmt"
+	"runtime"
+	"sync"
 	"testing"
 	"unsafe"
 )
@@ -9,11 +12,200 @@ func TestNew(t *testing.T) {
 	directory := New(1024)
 	t.Log(directory)
 	_, p := directory.Allocate(100)
-	*((*byte)(unsafe.Pointer(p))) = 1
-	*((*byte)(unsafe.Pointer(p + 1))) = 2
-	*((*byte)(unsafe.Pointer(p + 2))) = 3
-	t.Log(directory.blocks[0].data[:16])
+	*((*byte)(UintptrPointer(p))) = 1
+	*((*byte)(UintptrPointer(p + 1))) = 2
+	*((*byte)(UintptrPointer(p + 2))) = 3
+	t.Log(directory.blocks()[0].data[:16])
 	t.Log(directory)
 	_, _ = directory.Allocate(200)
 	t.Log(directory)
 }
+
+func TestAllocatedBytes(t *testing.T) {
+	directory := New(1024)
+	if directory.AllocatedBytes() != 0 || directory.ReservedBytes() != 1024 {
+		panic(directory.String())
+	}
+	directory.Allocate(1000)
+	directory.Allocate(100) // 放不下，新开一个 block
+	if directory.AllocatedBytes() != 1100 || directory.ReservedBytes() != 2048 {
+		panic(directory.String())
+	}
+}
+
+func TestBytes(t *testing.T) {
+	directory := New(1024)
+	directory.Allocate(10)
+	loc, _ := directory.Allocate(4)
+	b := Bytes(directory, loc, 4)
+	copy(b, "abcd")
+	if *(*byte)(unsafe.Add(Pointer(directory, loc), 3)) != 'd' || len(b) != 4 || cap(b) != 4 {
+		panic(string(b))
+	}
+
+	// 没有实现 BytesManager 时由 Pointer 构造
+	faulty := NewFaulty(directory)
+	var m MemManager = struct {
+		MemManager
+		PointerManager
+	}{faulty, faulty}
+	if string(Bytes(m, loc, 4)) != "abcd" || string(Bytes(faulty, loc, 2)) != "ab" || len(Bytes(m, loc, 0)) != 0 {
+		panic(string(Bytes(m, loc, 4)))
+	}
+
+	in := NewInstrumented(directory)
+	if string(Bytes(in, loc, 3)) != "abc" || in.PointerAtCounts()[0] != 1 {
+		panic(in.String())
+	}
+}
+
+func TestPointer(t *testing.T) {
+	directory := New(1024)
+	locs := make([]Location, 0)
+	for i := 0; i < 100; i++ {
+		loc, _ := directory.Allocate(8)
+		*(*int64)(directory.Pointer(loc)) = int64(i)
+		locs = append(locs, loc)
+	}
+	runtime.GC() // block 只由 Directory 引用
+	for i, loc := range locs {
+		if *(*int64)(Pointer(directory, loc)) != int64(i) || uintptr(directory.Pointer(loc)) != directory.PointerAt(loc) {
+			panic(i)
+		}
+	}
+
+	// 没有实现 PointerManager 时取 Bytes 的起始地址
+	var m MemManager = struct {
+		MemManager
+		BytesManager
+	}{directory, directory}
+	if Pointer(m, locs[1]) != directory.Pointer(locs[1]) || Pointer(NewFaulty(directory), locs[1]) != directory.Pointer(locs[1]) {
+		panic(locs[1])
+	}
+}
+
+func TestConcurrentAllocate(t *testing.T) {
+	for _, directory := range []*Directory{New(1024), NewWithArenas(1024)} {
+		const goroutines, count = 8, 1000
+		locs := make([][]Location, goroutines)
+		wg := sync.WaitGroup{}
+		for g := 0; g < goroutines; g++ {
+			g := g
+			wg.Add(1)
+			go func() {
+				defer wg.Done()
+				for i := 0; i < count; i++ {
+					loc, _ := directory.Allocate(8 + uint32(i%3)*8)
+					*(*int64)(directory.Pointer(loc)) = int64(g*count + i)
+					locs[g] = append(locs[g], loc)
+					// 同时读取其他 goroutine 分配的内存
+					if i > 0 && !directory.Contains(locs[g][i-1], 8) {
+						panic(locs[g][i-1])
+					}
+				}
+			}()
+		}
+		wg.Wait()
+
+		seen := map[Location]bool{}
+		allocated := uint64(0)
+		for g := range locs {
+			for i, loc := range locs[g] {
+				if seen[loc] || *(*int64)(directory.Pointer(loc)) != int64(g*count+i) {
+					panic(loc)
+				}
+				seen[loc] = true
+				allocated += 8 + uint64(i%3)*8
+			}
+		}
+		if directory.AllocatedBytes() != allocated || directory.ReservedBytes() < allocated {
+			panic(directory.String())
+		}
+	}
+}
+
+func TestArenasGC(t *testing.T) {
+	defer runtime.GOMAXPROCS(runtime.GOMAXPROCS(2))
+	directory := NewWithArenas(1 << 20)
+	for i := 0; i < 50; i++ {
+		directory.Allocate(64)
+		runtime.GC() // 清空 sync.Pool，arena 和它的 block 不受影响
+	}
+	if directory.AllocatedBytes() != 50*64 || len(directory.arenas) != 2 || directory.ReservedBytes() > 2<<20 {
+		panic(directory.String())
+	}
+}
+
+func TestAllocateAligned(t *testing.T) {
+	directory := New(1024)
+	directory.Allocate(3)
+	for _, align := range []uint32{1, 2, 8, 64} {
+		directory.Allocate(5)
+		loc, p := directory.AllocateAligned(12, align)
+		if p%uintptr(align) != 0 || uintptr(directory.Pointer(loc)) != p || !directory.Contains(loc, 12) {
+			panic(align)
+		}
+	}
+
+	// 没有实现 AlignedManager 时多分配再跳过开头
+	var m MemManager = struct{ MemManager }{directory}
+	in := NewInstrumented(m)
+	for i := 0; i < 10; i++ {
+		AllocateTagged(in, 3, TagValue)
+		loc, p := AllocateAligned(in, 16, 16, TagNode)
+		if p%16 != 0 || uintptr(Pointer(m, loc)) != p {
+			panic(loc)
+		}
+	}
+	if in.Stats(TagNode).Bytes != 160 {
+		panic(in.String())
+	}
+
+	defer func() {
+		if recover() == nil {
+			panic("align 3")
+		}
+	}()
+	directory.AllocateAligned(8, 3)
+}
+
+func TestGrowth(t *testing.T) {
+	directory := New(1024, WithGrowth(8192))
+	for i := 0; i < 30; i++ {
+		directory.Allocate(1000)
+	}
+	sizes := []int{}
+	for _, b := range directory.blocks() {
+		sizes = append(sizes, len(b.data))
+	}
+	if fmt.Sprint(sizes[:6]) != "[1024 2048 4096 8192 8192 8192]" {
+		panic(fmt.Sprint(sizes))
+	}
+
+	// 比下一个 block 还大的分配，block 继续翻倍直到放得下
+	directory = New(1024, WithGrowth(1<<16))
+	loc, _ := directory.Allocate(5000)
+	if loc.BlockId != 1 || len(directory.blocks()[1].data) != 8192 {
+		panic(directory.String())
+	}
+}
+
+func TestHugeBlock(t *testing.T) {
+	for _, directory := range []*Directory{New(1024), New(1024, WithGrowth(4096))} {
+		before, _ := directory.Allocate(8)
+		huge, p := directory.AllocateAligned(10000, 64)
+		if p%64 != 0 || !directory.Contains(huge, 10000) || !directory.blocks()[huge.BlockId].huge {
+			panic(directory.String())
+		}
+		copy(directory.Bytes(huge, 10000)[9990:], "0123456789")
+
+		// huge block 不影响普通 block 的分配
+		after, _ := directory.Allocate(8)
+		if after.BlockId != before.BlockId || after.BlockOffset != before.BlockOffset+8 {
+			panic(directory.String())
+		}
+		if string(directory.Bytes(huge, 10000)[9990:]) != "0123456789" {
+			panic(huge)
+		}
+	}
+}
@@ -0,0 +1,24 @@
+package memory
+
+import (
+	"fmt"
+	"unsafe"
+)
+
+// maxMovableAlign 内存会移动时（例如 Tiered 换出后读回），按 block 内偏移对齐，block 本身按 maxMovableAlign 对齐
+// 这样移动之后仍然是对齐的，align 不能超过它
+const maxMovableAlign = 64
+
+// movableBuffer 起始地址按 maxMovableAlign 对齐的 size bytes
+func movableBuffer(size uint32) []byte {
+	buf := make([]byte, size+maxMovableAlign-1)
+	pad := padding(uintptr(unsafe.Pointer(&buf[0])), maxMovableAlign)
+	return buf[pad : pad+size : pad+size]
+}
+
+func checkMovableAlign(align uint32) {
+	checkAlign(align)
+	if align > maxMovableAlign {
+		panic(fmt.Sprintf("memory: align %d is larger than %d", align, maxMovableAlign))
+	}
+}
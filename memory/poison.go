@@ -0,0 +1,9 @@
+//go:build !bptreedebug
+
+package memory
+
+// poisonEvicted 为 true 时 BufferPool 填充换出的页并且不再复用，见 poison_debug.go
+const poisonEvicted = false
+
+// poisonByte 以 bptreedebug 构建时换出的页被填充的值
+const poisonByte = 0xdb
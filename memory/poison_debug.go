@@ -0,0 +1,8 @@
+//go:build bptreedebug
+
+package memory
+
+// 以 bptreedebug 构建时 BufferPool 换出的页被填充为 poisonByte 并且不再复用，失效的指针读到的都是 poisonByte
+const poisonEvicted = true
+
+const poisonByte = 0xdb
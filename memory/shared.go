@@ -0,0 +1,296 @@
+//go:build linux || darwin || freebsd
+
+package memory
+
+import (
+	"errors"
+	"fmt"
+	"os"
+	"runtime"
+	"runtime/debug"
+	"sync"
+	"sync/atomic"
+	"syscall"
+	"unsafe"
+)
+
+/*
+多进程共享
+Shared 把一个文件整体 mmap（MAP_SHARED），文件放在 /dev/shm 下即为 POSIX 共享内存。一个写者进程以 CreateShared 建立并写入，
+多个读者进程以 OpenShared 只读映射同一个文件，不需要复制就能看到写者的数据。
+文件开头是 superblock（sharedHeader），之后按分配顺序连续存放数据，Location 由文件内偏移拆分得到。映射大小在创建时确定，不再增长，地址始终不变。
+一致性由 superblock 中的 seqlock 保证：
+1. 写者的最外层 Enter 把 seq 加一变为奇数，对应的 Exit 再加一变为偶数。bptree 的每个操作都在 Enter、Exit 之间，因此 seq 为偶数时树是完整的
+2. 读者在 Read(f) 中查询：等到 seq 为偶数再执行 f，f 结束后 seq 没有变化才说明 f 读到的是一致的数据，否则重新执行
+3. 写者以 Publish 发布元数据地址（bptree.Tree.MetaLocation），读者由 Published 得到，再 bptree.Open
+node 是原地修改的，f 执行期间可能读到修改了一半的数据，f 需要把结果复制出来，并且只在 Read 返回之后使用。
+读到不一致的地址时 Pointer 以 ErrOutOfSpace panic，访问到映射之外的内存也会 panic（debug.SetPanicOnFault），Read 发现 seq 变化后重试。
+不一致的数据也可能让 f 不停地循环（例如叶子链表成环），因此 Read 期间读者的 Pointer、Bytes 每次都检查 seq，
+seq 变化了就以 errTornRead panic，f 立即结束并重试。bptree 每读一个 node 都经过 Pointer，遍历不会在不一致的数据上一直进行下去
+*/
+
+// ErrReadOnly 只读的 MemManager 上分配或者修改时以此 panic
+var ErrReadOnly = errors.New("memory: read-only")
+
+// errTornRead Read 期间写者修改过，读者的 Pointer、Bytes 以此 panic 结束 f，由 Read 重试
+var errTornRead = errors.New("memory: shared memory changed during read")
+
+const (
+	sharedMagic     = uint32(0x53484d42) // SHMB
+	sharedBlockSize = uint64(1 << 20)    // Location 中一个 block 的大小，映射本身是连续的
+	sharedHeaderSz  = uint64(unsafe.Sizeof(sharedHeader{}))
+)
+
+// sharedHeader 文件开头的 superblock，多个进程同时访问，除 magic、size 外都使用原子操作
+type sharedHeader struct {
+	magic     uint32
+	_         uint32
+	size      uint64 // 映射大小，即文件大小
+	allocated uint64 // 已分配到的偏移
+	seq       uint64 // seqlock，奇数表示写者正在修改
+	published uint64 // 发布的地址，Location 编码为 BlockId<<32 | BlockOffset
+	_         [3]uint64
+}
+
+type Shared struct {
+	file     *os.File
+	data     []byte
+	base     unsafe.Pointer
+	header   *sharedHeader
+	readOnly bool
+	mu       sync.Mutex // 保护 depth
+	depth    int        // 写者 Enter 的嵌套层数
+	reading  uint64     // 读者 Read 开始时的 seq 加一，不在 Read 中时为 0
+}
+
+// CreateShared 创建（或截断）path 处 size bytes 的文件并可读写地映射，当前进程是唯一的写者。不再使用时需要 Close
+// 映射大小固定为 size，不会增长，用完之后分配以 ErrOutOfSpace panic，size 需要按数据量预留
+func CreateShared(path string, size uint64) (*Shared, error) {
+	if size < sharedHeaderSz || uint64(int(size)) != size {
+		return nil, fmt.Errorf("memory: bad shared size %d", size)
+	}
+	file, err := os.OpenFile(path, os.O_RDWR|os.O_CREATE|os.O_TRUNC, 0o644)
+	if err != nil {
+		return nil, err
+	}
+	if err := file.Truncate(int64(size)); err != nil {
+		file.Close()
+		return nil, err
+	}
+	s, err := mapShared(file, size, false)
+	if err != nil {
+		return nil, err
+	}
+	s.header.size = size
+	atomic.StoreUint64(&s.header.allocated, sharedHeaderSz)
+	atomic.StoreUint64(&s.header.published, locationBits(Location{BlockId: ^uint32(0)}))
+	atomic.StoreUint32(&s.header.magic, sharedMagic)
+	return s, nil
+}
+
+// OpenShared 只读映射 CreateShared 建立的文件，用于读者进程。分配时以 ErrReadOnly panic，修改映射的内存会导致进程崩溃
+// 映射大小是创建时的 size，写者不会增长文件，因此读者的映射总能覆盖写者分配的所有内存
+func OpenShared(path string) (*Shared, error) {
+	file, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	var h sharedHeader
+	if _, err := file.ReadAt(unsafe.Slice((*byte)(unsafe.Pointer(&h)), sharedHeaderSz), 0); err != nil {
+		file.Close()
+		return nil, err
+	}
+	if h.magic != sharedMagic || h.size < sharedHeaderSz || uint64(int(h.size)) != h.size {
+		file.Close()
+		return nil, fmt.Errorf("memory: %s is not a shared memory file", path)
+	}
+	return mapShared(file, h.size, true)
+}
+
+func mapShared(file *os.File, size uint64, readOnly bool) (*Shared, error) {
+	prot := syscall.PROT_READ
+	if !readOnly {
+		prot |= syscall.PROT_WRITE
+	}
+	data, err := syscall.Mmap(int(file.Fd()), 0, int(size), prot, syscall.MAP_SHARED)
+	if err != nil {
+		file.Close()
+		return nil, err
+	}
+	base := unsafe.Pointer(&data[0])
+	return &Shared{file: file, data: data, base: base, header: (*sharedHeader)(base), readOnly: readOnly}, nil
+}
+
+// Close 解除映射并关闭文件，之后不能再使用。文件不会被删除
+func (s *Shared) Close() error {
+	err := syscall.Munmap(s.data)
+	if e := s.file.Close(); err == nil {
+		err = e
+	}
+	return err
+}
+
+func (s *Shared) Allocate(size uint32) (loc Location, pointer uintptr) {
+	return s.AllocateAligned(size, 1)
+}
+
+// AllocateAligned 在映射中连续分配，起始地址按 align 对齐。映射用完时以 ErrOutOfSpace panic
+func (s *Shared) AllocateAligned(size, align uint32) (loc Location, pointer uintptr) {
+	checkAlign(align)
+	if s.readOnly {
+		panic(ErrReadOnly)
+	}
+	for {
+		old := atomic.LoadUint64(&s.header.allocated)
+		offset := old + uint64(padding(uintptr(old), align))
+		if offset+uint64(size) > s.header.size {
+			panic(fmt.Errorf("%w: shared memory of %d bytes is full", ErrOutOfSpace, s.header.size))
+		}
+		if atomic.CompareAndSwapUint64(&s.header.allocated, old, offset+uint64(size)) {
+			loc = Location{BlockId: uint32(offset / sharedBlockSize), BlockOffset: uint32(offset % sharedBlockSize)}
+			return loc, uintptr(unsafe.Add(s.base, offset))
+		}
+	}
+}
+
+func (s *Shared) PointerAt(loc Location) uintptr {
+	return uintptr(s.Pointer(loc))
+}
+
+// Pointer 映射中的地址，一直有效。loc 超出映射时以 ErrOutOfSpace panic，读者读到不一致的地址时会出现这种情况
+// 读者在 Read 中、写者已经修改过时以 errTornRead panic，由 Read 重试
+func (s *Shared) Pointer(loc Location) unsafe.Pointer {
+	s.checkRead()
+	offset := s.offset(loc)
+	if offset >= s.header.size {
+		panic(fmt.Errorf("%w: location %v is out of shared memory", ErrOutOfSpace, loc))
+	}
+	return unsafe.Add(s.base, offset)
+}
+
+// Bytes loc 开始的 n bytes，与 Pointer 一样检查 Read 期间写者是否修改过
+func (s *Shared) Bytes(loc Location, n uint32) []byte {
+	s.checkRead()
+	offset := s.offset(loc)
+	if offset+uint64(n) > s.header.size {
+		panic(fmt.Errorf("%w: location %v is out of shared memory", ErrOutOfSpace, loc))
+	}
+	return s.data[offset : offset+uint64(n) : offset+uint64(n)]
+}
+
+// Contains loc 开始的 size 大小的内存是否已经被写者分配
+func (s *Shared) Contains(loc Location, size uint32) bool {
+	return s.offset(loc)+uint64(size) <= atomic.LoadUint64(&s.header.allocated)
+}
+
+// Enter 写者开始修改，最外层的 Enter 使 seq 变为奇数。读者上没有作用
+func (s *Shared) Enter() {
+	if s.readOnly {
+		return
+	}
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if s.depth == 0 {
+		atomic.AddUint64(&s.header.seq, 1)
+	}
+	s.depth++
+}
+
+// Exit 结束 Enter，最外层的 Exit 使 seq 变回偶数，读者可以看到这之前的修改
+func (s *Shared) Exit() {
+	if s.readOnly {
+		return
+	}
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.depth--
+	if s.depth == 0 {
+		atomic.AddUint64(&s.header.seq, 1)
+	}
+}
+
+// Volatile 读者的内存同时被写者修改
+func (s *Shared) Volatile() bool {
+	return s.readOnly
+}
+
+// Publish 写者发布 loc（一般是树的元数据地址），读者由 Published 得到
+func (s *Shared) Publish(loc Location) {
+	if s.readOnly {
+		panic(ErrReadOnly)
+	}
+	s.Enter()
+	defer s.Exit()
+	atomic.StoreUint64(&s.header.published, locationBits(loc))
+}
+
+// Published 写者最后一次 Publish 的地址，没有发布过时 BlockId 为 ^uint32(0)
+func (s *Shared) Published() Location {
+	bits := atomic.LoadUint64(&s.header.published)
+	return Location{BlockId: uint32(bits >> 32), BlockOffset: uint32(bits)}
+}
+
+// Read 在写者没有修改的一段时间内执行 f，f 期间写者修改过时重新执行，直到 f 读到一致的数据。
+// f 可能被执行多次、读到不一致的数据，需要把结果复制出来并且只在 Read 返回之后使用。写者不能在自己的 Enter、Exit 之间调用 Read
+// 写者修改之后，f 中下一次 Pointer、Bytes 就结束这次执行，f 读到不一致的数据时不会一直执行下去。
+// 同一个 Shared 上同时只能有一个 Read，并发的读者各自 OpenShared
+func (s *Shared) Read(f func()) {
+	defer debug.SetPanicOnFault(debug.SetPanicOnFault(true))
+	for {
+		seq := atomic.LoadUint64(&s.header.seq)
+		if seq%2 == 1 {
+			runtime.Gosched()
+			continue
+		}
+		if s.try(f, seq) {
+			return
+		}
+	}
+}
+
+// try 执行一次 f，f 执行期间 seq 没有变化时返回 true。seq 变化了，f 的 panic 认为是读到了不一致的数据
+func (s *Shared) try(f func(), seq uint64) (ok bool) {
+	if s.readOnly {
+		atomic.StoreUint64(&s.reading, seq+1)
+		defer atomic.StoreUint64(&s.reading, 0)
+	}
+	defer func() {
+		if r := recover(); r != nil {
+			if atomic.LoadUint64(&s.header.seq) == seq {
+				panic(r)
+			}
+			ok = false
+		}
+	}()
+	f()
+	return atomic.LoadUint64(&s.header.seq) == seq
+}
+
+// checkRead 读者在 Read 中并且 seq 已经变化时以 errTornRead panic
+func (s *Shared) checkRead() {
+	if reading := atomic.LoadUint64(&s.reading); reading != 0 && atomic.LoadUint64(&s.header.seq) != reading-1 {
+		panic(errTornRead)
+	}
+}
+
+// Seq 当前的 seq，写者每次修改增加 2
+func (s *Shared) Seq() uint64 {
+	return atomic.LoadUint64(&s.header.seq)
+}
+
+// AllocatedBytes 已分配的字节数，包括 superblock
+func (s *Shared) AllocatedBytes() uint64 {
+	return atomic.LoadUint64(&s.header.allocated)
+}
+
+func (s *Shared) offset(loc Location) uint64 {
+	return uint64(loc.BlockId)*sharedBlockSize + uint64(loc.BlockOffset)
+}
+
+func locationBits(loc Location) uint64 {
+	return uint64(loc.BlockId)<<32 | uint64(loc.BlockOffset)
+}
+
+func (s *Shared) String() string {
+	return fmt.Sprintf("file=%s, size=%d, allocated=%d, seq=%d, readOnly=%v", s.file.Name(), s.header.size, s.AllocatedBytes(), s.Seq(), s.readOnly)
+}
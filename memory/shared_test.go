@@ -0,0 +1,122 @@
+//go:build linux || darwin || freebsd
+
+package memory
+
+import (
+	"errors"
+	"path/filepath"
+	"sync"
+	"testing"
+	"time"
+)
+
+func TestSharedMemory(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "shm")
+	writer, err := CreateShared(path, 1<<16)
+	if err != nil {
+		panic(err)
+	}
+	defer writer.Close()
+	reader, err := OpenShared(path)
+	if err != nil {
+		panic(err)
+	}
+	defer reader.Close()
+
+	// 读者不复制就能看到写者的分配和数据
+	loc, _ := writer.AllocateAligned(16, 8)
+	copy(writer.Bytes(loc, 16), "0123456789abcdef")
+	if string(reader.Bytes(loc, 16)) != "0123456789abcdef" || !reader.Contains(loc, 16) || reader.Contains(loc, 17) || uintptr(reader.Pointer(loc))%8 != 0 {
+		panic(reader.String())
+	}
+	// 映射不在 Go 堆上，只有 PointerAt 时也可以转换为 unsafe.Pointer
+	var m MemManager = struct{ MemManager }{reader}
+	if Pointer(m, loc) != reader.Pointer(loc) || string(Bytes(m, loc, 4)) != "0123" {
+		panic(reader.String())
+	}
+	if reader.Published().BlockId != ^uint32(0) {
+		panic(reader.Published())
+	}
+	writer.Publish(loc)
+	if reader.Published() != loc || reader.Seq()%2 != 0 || !reader.Volatile() || writer.Volatile() {
+		panic(reader.String())
+	}
+
+	// 写者修改期间读者看不到修改了一半的数据
+	pair, _ := writer.AllocateAligned(16, 8)
+	values := (*[2]uint64)(writer.Pointer(pair))
+	wg := sync.WaitGroup{}
+	wg.Add(1)
+	go func() {
+		defer wg.Done()
+		for i := uint64(1); i <= 20000; i++ {
+			writer.Enter()
+			values[0] = i
+			values[1] = i
+			writer.Exit()
+		}
+	}()
+	seen := (*[2]uint64)(reader.Pointer(pair))
+	for last := uint64(0); last < 20000; {
+		var a, b uint64
+		reader.Read(func() {
+			a, b = seen[0], seen[1]
+		})
+		if a != b || a < last {
+			panic(a)
+		}
+		last = a
+	}
+	wg.Wait()
+	if reader.Seq() != 2*20000+2 {
+		panic(reader.String())
+	}
+
+	// 读到不一致的地址时重试，没有修改时 panic 照常抛出
+	func() {
+		defer func() {
+			if err, ok := recover().(error); !ok || !errors.Is(err, ErrOutOfSpace) {
+				panic(err)
+			}
+		}()
+		reader.Read(func() {
+			reader.Pointer(Location{BlockId: 1})
+		})
+	}()
+
+	// 不一致的数据使 f 一直循环时，写者的修改让下一次 Pointer 结束 f，Read 重试
+	attempts := 0
+	go func() {
+		time.Sleep(10 * time.Millisecond)
+		writer.Enter()
+		writer.Exit()
+	}()
+	reader.Read(func() {
+		attempts++
+		for attempts == 1 {
+			reader.Pointer(loc)
+		}
+	})
+	if attempts != 2 {
+		panic(attempts)
+	}
+	// Read 之外不检查
+	writer.Enter()
+	reader.Bytes(loc, 16)
+	writer.Exit()
+
+	for _, f := range []func(){
+		func() { reader.Allocate(8) },
+		func() { reader.Publish(loc) },
+		func() { writer.Allocate(1 << 16) },
+	} {
+		func() {
+			defer func() {
+				if err, ok := recover().(error); !ok || !(errors.Is(err, ErrReadOnly) || errors.Is(err, ErrOutOfSpace)) {
+					panic(err)
+				}
+			}()
+			f()
+		}()
+	}
+}
@@ -0,0 +1,240 @@
+package memory
+
+import (
+	"container/list"
+	"fmt"
+	"os"
+	"sync"
+	"unsafe"
+)
+
+/*
+内存上限与换出
+Tiered 与 Directory 一样由 block 组成，但常驻 Go 堆的 block 总大小有上限 budget。
+超过上限时把最久没有使用的 block 写到本地文件，释放堆上的内存；之后通过 Pointer、PointerAt、Bytes 访问时再读回，地址会变化。
+因此指针只在一段时间内有效：
+1. Enter 和 Exit 之间（可以嵌套）得到的指针一直有效，换出只发生在最外层的 Exit
+2. 最外层 Exit 时，本次 Enter 之后用过的 block 不换出，它们的指针在下一次 Exit 之前仍然有效
+3. 不在 Enter、Exit 之间时，每次调用都相当于单独的一次 Enter、Exit
+bptree 的每个操作都在 Enter、Exit 之间进行。换出时总是把整个 block 写回文件，不区分是否修改过
+*/
+
+type Tiered struct {
+	mu        sync.Mutex
+	blockSize uint32
+	budget    uint64 // 常驻内存的上限
+	file      *os.File
+	fileEnd   int64 // 文件中已经分配给 block 的长度
+	blocks    []*tieredBlock
+	current   *tieredBlock // 从这里分配
+	lru       list.List    // 常驻的 block，最近使用的在前面
+	depth     int          // Enter 的嵌套层数
+	scope     uint64       // 当前作用域的编号，最外层 Enter 时增加
+	resident  uint64
+	spilled   uint64
+	spills    uint64 // 换出次数
+	loads     uint64 // 读回次数
+}
+
+type tieredBlock struct {
+	id         uint32
+	size       uint32
+	freeOffset uint32
+	data       []byte        // nil 表示已经换出
+	fileOffset int64         // 在文件中的位置，-1 表示从没有换出过
+	elem       *list.Element // 在 lru 中的位置，换出时为 nil
+	lastScope  uint64        // 最后一次使用时的 scope
+}
+
+// NewTiered 新建 Tiered，常驻内存不超过 budget bytes（当前作用域用到的 block 除外），换出的 block 写到 dir 下的临时文件
+// dir 为空时使用 os.TempDir()。不再使用时需要 Close
+func NewTiered(blockSize uint32, budget uint64, dir string) (*Tiered, error) {
+	file, err := os.CreateTemp(dir, "bptree-spill-*")
+	if err != nil {
+		return nil, err
+	}
+	return &Tiered{blockSize: blockSize, budget: budget, file: file}, nil
+}
+
+// Close 关闭并删除换出文件，之后不能再使用
+func (t *Tiered) Close() error {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	err := t.file.Close()
+	if e := os.Remove(t.file.Name()); err == nil {
+		err = e
+	}
+	return err
+}
+
+func (t *Tiered) Allocate(size uint32) (loc Location, pointer uintptr) {
+	return t.AllocateAligned(size, 1)
+}
+
+// AllocateAligned 分配 size 大小、起始地址按 align 对齐的内存。超过 block 大小时单独使用一个 block
+// block 读回后地址会变化，因此按 block 内偏移对齐，align 不能超过 maxMovableAlign
+func (t *Tiered) AllocateAligned(size, align uint32) (loc Location, pointer uintptr) {
+	checkMovableAlign(align)
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	defer t.access()()
+	need := uint64(size) + uint64(align) - 1
+	b := t.current
+	if need > uint64(t.blockSize) {
+		if need > uint64(^uint32(0)) {
+			panic(fmt.Errorf("%w: %d aligned to %d is too large", ErrOutOfSpace, size, align))
+		}
+		b = t.newBlock(uint32(need))
+	} else if b == nil || uint64(b.freeOffset)+need > uint64(b.size) {
+		b = t.newBlock(t.blockSize)
+		t.current = b
+	}
+	t.load(b)
+	offset := b.freeOffset + padding(uintptr(b.freeOffset), align)
+	b.freeOffset = offset + size
+	loc = Location{BlockId: b.id, BlockOffset: offset}
+	return loc, uintptr(unsafe.Add(unsafe.Pointer(&b.data[0]), offset))
+}
+
+func (t *Tiered) PointerAt(loc Location) uintptr {
+	return uintptr(t.Pointer(loc))
+}
+
+// Pointer 换出的 block 先读回，返回的指针有效期见 Tiered
+func (t *Tiered) Pointer(loc Location) unsafe.Pointer {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	defer t.access()()
+	b := t.blocks[loc.BlockId]
+	t.load(b)
+	return unsafe.Add(unsafe.Pointer(&b.data[0]), loc.BlockOffset)
+}
+
+// Bytes 与 Pointer 相同，返回 block 数据的切片
+func (t *Tiered) Bytes(loc Location, n uint32) []byte {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	defer t.access()()
+	b := t.blocks[loc.BlockId]
+	t.load(b)
+	end := loc.BlockOffset + n
+	return b.data[loc.BlockOffset:end:end]
+}
+
+// Contains loc 开始的 size 大小的内存是否在已分配的范围内，不需要读回 block
+func (t *Tiered) Contains(loc Location, size uint32) bool {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	if loc.BlockId >= uint32(len(t.blocks)) {
+		return false
+	}
+	return uint64(loc.BlockOffset)+uint64(size) <= uint64(t.blocks[loc.BlockId].freeOffset)
+}
+
+// Enter 开始一个作用域，到对应的 Exit 为止得到的指针都有效
+func (t *Tiered) Enter() {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	t.enter()
+}
+
+// Exit 结束 Enter 开始的作用域。最外层的 Exit 把超出上限的 block 换出
+func (t *Tiered) Exit() {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	t.exit()
+}
+
+func (t *Tiered) enter() {
+	if t.depth == 0 {
+		t.scope++
+	}
+	t.depth++
+}
+
+func (t *Tiered) exit() {
+	t.depth--
+	if t.depth > 0 {
+		return
+	}
+	// 从最久没有使用的开始换出，当前作用域用过的不换出
+	for t.resident > t.budget {
+		e := t.lru.Back()
+		if e == nil || e.Value.(*tieredBlock).lastScope == t.scope {
+			return
+		}
+		t.spill(e.Value.(*tieredBlock))
+	}
+}
+
+// access 一次访问。不在作用域中时相当于单独的一次 Enter、Exit，返回的函数结束该作用域
+func (t *Tiered) access() func() {
+	t.enter()
+	return t.exit
+}
+
+// newBlock 新建 size 大小的 block，调用者持有 t.mu
+func (t *Tiered) newBlock(size uint32) *tieredBlock {
+	b := &tieredBlock{id: uint32(len(t.blocks)), size: size, fileOffset: -1}
+	t.blocks = append(t.blocks, b)
+	b.data = movableBuffer(size)
+	b.elem = t.lru.PushFront(b)
+	t.resident += uint64(size)
+	return b
+}
+
+// load 在当前作用域中使用 b，换出了的先读回。调用者持有 t.mu
+func (t *Tiered) load(b *tieredBlock) {
+	b.lastScope = t.scope
+	if b.data != nil {
+		t.lru.MoveToFront(b.elem)
+		return
+	}
+	data := movableBuffer(b.size)
+	if _, err := t.file.ReadAt(data, b.fileOffset); err != nil {
+		panic(fmt.Errorf("memory: load block %d: %w", b.id, err))
+	}
+	b.data = data
+	b.elem = t.lru.PushFront(b)
+	t.resident += uint64(b.size)
+	t.spilled -= uint64(b.size)
+	t.loads++
+}
+
+// spill 把 b 写到文件并释放内存。调用者持有 t.mu
+func (t *Tiered) spill(b *tieredBlock) {
+	if b.fileOffset < 0 {
+		b.fileOffset = t.fileEnd
+		t.fileEnd += int64(b.size)
+	}
+	if _, err := t.file.WriteAt(b.data, b.fileOffset); err != nil {
+		panic(fmt.Errorf("memory: spill block %d: %w", b.id, err))
+	}
+	b.data = nil
+	t.lru.Remove(b.elem)
+	b.elem = nil
+	t.resident -= uint64(b.size)
+	t.spilled += uint64(b.size)
+	t.spills++
+}
+
+// ResidentBytes 常驻 Go 堆的 block 总大小
+func (t *Tiered) ResidentBytes() uint64 {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	return t.resident
+}
+
+// SpilledBytes 换出到文件、当前不在内存中的 block 总大小
+func (t *Tiered) SpilledBytes() uint64 {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	return t.spilled
+}
+
+func (t *Tiered) String() string {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	return fmt.Sprintf("blockSize=%d, budget=%d, len(blocks)=%d, resident=%d, spilled=%d, spills=%d, loads=%d",
+		t.blockSize, t.budget, len(t.blocks), t.resident, t.spilled, t.spills, t.loads)
+}
@@ -0,0 +1,71 @@
+package memory
+
+import (
+	"encoding/binary"
+	"os"
+	"testing"
+)
+
+func TestTiered(t *testing.T) {
+	tiered, err := NewTiered(1024, 4096, t.TempDir())
+	if err != nil {
+		panic(err)
+	}
+	defer tiered.Close()
+
+	locs := make([]Location, 0)
+	for i := 0; i < 1000; i++ {
+		loc, _ := tiered.AllocateAligned(8+uint32(i%5), 8)
+		binary.LittleEndian.PutUint64(tiered.Bytes(loc, 8), uint64(i))
+		locs = append(locs, loc)
+	}
+	if tiered.ResidentBytes() > 4096 || tiered.SpilledBytes() == 0 || tiered.ResidentBytes()+tiered.SpilledBytes() != uint64(len(tiered.blocks))*1024 {
+		panic(tiered.String())
+	}
+	for i, loc := range locs {
+		// 换出后读回的 block 地址变化，仍然是对齐的
+		if binary.LittleEndian.Uint64(tiered.Bytes(loc, 8)) != uint64(i) || !tiered.Contains(loc, 8) || uintptr(tiered.Pointer(loc))%8 != 0 {
+			panic(i)
+		}
+	}
+	if tiered.ResidentBytes() > 4096 {
+		panic(tiered.String())
+	}
+
+	// 作用域中用到的 block 不换出，地址不变
+	tiered.Enter()
+	first := tiered.Pointer(locs[0])
+	for _, loc := range locs {
+		tiered.Pointer(loc)
+	}
+	if tiered.ResidentBytes() <= 4096 || tiered.Pointer(locs[0]) != first {
+		panic(tiered.String())
+	}
+	tiered.Exit()
+	// 刚结束的作用域用到的 block 在下一次 Exit 时才换出
+	if tiered.ResidentBytes() <= 4096 {
+		panic(tiered.String())
+	}
+	tiered.Pointer(locs[0])
+	if tiered.ResidentBytes() > 4096 {
+		panic(tiered.String())
+	}
+
+	// 超过 block 大小的分配
+	huge, _ := tiered.Allocate(3000)
+	copy(tiered.Bytes(huge, 3000)[2990:], "0123456789")
+	for _, loc := range locs {
+		tiered.Pointer(loc)
+	}
+	if string(tiered.Bytes(huge, 3000)[2990:]) != "0123456789" {
+		panic(tiered.String())
+	}
+
+	name := tiered.file.Name()
+	if err := tiered.Close(); err != nil {
+		panic(err)
+	}
+	if _, err := os.Stat(name); !os.IsNotExist(err) {
+		panic(err)
+	}
+}
@@ -0,0 +1,75 @@
+package memory
+
+import "unsafe"
+
+/*
+包装类型的可选接口
+Instrumented、FaultyManager 包装其他 MemManager，使用者（例如 bptree）按 MemManager 是否实现 Scoped、Pinner、Dirtier、Volatile 决定行为，
+因此包装之后只能实现 inner 实现了的这些接口。Go 不能按条件增加方法，NewInstrumented、NewFaulty 按 inner 实现的接口，
+把包装类型和下面的 forwardXxx 组合成不同的类型，forwardXxx 把方法转发给 inner
+*/
+
+// optional inner 实现的可选接口，每个接口一位
+type optional uint8
+
+const (
+	optScoped optional = 1 << iota
+	optPinner
+	optDirtier
+	optVolatile
+)
+
+func optionalOf(m MemManager) (o optional) {
+	if _, ok := m.(Scoped); ok {
+		o |= optScoped
+	}
+	if _, ok := m.(Pinner); ok {
+		o |= optPinner
+	}
+	if _, ok := m.(Dirtier); ok {
+		o |= optDirtier
+	}
+	if _, ok := m.(Volatile); ok {
+		o |= optVolatile
+	}
+	return o
+}
+
+type forwardScoped struct{ inner MemManager }
+
+func (f forwardScoped) Enter() {
+	Enter(f.inner)
+}
+
+func (f forwardScoped) Exit() {
+	Exit(f.inner)
+}
+
+// forwardPinner pinned 不为 nil 时，每次 Pin 之前调用，用于统计
+type forwardPinner struct {
+	inner  MemManager
+	pinned func(loc Location)
+}
+
+func (f forwardPinner) Pin(loc Location) unsafe.Pointer {
+	if f.pinned != nil {
+		f.pinned(loc)
+	}
+	return Pin(f.inner, loc)
+}
+
+func (f forwardPinner) Unpin(loc Location) {
+	Unpin(f.inner, loc)
+}
+
+type forwardDirtier struct{ inner MemManager }
+
+func (f forwardDirtier) MarkDirty(loc Location) {
+	MarkDirty(f.inner, loc)
+}
+
+type forwardVolatile struct{ inner MemManager }
+
+func (f forwardVolatile) Volatile() bool {
+	return IsVolatile(f.inner)
+}